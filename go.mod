@@ -5,16 +5,22 @@ go 1.24.0
 toolchain go1.24.5
 
 require (
+	github.com/eclipse/paho.mqtt.golang v1.5.1
 	github.com/google/safehtml v0.1.1-0.20231004162613-be2313499843
 	github.com/gorilla/csrf v1.7.3
 	github.com/gorilla/mux v1.8.1
+	github.com/gorilla/securecookie v1.1.2
 	github.com/gorilla/sessions v1.4.0
 	github.com/joho/godotenv v1.5.1
 	github.com/kardianos/service v1.2.4
+	golang.org/x/sys v0.36.0
+	gopkg.in/yaml.v3 v3.0.1
+	rsc.io/qr v0.2.0
 )
 
 require (
-	github.com/gorilla/securecookie v1.1.2 // indirect
-	golang.org/x/sys v0.35.0 // indirect
-	golang.org/x/text v0.28.0 // indirect
+	github.com/gorilla/websocket v1.5.3 // indirect
+	golang.org/x/net v0.44.0 // indirect
+	golang.org/x/sync v0.17.0 // indirect
+	golang.org/x/text v0.29.0 // indirect
 )
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of alert rules.
+const (
+	alertFreePercent       = "free_percent"
+	alertFreeGB            = "free_gb"
+	alertInodesFreePercent = "inodes_free_percent"
+	alertSMART             = "smart"
+	alertMissing           = "missing"
+)
+
+var alertKinds = []string{alertFreePercent, alertFreeGB, alertInodesFreePercent, alertSMART, alertMissing}
+
+const (
+	alertWarning  = "warning"
+	alertCritical = "critical"
+)
+
+// Notification channels of alerts.
+const (
+	channelWebhook = "webhook"
+	channelMQTT    = "mqtt"
+	channelEmail   = "email"
+)
+
+var alertChannels = []string{channelWebhook, channelMQTT, channelEmail}
+
+// alert is a rule firing for one drive.
+type alert struct {
+	Rule     string    `json:"rule"`
+	Kind     string    `json:"kind"`
+	Severity string    `json:"severity"`
+	UUID     string    `json:"uuid"`
+	Path     string    `json:"path"`
+	Message  string    `json:"message"`
+	Since    time.Time `json:"since"`
+	Resolved bool      `json:"resolved,omitempty"` // only in notifications
+}
+
+// Key identifies the alert across evaluations, also in MQTT topics.
+func (a alert) Key() string {
+	return a.Rule + "_" + a.UUID
+}
+
+// IsCritical is used by the banners.
+func (a alert) IsCritical() bool {
+	return a.Severity == alertCritical
+}
+
+// alertDrive is what a rule is evaluated on: a drive known from the history
+// or the current mounts.
+type alertDrive struct {
+	UUID, Device, Path string
+	Mount              *Mount // nil if not mounted
+	Attached           bool
+}
+
+// alertEvaluator evaluates the rules every alerts.interval. A rule fires below
+// its threshold and resolves only at or above clear, so a value around the
+// threshold does not notify on every evaluation.
+type alertEvaluator struct {
+	mu      sync.Mutex
+	firing  map[string]*alert    // by Key
+	missing map[string]time.Time // first evaluation the drive was gone, by UUID
+	bridge  *mqttBridge
+}
+
+var alerts = &alertEvaluator{firing: map[string]*alert{}, missing: map[string]time.Time{}}
+
+// Active returns the firing alerts, critical ones first.
+func (e *alertEvaluator) Active() []alert {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	active := []alert{}
+	for _, a := range e.firing {
+		active = append(active, *a)
+	}
+	slices.SortFunc(active, func(a, b alert) int {
+		if a.IsCritical() != b.IsCritical() {
+			if a.IsCritical() {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(a.Key(), b.Key())
+	})
+	return active
+}
+
+// Run evaluates the rules until ctx is done. Notifications to MQTT go through
+// bridge, which may be nil.
+func (e *alertEvaluator) Run(ctx context.Context, bridge *mqttBridge) {
+	e.bridge = bridge
+	timer := time.NewTimer(10 * time.Second) // let the first status settle
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		if len(config().Alerts.Rules) > 0 {
+			e.Evaluate(systemStatusCache.Get(ctx, false))
+		}
+		timer.Reset(config().Alerts.Interval)
+	}
+}
+
+// Evaluate checks all rules against a status collection.
+func (e *alertEvaluator) Evaluate(status *SystemStatus) {
+	if status.ErrorMounts != nil {
+		return // an unknown mount list must not look like missing drives
+	}
+	drives := alertDrives(status)
+	now := time.Now()
+
+	e.mu.Lock()
+	for _, d := range drives {
+		if d.Attached {
+			delete(e.missing, d.UUID)
+		} else if _, ok := e.missing[d.UUID]; !ok {
+			e.missing[d.UUID] = now
+		}
+	}
+	missing := map[string]time.Time{}
+	for uuid, since := range e.missing {
+		missing[uuid] = since
+	}
+	e.mu.Unlock()
+
+	for _, rule := range config().Alerts.Rules {
+		for _, d := range drives {
+			if len(rule.Drives) > 0 && !slices.Contains(rule.Drives, d.UUID) && !slices.Contains(rule.Drives, d.Path) {
+				continue
+			}
+			fire, message, known := evaluateRule(rule, d, missing[d.UUID])
+			if known {
+				e.update(rule, d, fire, message)
+			}
+		}
+	}
+
+	// Rules or drives that are gone from the config resolve.
+	e.mu.Lock()
+	stale := []*alert{}
+	for key, a := range e.firing {
+		rule, ok := alertRule(a.Rule)
+		if !ok || (len(rule.Drives) > 0 && !slices.Contains(rule.Drives, a.UUID) && !slices.Contains(rule.Drives, a.Path)) {
+			delete(e.firing, key)
+			stale = append(stale, a)
+		}
+	}
+	e.mu.Unlock()
+	for _, a := range stale {
+		a.Resolved, a.Message = true, "rule removed"
+		e.notify(AlertRule{Name: a.Rule}, *a)
+	}
+}
+
+// evaluateRule returns whether the rule fires for the drive. Values that can't
+// be measured right now, e.g. free space of an unmounted drive, are not known
+// and leave the alert as it is.
+func evaluateRule(rule AlertRule, d alertDrive, missingSince time.Time) (fire bool, message string, known bool) {
+	resolveAt := rule.Clear
+	if resolveAt == 0 {
+		resolveAt = rule.Below * 1.2
+	}
+	threshold := func(value float64, unit string) (bool, string, bool) {
+		message := fmt.Sprintf("%s: %.1f%s, alert below %g%s", rule.Kind, value, unit, rule.Below, unit)
+		if value < rule.Below {
+			return true, message, true
+		}
+		return false, message, value >= resolveAt
+	}
+
+	switch rule.Kind {
+	case alertFreePercent:
+		if d.Mount != nil && d.Mount.TotalBytes > 0 {
+			return threshold(float64(d.Mount.FreeBytes)/float64(d.Mount.TotalBytes)*100, "% free")
+		}
+	case alertFreeGB:
+		if d.Mount != nil && d.Mount.TotalBytes > 0 {
+			return threshold(float64(d.Mount.FreeBytes)/(1<<30), " GB free")
+		}
+	case alertInodesFreePercent:
+		if d.Mount != nil && d.Mount.Inodes > 0 {
+			return threshold(float64(d.Mount.FreeInodes)/float64(d.Mount.Inodes)*100, "% inodes free")
+		}
+	case alertSMART:
+		if !d.Attached || d.Device == "" {
+			return false, "", false
+		}
+		report := smartReports.Get(wholeDisk(d.Device))
+		if report == nil || report.Source == "" || report.Error != "" {
+			return false, "", false
+		}
+		warnings := report.Warnings()
+		message := "SMART overall health " + map[bool]string{true: "passed", false: "FAILED"}[report.Passed]
+		if len(warnings) > 0 {
+			message = "SMART: " + strings.Join(warnings, "; ")
+		}
+		return len(warnings) > 0, message, true
+	case alertMissing:
+		if d.Attached {
+			return false, "", true
+		}
+		gone := time.Since(missingSince)
+		return gone >= rule.For, fmt.Sprintf("missing for %s", gone.Round(time.Minute)), true
+	}
+	return false, "", false
+}
+
+// update records a state change of a rule on a drive and notifies it.
+func (e *alertEvaluator) update(rule AlertRule, d alertDrive, fire bool, message string) {
+	key := alert{Rule: rule.Name, UUID: d.UUID}.Key()
+	e.mu.Lock()
+	current, firing := e.firing[key]
+	switch {
+	case fire && firing:
+		current.Message = message
+		e.mu.Unlock()
+		return
+	case fire:
+		severity := rule.Severity
+		if severity == "" {
+			severity = alertWarning
+		}
+		current = &alert{Rule: rule.Name, Kind: rule.Kind, Severity: severity, UUID: d.UUID, Path: d.Path, Message: message, Since: time.Now()}
+		e.firing[key] = current
+	case firing:
+		delete(e.firing, key)
+		current.Resolved, current.Message = true, message
+	default:
+		e.mu.Unlock()
+		return
+	}
+	notification := *current
+	e.mu.Unlock()
+	e.notify(rule, notification)
+}
+
+// notify logs an alert that fired or resolved and sends it to the channels of
+// the rule.
+func (e *alertEvaluator) notify(rule AlertRule, a alert) {
+	state, event := "firing", webhookAlertFiring
+	if a.Resolved {
+		state, event = "resolved", webhookAlertResolved
+	}
+	logger.Warningf("[alerts] %s %s on %s (%s): %s", a.Rule, state, a.Path, a.UUID, a.Message)
+
+	channels := rule.Notify
+	if len(channels) == 0 {
+		channels = alertChannels
+	}
+	if slices.Contains(channels, channelWebhook) {
+		webhooks.Emit(event, a)
+	}
+	if slices.Contains(channels, channelMQTT) {
+		e.bridge.publishAlert(a)
+	}
+	if slices.Contains(channels, channelEmail) && len(config().Alerts.Email.To) > 0 {
+		go func() {
+			subject := fmt.Sprintf("[unmounter] %s %s: %s on %s", a.Severity, state, a.Rule, a.Path)
+			body := fmt.Sprintf("%s\n\nRule:   %s\nDrive:  %s (UUID %s)\nSince:  %s\n", a.Message, a.Rule, a.Path, a.UUID, a.Since.Format(time.RFC1123))
+			if err := sendEmail(subject, body); err != nil {
+				logger.Errorf("[alerts] failed to send email for %s: %v", a.Key(), err)
+			}
+		}()
+	}
+}
+
+func alertRule(name string) (AlertRule, bool) {
+	for _, rule := range config().Alerts.Rules {
+		if rule.Name == name {
+			return rule, true
+		}
+	}
+	return AlertRule{}, false
+}
+
+// alertDrives merges the drives of the history with the current mounts and
+// attached block devices.
+func alertDrives(status *SystemStatus) []alertDrive {
+	attached, err := attachedDrives()
+	drives := map[string]*alertDrive{}
+	for _, h := range history.Drives() {
+		if h.UUID == deviceKey(h.Device) {
+			continue // another drive may be attached under the same name
+		}
+		_, present := attached[h.UUID]
+		drives[h.UUID] = &alertDrive{UUID: h.UUID, Device: h.Device, Path: h.Path, Attached: present}
+	}
+	for i := range status.Mounts {
+		m := &status.Mounts[i]
+		if m.UUID == "" {
+			continue
+		}
+		d, ok := drives[m.UUID]
+		if !ok {
+			d = &alertDrive{UUID: m.UUID}
+			drives[m.UUID] = d
+		}
+		d.Device, d.Path, d.Mount, d.Attached = m.Device, m.Path, m, true
+	}
+	if err != nil {
+		// Without /dev/disk/by-uuid only mounted drives count as attached.
+		for _, d := range drives {
+			d.Attached = d.Mount != nil
+		}
+	}
+	list := []alertDrive{}
+	for _, uuid := range sortedKeys(drives) {
+		list = append(list, *drives[uuid])
+	}
+	return list
+}
+
+// sendEmail sends a plain text mail to alerts.email.to through the relay.
+func sendEmail(subject, body string) error {
+	cfg := config().Alerts.Email
+	from := cfg.From
+	if from == "" {
+		hostname, _ := os.Hostname()
+		from = "unmounter@" + hostname
+	}
+	conn, err := net.DialTimeout("tcp", cfg.SMTP, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	host, _, _ := net.SplitHostPort(cfg.SMTP)
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if err := client.Mail(from); err != nil {
+		return err
+	}
+	for _, to := range cfg.To {
+		if err := client.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	message := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s",
+		from, strings.Join(cfg.To, ", "), subject, time.Now().Format(time.RFC1123Z), strings.ReplaceAll(body, "\n", "\r\n"))
+	if _, err := w.Write([]byte(message)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
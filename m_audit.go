@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Outcomes of an audited action.
+const (
+	auditSuccess = "success"
+	auditFailure = "failure"
+	auditDenied  = "denied"
+)
+
+// auditEntry is one line of the audit log.
+type auditEntry struct {
+	Time    time.Time `json:"time"`
+	User    string    `json:"user"`
+	Token   string    `json:"token,omitempty"`  // id of the API token used
+	Source  string    `json:"source"`           // client IP, "cli" or "signal"; empty if unknown
+	Action  string    `json:"action"`           // e.g. unmount, kill, restart, token.create
+	Target  string    `json:"target,omitempty"` // mount path, "pid (command)", unit, ...
+	Outcome string    `json:"outcome"`
+	Error   string    `json:"error,omitempty"`
+	Output  string    `json:"output,omitempty"` // hooks: the end of stdout and stderr
+}
+
+func (e auditEntry) String() string {
+	s := e.User
+	if e.Source != "" {
+		s += " from " + e.Source
+	}
+	s += fmt.Sprintf(": %s %s: %s", e.Action, e.Target, e.Outcome)
+	if e.Error != "" {
+		s += ": " + e.Error
+	}
+	return s
+}
+
+// auditLog appends entries as JSON lines to the configured file. Once the
+// file grows over audit.max_size_mb it is rotated to file.1, file.2, ... and
+// the oldest beyond audit.max_files is removed.
+type auditLog struct {
+	mu sync.Mutex
+}
+
+var audit = &auditLog{}
+
+// Record writes the entry to the audit file and the service log. Failing to
+// write the file is logged but does not fail the action.
+func (a *auditLog) Record(e auditEntry) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	actionsTotal.Inc(e.Action, e.Outcome)
+	if e.Outcome == auditSuccess {
+		logger.Info("[audit] " + e.String())
+	} else {
+		logger.Warning("[audit] " + e.String())
+	}
+
+	cfg := config().Audit
+	if cfg.File == "" {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.append(cfg, e); err != nil {
+		logger.Errorf("[audit] failed to write %s: %v", cfg.File, err)
+	}
+}
+
+func (a *auditLog) append(cfg AuditConfig, e auditEntry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	if err := os.MkdirAll(filepath.Dir(cfg.File), 0o700); err != nil {
+		return err
+	}
+	if info, err := os.Stat(cfg.File); err == nil && info.Size()+int64(len(line)) > int64(cfg.MaxSizeMB)<<20 {
+		if err := rotateAuditFiles(cfg.File, cfg.MaxFiles); err != nil {
+			return fmt.Errorf("failed to rotate: %v", err)
+		}
+	}
+
+	f, err := os.OpenFile(cfg.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(line); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// rotateAuditFiles shifts file.N-1 to file.N, ..., file to file.1.
+func rotateAuditFiles(path string, keep int) error {
+	if err := os.Remove(auditFileName(path, keep)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	for i := keep - 1; i >= 0; i-- {
+		err := os.Rename(auditFileName(path, i), auditFileName(path, i+1))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+func auditFileName(path string, generation int) string {
+	if generation == 0 {
+		return path
+	}
+	return path + "." + strconv.Itoa(generation)
+}
+
+// auditFilter selects audit entries. Empty fields match everything; Action
+// matches by prefix, so "token" finds token.create and token.revoke, and
+// Text searches user, source, target, error and output.
+type auditFilter struct {
+	User    string
+	Action  string
+	Outcome string
+	Text    string
+	Since   time.Time
+	Limit   int
+}
+
+const auditDefaultLimit = 200
+
+func (f auditFilter) match(e auditEntry) bool {
+	if f.User != "" && e.User != f.User {
+		return false
+	}
+	if f.Action != "" && !strings.HasPrefix(e.Action, f.Action) {
+		return false
+	}
+	if f.Outcome != "" && e.Outcome != f.Outcome {
+		return false
+	}
+	if f.Text != "" {
+		text := strings.ToLower(f.Text)
+		if !slices.ContainsFunc([]string{e.User, e.Source, e.Target, e.Error, e.Output}, func(s string) bool { return strings.Contains(strings.ToLower(s), text) }) {
+			return false
+		}
+	}
+	return true
+}
+
+// auditFilterFrom reads the filter from the query parameters user, action,
+// outcome, q, since (a duration like 24h or an RFC 3339 time) and limit.
+func auditFilterFrom(r *http.Request) (auditFilter, error) {
+	query := r.URL.Query()
+	f := auditFilter{
+		User:    strings.TrimSpace(query.Get("user")),
+		Action:  strings.TrimSpace(query.Get("action")),
+		Outcome: strings.TrimSpace(query.Get("outcome")),
+		Text:    strings.TrimSpace(query.Get("q")),
+		Limit:   auditDefaultLimit,
+	}
+	if since := strings.TrimSpace(query.Get("since")); since != "" {
+		if d, err := time.ParseDuration(since); err == nil {
+			f.Since = time.Now().Add(-d)
+		} else if t, err := time.Parse(time.RFC3339, since); err == nil {
+			f.Since = t
+		} else {
+			return f, fmt.Errorf("invalid since %q, use a duration like 24h or an RFC 3339 time", since)
+		}
+	}
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 {
+			return f, fmt.Errorf("invalid limit %q", limit)
+		}
+		f.Limit = min(n, 5000)
+	}
+	return f, nil
+}
+
+// Query returns the matching entries, newest first, from the current and the
+// rotated files.
+func (a *auditLog) Query(f auditFilter) ([]auditEntry, error) {
+	cfg := config().Audit
+	entries := []auditEntry{}
+	if cfg.File == "" {
+		return entries, nil
+	}
+
+	for generation := 0; generation <= cfg.MaxFiles; generation++ {
+		a.mu.Lock()
+		data, err := os.ReadFile(auditFileName(cfg.File, generation))
+		a.mu.Unlock()
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return entries, fmt.Errorf("failed to read audit log: %v", err)
+		}
+
+		lines := bytes.Split(bytes.TrimSpace(data), []byte("\n"))
+		for _, line := range slices.Backward(lines) {
+			var e auditEntry
+			if err := json.Unmarshal(line, &e); err != nil {
+				continue // a line cut off by a crash
+			}
+			if e.Time.Before(f.Since) {
+				return entries, nil
+			}
+			if f.match(e) {
+				entries = append(entries, e)
+				if len(entries) >= f.Limit {
+					return entries, nil
+				}
+			}
+		}
+	}
+	return entries, nil
+}
+
+// auditRequest records an action of the authenticated caller of r.
+func auditRequest(r *http.Request, action, target string, err error) {
+	e := requestActor(r)
+	e.Action, e.Target, e.Outcome = action, target, auditSuccess
+	if err != nil {
+		e.Outcome, e.Error = auditFailure, err.Error()
+	}
+	audit.Record(e)
+}
+
+// requestActor is the user, token and client of a request, for the audit
+// entries of what it causes.
+func requestActor(r *http.Request) auditEntry {
+	e := auditEntry{Source: clientIP(r)}
+	if p := principalFrom(r); p != nil {
+		e.User, e.Token = p.Name, p.TokenID
+	}
+	return e
+}
+
+// cliActor is the user calling the command line.
+func cliActor() auditEntry {
+	name := os.Getenv("SUDO_USER")
+	if name == "" {
+		if u, err := user.Current(); err == nil {
+			name = u.Username
+		}
+	}
+	return auditEntry{User: name, Source: "cli"}
+}
+
+// auditCLI records an action run from the command line by the calling user.
+func auditCLI(action, target string, err error) {
+	e := cliActor()
+	e.Action, e.Target, e.Outcome = action, target, auditSuccess
+	if err != nil {
+		e.Outcome, e.Error = auditFailure, err.Error()
+	}
+	audit.Record(e)
+}
+
+// processTarget describes a killed process as "pid (command)".
+func processTarget(pid int, command string) string {
+	if command == "" {
+		return strconv.Itoa(pid)
+	}
+	return fmt.Sprintf("%d (%s)", pid, command)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gorilla/csrf"
+)
+
+// Scopes an API token can be granted. Users get them through their role.
+const (
+	scopeStatusRead      = "status:read"
+	scopeMountUnmount    = "mount:unmount"
+	scopeProcessKill     = "process:kill"
+	scopeServiceRestart  = "service:restart"
+	scopeDiskTest        = "disk:test"
+	scopeContainerManage = "container:manage"
+	scopeAdmin           = "admin"
+)
+
+var allScopes = []string{scopeStatusRead, scopeMountUnmount, scopeProcessKill, scopeServiceRestart, scopeDiskTest, scopeContainerManage, scopeAdmin}
+
+// principal is the authenticated caller of a request.
+type principal struct {
+	Name    string
+	Scopes  []string
+	TokenID string
+}
+
+func (p *principal) Can(scope string) bool {
+	return p != nil && slices.Contains(p.Scopes, scope)
+}
+
+func (p *principal) IsToken() bool {
+	return p != nil && p.TokenID != ""
+}
+
+type contextKey int
+
+const principalKey contextKey = iota
+
+func principalFrom(r *http.Request) *principal {
+	p, _ := r.Context().Value(principalKey).(*principal)
+	return p
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	return strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+// skipCSRFForBearer runs before the CSRF middleware. Requests carrying a
+// bearer token are not sent by a browser form and have no CSRF cookie, so the
+// check is skipped; withAuth never falls back to basic auth for them.
+func skipCSRFForBearer(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := bearerToken(r); ok {
+			r = csrf.UnsafeSkipCheck(r)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// withAuth authenticates the request by bearer token or basic auth and
+// requires the given scope. With TOTP_MODE=login, browser users with
+// two-factor authentication must have confirmed a code in this session.
+func withAuth(scope string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p := authenticate(w, r)
+		if p == nil {
+			return
+		}
+		if config().Auth.TOTPMode == totpModeLogin && !p.IsToken() && totps.Enabled(p.Name) && !secondFactorVerified(r, p) {
+			http.Redirect(w, r, "/login/2fa", http.StatusSeeOther)
+			return
+		}
+		if !p.Can(scope) {
+			if r.Method != http.MethodGet {
+				audit.Record(auditEntry{User: p.Name, Token: p.TokenID, Source: clientIP(r), Action: "access", Target: r.Method + " " + r.URL.Path, Outcome: auditDenied, Error: "missing scope " + scope})
+			}
+			http.Error(w, "Forbidden - missing scope "+scope, http.StatusForbidden)
+			return
+		}
+		handler(w, r.WithContext(context.WithValue(r.Context(), principalKey, p)))
+	}
+}
+
+// withCredentials only requires valid basic-auth credentials. It guards the
+// pages that complete a login, like the two-factor prompt.
+func withCredentials(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p := authenticate(w, r)
+		if p == nil {
+			return
+		}
+		if p.IsToken() {
+			http.Error(w, "Forbidden - not available for API tokens", http.StatusForbidden)
+			return
+		}
+		handler(w, r.WithContext(context.WithValue(r.Context(), principalKey, p)))
+	}
+}
+
+// browserOnly rejects API token clients, for pages that manage a user's own
+// login.
+func browserOnly(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if principalFrom(r).IsToken() {
+			http.Error(w, "Forbidden - not available for API tokens", http.StatusForbidden)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// authenticate checks the bearer token or basic-auth credentials. On failure
+// it writes the response and returns nil.
+func authenticate(w http.ResponseWriter, r *http.Request) *principal {
+	ipKey := "ip:" + clientIP(r)
+	if raw, ok := bearerToken(r); ok {
+		if until := loginAttempts.LockedUntil(ipKey); !until.IsZero() {
+			rejectLocked(w, until)
+			return nil
+		}
+		token, err := tokens.Authenticate(raw)
+		if err != nil {
+			recordLoginFailure(r, "")
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return nil
+		}
+		loginAttempts.Succeed(ipKey)
+		return &principal{Name: token.Name, Scopes: token.Scopes, TokenID: token.ID}
+	}
+
+	user, pass, ok := r.BasicAuth()
+	if ok {
+		// A locked username is rejected even with the right password, so
+		// guessing it from many addresses is slowed down as well.
+		if until := loginAttempts.LockedUntil(ipKey, "user:"+user); !until.IsZero() {
+			rejectLocked(w, until)
+			return nil
+		}
+	}
+	if !ok || !checkCredentials(user, pass) {
+		if ok {
+			recordLoginFailure(r, user)
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="restricted"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil
+	}
+	loginAttempts.Succeed(ipKey, "user:"+user)
+	account, _ := config().User(user)
+	return &principal{Name: user, Scopes: roleScopes[account.Role]}
+}
+
+// secondFactorVerified reports whether the session has passed the
+// two-factor prompt for this user.
+func secondFactorVerified(r *http.Request, p *principal) bool {
+	session, _ := store.Get(r, "sid")
+	verified, _ := session.Values[sessionKeyTOTPUser].(string)
+	return verified == p.Name
+}
+
+const sessionKeyTOTPUser = "totp_user"
+
+func checkCredentials(user, pass string) bool {
+	account, ok := config().User(user)
+	if !ok {
+		// Compare anyway so unknown users take as long as known ones.
+		account.Password = pass + "x"
+	}
+	return subtle.ConstantTimeCompare([]byte(pass), []byte(account.Password)) == 1 && ok
+}
+
+func rejectLocked(w http.ResponseWriter, until time.Time) {
+	setRetryAfter(w, time.Until(until))
+	http.Error(w, "Too Many Requests - too many failed logins, try again after "+until.Format(time.Kitchen), http.StatusTooManyRequests)
+}
@@ -3,22 +3,40 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"os"
 	"os/exec"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/google/safehtml" // Import safehtml directly
 	"github.com/google/safehtml/uncheckedconversions"
 	// Import safehtml template
 )
 
+// Errors callers can tell apart, e.g. for CLI exit codes.
+var (
+	errNotMounted  = errors.New("device not mounted")
+	errDeviceBusy  = errors.New("device is busy")
+	errPIDNotFound = errors.New("pid not found")
+)
+
 type ServiceStatus struct {
-	Name   string
-	Active bool
-	Detail string
+	Name        string `json:"name"`
+	Unit        string `json:"unit,omitempty"`
+	Active      bool   `json:"active"`
+	Restartable bool   `json:"restartable,omitempty"`
+	Detail      string `json:"detail"`
+	Error       string `json:"error,omitempty"`
+	Locks       int    `json:"locks,omitempty"` // samba only, locked files
 }
 
 type Usage struct {
@@ -26,70 +44,285 @@ type Usage struct {
 	PID     int    `json:"pid"`
 	User    string `json:"user"`
 	Name    string `json:"name"`
+
+	Owner *processOwner `json:"owner,omitempty"` // nil if the process could not be read
 }
 
 type Mount struct {
 	Device              string         `json:"device"`
+	UUID                string         `json:"uuid"` // filesystem UUID, the key of the drive history
 	Path                string         `json:"path"`
 	Usages              []Usage        `json:"usages"`
 	UsageError          string         `json:"usageError,omitempty"`
 	FreeSpace           string         `json:"freeSpace,omitempty"`
-	TotalSpace          string         `json:"totalSpace,omitempty"`          // Added TotalSpace
+	TotalSpace          string         `json:"totalSpace,omitempty"` // Added TotalSpace
+	FreeBytes           uint64         `json:"freeBytes,omitempty"`
+	TotalBytes          uint64         `json:"totalBytes,omitempty"`
+	Inodes              uint64         `json:"inodes,omitempty"` // 0 if the filesystem has none, e.g. exFAT
+	FreeInodes          uint64         `json:"freeInodes,omitempty"`
 	UsedSpacePercentage int            `json:"usedSpacePercentage,omitempty"` // Added UsedSpacePercentage
 	FreeSpacePercentage int            `json:"freeSpacePercentage,omitempty"`
-	StyleWidth          safehtml.Style `json:"-"` // Change StyleWidth to safehtml.Style
+	StyleWidth          safehtml.Style `json:"-"`               // Change StyleWidth to safehtml.Style
+	SMART               *smartReport   `json:"smart,omitempty"` // nil until the first read or if SMART is disabled
+	Idle                *idleStatus    `json:"idle,omitempty"`  // nil until the disk was sampled
+	NextJob             *scheduledJob  `json:"nextJob,omitempty"`
+	Containers          []Container    `json:"containers,omitempty"` // with a bind mount reaching the drive
 }
 
 type SystemStatus struct {
-	Mounts []Mount       `json:"mounts"`
-	AutoFs ServiceStatus `json:"autofs"`
-	Samba  ServiceStatus `json:"samba"`
+	Mounts   []Mount         `json:"mounts"`
+	Services []ServiceStatus `json:"services"`
+	Samba    *ServiceStatus  `json:"samba,omitempty"` // nil if samba is disabled in the config
+
+	Probes      []ProbeResult `json:"probes"`
+	CollectedAt time.Time     `json:"collectedAt"`
+
+	ErrorMounts error `json:"-"`
+	ErrorSamba  error `json:"-"`
+	ErrorDocker error `json:"-"`
+
+	probesMu sync.Mutex
+}
+
+// Age is how long ago the status was collected, rounded for display.
+func (s *SystemStatus) Age() time.Duration {
+	return time.Since(s.CollectedAt).Round(time.Second)
+}
 
-	ErrorMounts error
-	ErrorAutoFs error
-	ErrorSamba  error
+// MarshalJSON adds the probe errors as strings, error values themselves do
+// not serialize.
+func (s *SystemStatus) MarshalJSON() ([]byte, error) {
+	type plain SystemStatus
+	errs := map[string]string{}
+	for name, err := range map[string]error{"mounts": s.ErrorMounts, "samba": s.ErrorSamba, "docker": s.ErrorDocker} {
+		if err != nil {
+			errs[name] = err.Error()
+		}
+	}
+	return json.Marshal(struct {
+		*plain
+		Errors map[string]string `json:"errors,omitempty"`
+	}{(*plain)(s), errs})
 }
 
-func getSystemStatus() *SystemStatus {
+// getSystemStatus runs all probes concurrently. Each probe has its own
+// deadline, so a hanging lsof or statfs only marks its part of the result.
+func getSystemStatus(ctx context.Context) *SystemStatus {
 	response := &SystemStatus{}
-	response.Mounts, response.ErrorMounts = getMounts()
-	response.AutoFs, response.ErrorAutoFs = checkAutofsStatus()
-	response.Samba, response.ErrorSamba = checkSambaStatus()
+	services := config().Services
+	response.Services = make([]ServiceStatus, len(services))
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		response.Mounts, response.ErrorMounts = collectMounts(ctx, response)
+		if config().Docker.Enabled && response.ErrorMounts == nil {
+			_, response.ErrorDocker = probe(ctx, response, "docker", func(ctx context.Context) (struct{}, error) {
+				return struct{}{}, collectContainers(ctx, response.Mounts)
+			})
+		}
+		for i := range response.Mounts {
+			response.Mounts[i].SMART = smartReports.Get(wholeDisk(response.Mounts[i].Device))
+			response.Mounts[i].Idle = idle.Status(response.Mounts[i])
+			response.Mounts[i].NextJob = schedules.NextFor(response.Mounts[i])
+		}
+	}()
+	for i, svc := range services {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			status, err := probe(ctx, response, "systemctl "+svc.Unit, func(ctx context.Context) (ServiceStatus, error) {
+				status := checkServiceStatus(ctx, svc)
+				if status.Error != "" {
+					return status, errors.New(status.Error)
+				}
+				return status, nil
+			})
+			if err != nil {
+				status = ServiceStatus{Name: svc.Name, Unit: svc.Unit, Restartable: svc.Restartable, Error: err.Error()}
+			}
+			response.Services[i] = status
+		}()
+	}
+	if config().Samba.Enabled {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			samba, err := probe(ctx, response, "smbstatus", checkSambaStatus)
+			response.Samba, response.ErrorSamba = &samba, err
+		}()
+	}
+	wg.Wait()
+	slices.SortFunc(response.Probes, func(a, b ProbeResult) int { return strings.Compare(a.Name, b.Name) })
+	response.CollectedAt = time.Now()
 	return response
 }
 
-func checkAutofsStatus() (ServiceStatus, error) {
-	if devModeEnabled {
-		devStatus := checkAutofsStatusDevMode() // Call dev-mode function
-		return devStatus, nil
+// runCommand runs a command with the configured timeout and returns its
+// combined output. Privileged commands are run through sudo non-interactively.
+func runCommand(privileged bool, name string, args ...string) ([]byte, error) {
+	return runCommandContext(context.Background(), privileged, name, args...)
+}
+
+// runCommandContext is runCommand with a parent context, e.g. a probe
+// deadline or the request of a browser that may disconnect.
+func runCommandContext(ctx context.Context, privileged bool, name string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, config().Timeouts.Command)
+	defer cancel()
+	if privileged {
+		args = append([]string{"-n", name}, args...)
+		name = config().Commands.Sudo
 	}
-	cmd := exec.Command("systemctl", "status", "autofs")
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.WaitDelay = time.Second // don't wait for children that keep the output open
 	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return ServiceStatus{}, err
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return output, fmt.Errorf("%s timed out after %s", name, config().Timeouts.Command)
+	}
+	return output, err
+}
+
+func checkServiceStatus(ctx context.Context, svc ServiceEntry) ServiceStatus {
+	status := ServiceStatus{Name: svc.Name, Unit: svc.Unit, Restartable: svc.Restartable}
+	if config().DevMode {
+		devStatus := checkServiceStatusDevMode(svc) // Call dev-mode function
+		devStatus.Restartable = svc.Restartable
+		return devStatus
+	}
+	output, err := runCommandContext(ctx, false, config().Commands.Systemctl, "status", "--", svc.Unit)
+	status.Detail = strings.TrimSpace(string(output))
+	// systemctl status exits with 3 for units that are not running.
+	var exitErr *exec.ExitError
+	if err != nil && !(errors.As(err, &exitErr) && exitErr.ExitCode() == 3) {
+		status.Error = err.Error()
+		return status
 	}
 
-	active := strings.Contains(string(output), "active (running)")
-	return ServiceStatus{Name: "Autofs", Active: active, Detail: strings.TrimSpace(string(output))}, nil
+	status.Active = strings.Contains(string(output), "active (running)")
+	return status
 }
 
-func checkSambaStatus() (ServiceStatus, error) {
-	if devModeEnabled {
+func checkSambaStatus(ctx context.Context) (ServiceStatus, error) {
+	if config().DevMode {
 		devStatus := checkSambaStatusDevMode() // Call dev-mode function
 		return devStatus, nil
 	}
-	cmd := exec.Command("sudo", "smbstatus", "--locked")
-	output, err := cmd.CombinedOutput()
+	output, err := runCommandContext(ctx, true, config().Commands.Smbstatus, "--locked")
 	if err != nil {
-		return ServiceStatus{}, err
+		return ServiceStatus{Name: "Samba"}, err
 	}
 
 	noLockedFiles := strings.Contains(string(output), "No locked files")
-	return ServiceStatus{Name: "Samba", Active: noLockedFiles, Detail: string(output)}, nil
+	return ServiceStatus{Name: "Samba", Active: noLockedFiles, Detail: string(output), Locks: countSambaLocks(string(output))}, nil
+}
+
+// countSambaLocks counts the rows of the "Locked files:" table of smbstatus,
+// which start with the pid.
+func countSambaLocks(output string) int {
+	_, locked, found := strings.Cut(output, "Locked files:")
+	if !found {
+		return 0
+	}
+	count := 0
+	for _, line := range strings.Split(locked, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 0 {
+			if _, err := strconv.Atoi(fields[0]); err == nil {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// restartService restarts a configured, restartable systemd unit and waits
+// for it to settle.
+func restartService(unit string) error {
+	svc, ok := config().Service(unit)
+	if !ok || !svc.Restartable {
+		return fmt.Errorf("service %s is not restartable", unit)
+	}
+	if config().DevMode {
+		time.Sleep(1 * time.Second) // Simulate delay
+		return nil
+	}
+	if _, err := runCommand(true, config().Commands.Systemctl, "restart", svc.Unit); err != nil {
+		return err
+	}
+	time.Sleep(config().Timeouts.RestartSettle)
+	return nil
+}
+
+// mountPath mounts a managed path again. Listing it lets autofs mount it,
+// otherwise mount uses its fstab entry.
+func mountPath(ctx context.Context, path string) error {
+	if config().DevMode {
+		return mountPathDevMode(path)
+	}
+	listed := make(chan struct{})
+	go func() {
+		os.ReadDir(path)
+		close(listed)
+	}()
+	select {
+	case <-listed:
+	case <-ctx.Done():
+		return fmt.Errorf("listing %s: %v", path, ctx.Err())
+	}
+	if mounts, err := listMounts(ctx); err == nil && slices.ContainsFunc(mounts, func(m Mount) bool { return m.Path == path }) {
+		return nil
+	}
+	output, err := runCommandContext(ctx, true, config().Commands.Mount, "--", path)
+	if err != nil {
+		return fmt.Errorf("mount: %v: %s", err, lastLine(string(output)))
+	}
+	return nil
+}
+
+// ejectDisk stops and ejects an unmounted disk, so it can be unplugged.
+func ejectDisk(ctx context.Context, disk string) error {
+	if config().DevMode {
+		return ejectDiskDevMode(disk)
+	}
+	output, err := runCommandContext(ctx, true, config().Commands.Eject, "--", disk)
+	if err != nil {
+		return fmt.Errorf("eject: %v: %s", err, lastLine(string(output)))
+	}
+	return nil
+}
+
+// regexDevice limits mount paths to plain characters, isManagedMountPath to
+// the configured directories.
+var regexDevice = regexp.MustCompile(`^/[\/a-zA-Z0-9_ -]+$`)
+
+// validMountPath checks user input before it is passed to umount.
+func validMountPath(path string) bool {
+	return regexDevice.MatchString(path) && isManagedMountPath(path) && !strings.Contains(path, "..")
+}
+
+// isManagedMountPath reports whether a path is below one of the configured
+// mount directories.
+func isManagedMountPath(path string) bool {
+	for _, prefix := range config().Mounts.PathPrefixes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func isManagedDevice(device string) bool {
+	for _, prefix := range config().Mounts.DevicePrefixes {
+		if strings.HasPrefix(device, prefix) {
+			return true
+		}
+	}
+	return false
 }
 
 func unmountDevice(device string) error {
-	if devModeEnabled {
+	if config().DevMode {
 		return unmountDeviceDevMode(device) // Call dev-mode function
 	}
 
@@ -107,12 +340,11 @@ func unmountDevice(device string) error {
 		}
 	}
 	if !found {
-		return fmt.Errorf("device not mounted: %s", device)
+		return fmt.Errorf("%w: %s", errNotMounted, device)
 	}
 
 	// Device is valid and mounted, proceed with unmount
-	cmd := exec.Command("sudo", "umount", "--", device)
-	err = cmd.Run()
+	_, err = runCommand(true, config().Commands.Umount, "--", device)
 	if err != nil {
 		// Convert error to *exec.ExitError and get the exit code
 		if exitErr, ok := err.(*exec.ExitError); ok {
@@ -124,9 +356,9 @@ func unmountDevice(device string) error {
 			case 8:
 				return fmt.Errorf("failed to unmount device: %s, error: no such file or directory", device)
 			case 16:
-				return fmt.Errorf("failed to unmount device: %s, error: device is busy", device)
+				return fmt.Errorf("failed to unmount device: %s, error: %w", device, errDeviceBusy)
 			case 32:
-				return fmt.Errorf("failed to unmount device: %s, error: device is busy - umount command failed", device)
+				return fmt.Errorf("failed to unmount device: %s, error: %w - umount command failed", device, errDeviceBusy)
 			default:
 				return fmt.Errorf("failed to unmount device: %s, error: unknown error with exit status %d", device, exitErr.ExitCode())
 			}
@@ -138,40 +370,64 @@ func unmountDevice(device string) error {
 	return nil
 }
 
-func killProcess(pid int) error {
-	if devModeEnabled {
-		return killProcessDevMode(pid) // Call dev-mode function
+// killProcess kills a process using a managed drive. The target is checked
+// against the current usages: its start time and a command given with it must
+// still match, so a PID that was reused since the page was rendered is not
+// killed. Without a start time, as from the command line, the process listed
+// with the PID now is killed; its start time is read with the listing and
+// checked again when it is signalled.
+func killProcess(target processIdentity) (string, error) {
+	if config().DevMode {
+		return target.Command, killProcessDevMode(target)
 	}
 	mounts, err := getMounts()
 	if err != nil {
-		return fmt.Errorf("failed to get mounts: %v", err)
+		return "", fmt.Errorf("failed to get mounts: %v", err)
 	}
 
-	found := false
+	var found *Usage
 	for _, mount := range mounts {
 		for _, usage := range mount.Usages {
-			if pid == usage.PID {
-				found = true
+			if target.PID == usage.PID {
+				found = &usage
 				break
 			}
 		}
 	}
-	if !found {
-		return fmt.Errorf("pid not found: %d", pid)
+	if found == nil {
+		return "", fmt.Errorf("%w: %d", errPIDNotFound, target.PID)
 	}
-
-	return exec.Command("sudo", "kill", "-9", strconv.Itoa(pid)).Run()
+	if slices.Contains(config().Kill.ProtectedCommands, found.Command) {
+		return found.Command, fmt.Errorf("refusing to kill protected process %s (%d)", found.Command, target.PID)
+	}
+	current := processIdentity{PID: found.PID, Command: found.Command}
+	var started time.Time
+	if found.Owner != nil {
+		current.Started, started = found.Owner.StartTicks, found.Owner.Started
+	} else {
+		// The owner could not be read, the start time may still be.
+		stat, err := readProcStat(target.PID)
+		if err != nil {
+			return found.Command, unreadableProcess(target, err)
+		}
+		current.Started, started = stat.ticks, stat.started
+	}
+	if (target.Started != 0 && target.Started != current.Started) || (target.Command != "" && target.Command != current.Command) {
+		return found.Command, fmt.Errorf("%w: %s has exited, the PID now belongs to %s started %s", errStaleProcess, target, found.Command, started.Format("2006-01-02 15:04:05"))
+	}
+	return found.Command, signalProcess(current)
 }
 
-func getDiskFreeSpace(path string) (string, string, int, int, error) { // Modified return values
-	if devModeEnabled {
-		freeSpace, percentage, err := getDiskFreeSpaceDevMode()                      // Call dev-mode function
-		return freeSpace, "Simulated Total Space", percentage, 100 - percentage, err // Simulate total space and used percentage
+func getDiskFreeSpace(path string) (diskSpace, error) {
+	if config().DevMode {
+		freeSpace, percentage, err := getDiskFreeSpaceDevMode() // Call dev-mode function
+		// Simulate total space and used percentage
+		return diskSpace{Free: freeSpace, Total: "Simulated Total Space", FreePercentage: percentage, UsedPercentage: 100 - percentage}, err
 	}
 	var stat syscall.Statfs_t
 	err := syscall.Statfs(path, &stat)
 	if err != nil {
-		return "", "", 0, 0, err
+		return diskSpace{}, err
 	}
 	// Available blocks * size per block = available space in bytes
 	freeBytes := stat.Bavail * uint64(stat.Bsize)
@@ -179,7 +435,16 @@ func getDiskFreeSpace(path string) (string, string, int, int, error) { // Modifi
 	freePercentage := int(float64(freeBytes) / float64(totalBytes) * 100)
 	usedPercentage := 100 - freePercentage
 
-	return formatBytes(freeBytes), formatBytes(totalBytes), freePercentage, usedPercentage, nil // Return free space, total space, percentages
+	return diskSpace{
+		Free:           formatBytes(freeBytes),
+		Total:          formatBytes(totalBytes),
+		FreeBytes:      freeBytes,
+		TotalBytes:     totalBytes,
+		Inodes:         stat.Files,
+		FreeInodes:     stat.Ffree,
+		FreePercentage: freePercentage,
+		UsedPercentage: usedPercentage,
+	}, nil
 }
 
 // Helper function to format bytes into human-readable format (MB or GB)
@@ -198,59 +463,107 @@ func formatBytes(bytes uint64) string {
 	}
 }
 
+// getMounts lists the managed mounts with their usages and free space.
 func getMounts() ([]Mount, error) {
-	if devModeEnabled {
-		devMounts := getMountsDevMode() // Call dev-mode function
-		return devMounts, nil
+	return collectMounts(context.Background(), nil)
+}
+
+// collectMounts lists the managed mounts and probes usages and free space of
+// all of them concurrently. Probe results are recorded in status if given.
+func collectMounts(ctx context.Context, status *SystemStatus) ([]Mount, error) {
+	if config().DevMode {
+		return probe(ctx, status, "mount", func(context.Context) ([]Mount, error) {
+			devMounts := getMountsDevMode() // Call dev-mode function
+			for i := range devMounts {
+				devMounts[i].UUID = filesystemUUID(devMounts[i].Device)
+				resolveOwners(devMounts[i].Usages)
+			}
+			return devMounts, nil
+		})
 	}
-	cmd := exec.Command("mount")
-	output, err := cmd.CombinedOutput()
+	mounts, err := probe(ctx, status, "mount", listMounts)
+	if err != nil {
+		return nil, err
+	}
+
+	var wg sync.WaitGroup
+	for i := range mounts {
+		m := &mounts[i]
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			usages, err := probe(ctx, status, "lsof "+m.Path, func(ctx context.Context) ([]Usage, error) {
+				usages, usageError := getUsages(ctx, m.Path)
+				if usageError != "" {
+					return nil, errors.New(usageError)
+				}
+				resolveOwners(usages)
+				return usages, nil
+			})
+			m.Usages = usages
+			if err != nil {
+				m.UsageError = err.Error()
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			space, err := probe(ctx, status, "statfs "+m.Path, func(context.Context) (diskSpace, error) {
+				return getDiskFreeSpace(m.Path) // Get total space and used percentage
+			})
+			if err != nil {
+				space.Free = "Error fetching free space"
+				logger.Errorf("Error getting free space for %s: %v", m.Path, err)
+			}
+			m.FreeSpace = space.Free
+			m.TotalSpace = space.Total
+			m.FreeBytes, m.TotalBytes = space.FreeBytes, space.TotalBytes
+			m.Inodes, m.FreeInodes = space.Inodes, space.FreeInodes
+			m.FreeSpacePercentage = space.FreePercentage
+			m.UsedSpacePercentage = space.UsedPercentage
+			m.StyleWidth = uncheckedconversions.StyleFromStringKnownToSatisfyTypeContract("width: " + strconv.Itoa(space.UsedPercentage) + "%") // Use StyleFromStringKnownToSatisfyTypeContract
+		}()
+	}
+	wg.Wait()
+	return mounts, nil
+}
+
+type diskSpace struct {
+	Free, Total                    string
+	FreeBytes, TotalBytes          uint64
+	Inodes, FreeInodes             uint64
+	FreePercentage, UsedPercentage int
+}
+
+var regexMountLine = regexp.MustCompile(`(\/dev\/[^\s]+)\s+on\s+([^\s]+(?:\s+[^\s]+)*?)\s+type`)
+
+// listMounts parses the output of mount for managed devices and paths.
+func listMounts(ctx context.Context) ([]Mount, error) {
+	output, err := runCommandContext(ctx, false, config().Commands.Mount)
 	if err != nil {
 		return nil, err
 	}
 
 	lines := strings.Split(string(output), "\n")
 	var mounts []Mount
-	pattern := regexp.MustCompile(`(\/dev\/[^\s]+)\s+on\s+([^\s]+(?:\s+[^\s]+)*?)\s+type`)
 	for _, line := range lines {
-		matches := pattern.FindStringSubmatch(line)
+		matches := regexMountLine.FindStringSubmatch(line)
 		if len(matches) == 3 {
 			mountSource := matches[1]
 			mountPoint := matches[2]
-			if strings.HasPrefix(mountSource, "/dev/sd") && (strings.HasPrefix(mountPoint, "/mnt/") || strings.HasPrefix(mountPoint, "/media/")) {
-				usages, usageError := getUsages(mountPoint)
-				freeSpace, totalSpace, freeSpacePercentage, usedSpacePercentage, err := getDiskFreeSpace(mountPoint) // Get total space and used percentage
-				if err != nil {
-					freeSpace = "Error fetching free space"
-					logger.Error("Error getting free space for", mountPoint, ":", err)
-				}
-				styleWidth := uncheckedconversions.StyleFromStringKnownToSatisfyTypeContract("width: " + strconv.Itoa(usedSpacePercentage) + "%") // Use StyleFromStringKnownToSatisfyTypeContract
-
-				m := Mount{ // Changed variable name to 'm' to avoid shadowing
-					Device:              mountSource,
-					Path:                mountPoint,
-					Usages:              usages,
-					UsageError:          usageError,
-					FreeSpace:           freeSpace,
-					TotalSpace:          totalSpace,          // Set TotalSpace
-					UsedSpacePercentage: usedSpacePercentage, // Set UsedSpacePercentage
-					FreeSpacePercentage: freeSpacePercentage,
-					StyleWidth:          styleWidth, // Set StyleWidth as safehtml.Style
-				}
-				mounts = append(mounts, m) // Append the single mount 'm'
+			if isManagedDevice(mountSource) && isManagedMountPath(mountPoint) {
+				mounts = append(mounts, Mount{Device: mountSource, UUID: filesystemUUID(mountSource), Path: mountPoint})
 			}
 		}
 	}
 	return mounts, nil
 }
 
-func getUsages(mountPoint string) ([]Usage, string) {
-	if devModeEnabled {
+func getUsages(ctx context.Context, mountPoint string) ([]Usage, string) {
+	if config().DevMode {
 		devUsages, devError := getUsagesDevMode(mountPoint) // Call dev-mode function
 		return devUsages, devError
 	}
-	cmd := exec.Command("sudo", "lsof", "--", mountPoint)
-	output, err := cmd.CombinedOutput()
+	output, err := runCommandContext(ctx, true, config().Commands.Lsof, "--", mountPoint)
 	if err != nil {
 		if len(output) == 0 {
 			return []Usage{}, "" // No usages and no error.
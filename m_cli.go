@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Exit codes of the command line interface.
+const (
+	exitOK       = 0
+	exitFailure  = 1 // the command failed
+	exitUsage    = 2 // invalid arguments or config
+	exitDegraded = 3 // status: a probe failed or a service is not active
+	exitBusy     = 4 // unmount: the mount is in use
+	exitNotFound = 5 // unmount: not mounted, kill: pid not using a managed mount
+)
+
+const cliUsage = `Usage: unmounter [-config <file>] <command>
+Commands:
+  serve                   run the web server in the foreground (default)
+  status [--json]         show mounts, processes and services
+  unmount <path>          unmount a managed mount point
+  kill <pid>              kill a process using a managed mount
+  doctor                  check the host setup
+  config <validate|show|schema>
+  token <create|list|revoke>
+  2fa disable <user>
+  rotate-keys
+  install, uninstall, start, stop, restart
+Exit codes: 0 ok, 1 failed, 2 usage, 3 degraded, 4 busy, 5 not found`
+
+func handleStatusArgs(args []string) int {
+	flags := flag.NewFlagSet("status", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "print the status as JSON")
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	status := getSystemStatus(context.Background())
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(status); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitFailure
+		}
+	} else {
+		printStatus(status)
+	}
+
+	if status.Degraded() {
+		return exitDegraded
+	}
+	return exitOK
+}
+
+// Degraded reports whether a probe failed or a service is not running.
+func (s *SystemStatus) Degraded() bool {
+	if s.ErrorMounts != nil || s.ErrorSamba != nil {
+		return true
+	}
+	for _, svc := range s.Services {
+		if svc.Error != "" || !svc.Active {
+			return true
+		}
+	}
+	for _, mount := range s.Mounts {
+		if mount.UsageError != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func printStatus(status *SystemStatus) {
+	if timedOut := status.TimedOutProbes(); len(timedOut) > 0 {
+		fmt.Println("Timed out, results incomplete:", strings.Join(timedOut, ", "))
+	}
+	fmt.Println("Mounts:")
+	if status.ErrorMounts != nil {
+		fmt.Println("  error:", status.ErrorMounts)
+	} else if len(status.Mounts) == 0 {
+		fmt.Println("  none")
+	}
+	for _, mount := range status.Mounts {
+		fmt.Printf("  %s on %s, %s free of %s\n", mount.Device, mount.Path, mount.FreeSpace, mount.TotalSpace)
+		if mount.UsageError != "" {
+			fmt.Println("    error:", mount.UsageError)
+		}
+		for _, usage := range mount.Usages {
+			owner := ""
+			if usage.Owner != nil && usage.Owner.Kind != ownerProcess {
+				owner = fmt.Sprintf(" (%s %s)", usage.Owner.Label(), usage.Owner.Name)
+			}
+			fmt.Printf("    %-8d %-12s %-12s %s%s\n", usage.PID, usage.Command, usage.User, usage.Name, owner)
+		}
+	}
+
+	fmt.Println("Services:")
+	for _, svc := range status.Services {
+		state := "inactive"
+		if svc.Active {
+			state = "active"
+		}
+		if svc.Error != "" {
+			state = "error: " + svc.Error
+		}
+		fmt.Printf("  %s (%s): %s\n", svc.Name, svc.Unit, state)
+	}
+	if status.ErrorSamba != nil {
+		fmt.Println("  Samba: error:", status.ErrorSamba)
+	} else if status.Samba != nil {
+		state := "locked files"
+		if status.Samba.Active {
+			state = "no locked files"
+		}
+		fmt.Println("  Samba:", state)
+	}
+}
+
+func handleUnmountArgs(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: unmounter unmount <path>")
+		return exitUsage
+	}
+	path := args[0]
+	if !validMountPath(path) {
+		fmt.Fprintln(os.Stderr, "invalid device", path)
+		return exitUsage
+	}
+
+	results, err := unmountWithHooks(context.Background(), path, cliActor())
+	for _, result := range results {
+		fmt.Fprintln(os.Stderr, result)
+	}
+	auditCLI("unmount", path, err)
+	switch {
+	case err == nil:
+		fmt.Println("Unmounted", path)
+		return exitOK
+	case errors.Is(err, errNotMounted):
+		fmt.Fprintln(os.Stderr, err)
+		return exitNotFound
+	case errors.Is(err, errDeviceBusy):
+		fmt.Fprintln(os.Stderr, err)
+		return exitBusy
+	default:
+		fmt.Fprintln(os.Stderr, "unmount failed:", err)
+		return exitFailure
+	}
+}
+
+func handleKillArgs(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: unmounter kill <pid>")
+		return exitUsage
+	}
+	pid, err := strconv.Atoi(args[0])
+	if err != nil || pid <= 0 {
+		fmt.Fprintln(os.Stderr, "Invalid PID:", args[0])
+		return exitUsage
+	}
+
+	command, err := killProcess(processIdentity{PID: pid})
+	auditCLI("kill", processTarget(pid, command), err)
+	switch {
+	case err == nil:
+		fmt.Println("Killed process", pid)
+		return exitOK
+	case errors.Is(err, errPIDNotFound), errors.Is(err, errStaleProcess):
+		fmt.Fprintln(os.Stderr, err)
+		return exitNotFound
+	default:
+		fmt.Fprintln(os.Stderr, "kill failed:", err)
+		return exitFailure
+	}
+}
@@ -5,11 +5,16 @@ package main
 import (
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 )
 
-func checkAutofsStatusDevMode() ServiceStatus {
+func checkServiceStatusDevMode(svc ServiceEntry) ServiceStatus {
 	time.Sleep(100 * time.Millisecond) // Simulate delay
+	if svc.Unit != "autofs" {
+		detail := fmt.Sprintf("● %s.service\n     Loaded: loaded\n     Active: active (running) (simulated)", svc.Unit)
+		return ServiceStatus{Name: svc.Name, Unit: svc.Unit, Active: true, Detail: detail}
+	}
 	detail := `● autofs.service - Automounts filesystems on demand
      Loaded: loaded (/lib/systemd/system/autofs.service; enabled; vendor preset: enabled)
      Active: active (running) since Sun 2025-01-26 21:36:00 CET; 1 weeks 1 days ago
@@ -19,7 +24,7 @@ func checkAutofsStatusDevMode() ServiceStatus {
         CPU: 56.020s
      CGroup: /system.slice/autofs.service
              └─603 /usr/sbin/automount --pid-file /var/run/autofs.pid`
-	return ServiceStatus{Name: "Autofs", Active: true, Detail: detail}
+	return ServiceStatus{Name: svc.Name, Unit: svc.Unit, Active: true, Detail: detail}
 }
 
 func checkSambaStatusDevMode() ServiceStatus {
@@ -37,7 +42,7 @@ Locked files:
 Pid          User(ID)   DenyMode   Access      R/W        Oplock           SharePath   Name   Time
 --------------------------------------------------------------------------------------------------
 258080       1001       DENY_NONE  0x120089    RDONLY     NONE             /mnt/external   audio/bob-says-hello.flac   Tue Feb  4 17:33:57 2025`
-	return ServiceStatus{Name: "Samba", Active: false, Detail: detail} // Simulating locked files, so Active: false
+	return ServiceStatus{Name: "Samba", Active: false, Detail: detail, Locks: countSambaLocks(detail)} // Simulating locked files, so Active: false
 }
 
 func getMountsDevMode() []Mount {
@@ -59,12 +64,26 @@ func getMountsDevMode() []Mount {
 					User:    "sambauser",
 					Name:    "/mnt/external/audio/bob-says-hello.flac", // Simulate the second locked file entry
 				},
+				{
+					Command: "rsync",
+					PID:     31337,
+					User:    "bob",
+					Name:    "/mnt/external/backup", // Simulate a copy from an SSH session
+				},
+				{
+					Command: "python3",
+					PID:     4242,
+					User:    "root",
+					Name:    "/mnt/external/recordings", // Simulate a container with the drive reachable through /media
+				},
 			},
 			UsageError:          "",
 			FreeSpace:           "2.5 GB",
 			TotalSpace:          "10 GB", // Simulated total space
-			UsedSpacePercentage: 75,      // Simulated used space percentage
-			FreeSpacePercentage: 25,      // Simulated free space percentage
+			FreeBytes:           2.5 * (1 << 30),
+			TotalBytes:          10 << 30,
+			UsedSpacePercentage: 75, // Simulated used space percentage
+			FreeSpacePercentage: 25, // Simulated free space percentage
 		},
 		{
 			Device:              "/dev/sdb2",
@@ -73,8 +92,12 @@ func getMountsDevMode() []Mount {
 			UsageError:          "",
 			FreeSpace:           "500 MB",
 			TotalSpace:          "2 GB", // Simulated total space
-			UsedSpacePercentage: 80,     // Simulated used space percentage
-			FreeSpacePercentage: 20,     // Simulated free space percentage
+			FreeBytes:           500 << 20,
+			TotalBytes:          2 << 30,
+			Inodes:              131072,
+			FreeInodes:          2048, // Simulate a filesystem running out of inodes
+			UsedSpacePercentage: 80,   // Simulated used space percentage
+			FreeSpacePercentage: 20,   // Simulated free space percentage
 		},
 		{
 			Device:              "/dev/sdc1",
@@ -83,8 +106,10 @@ func getMountsDevMode() []Mount {
 			UsageError:          "",
 			FreeSpace:           "10 GB",
 			TotalSpace:          "100 GB", // Simulated total space
-			UsedSpacePercentage: 90,       // Simulated used space percentage
-			FreeSpacePercentage: 10,       // Simulated free space percentage
+			FreeBytes:           10 << 30,
+			TotalBytes:          100 << 30,
+			UsedSpacePercentage: 90, // Simulated used space percentage
+			FreeSpacePercentage: 10, // Simulated free space percentage
 		},
 	}
 	return mounts
@@ -109,15 +134,115 @@ func unmountDeviceDevMode(device string) error {
 	return nil // Simulate successful unmount
 }
 
-func killProcessDevMode(pid int) error {
+func killProcessDevMode(target processIdentity) error {
 	time.Sleep(100 * time.Millisecond) // Simulate delay
-	if pid == 9999 {                   // Simulate kill failure for PID 9999
+	pid := target.PID
+	if pid == 9999 { // Simulate kill failure for PID 9999
 		return fmt.Errorf("simulated kill process failure for pid: %d", pid)
 	}
+	if target.Started != 0 && target.Started != processOwnerDevMode(pid).StartTicks { // Simulate a reused PID
+		return fmt.Errorf("%w: %s has exited, the PID now belongs to mock_process%d (simulated)", errStaleProcess, target, pid)
+	}
 	return nil // Simulate successful kill
 }
 
+var startedDevMode = time.Now().Add(-3 * time.Hour).Truncate(time.Second)
+
+const startTicksDevMode = 360000 // an hour after boot
+
+// processOwnerDevMode simulates smbd as a service, rsync in an SSH session
+// and python3 in a container, anything else has no known owner.
+func processOwnerDevMode(pid int) *processOwner {
+	started := startedDevMode
+	switch pid {
+	case 258080:
+		return &processOwner{Kind: ownerUnit, Name: "smbd.service", Cgroup: "/system.slice/smbd.service", Cmdline: "/usr/sbin/smbd --foreground --no-process-group", PPID: 1, Started: started, StartTicks: startTicksDevMode}
+	case 31337:
+		return &processOwner{Kind: ownerSession, Name: "3", ID: "3", Cgroup: "/user.slice/user-1000.slice/session-3.scope", Cmdline: "rsync -a /home/bob/ /mnt/external/backup/", PPID: 31330, Parents: []string{"bash", "sshd"}, Started: started.Add(2 * time.Hour), StartTicks: startTicksDevMode + 720000}
+	case 4242:
+		return &processOwner{Kind: ownerContainer, Name: "ha1", ID: "ha1", Cgroup: "/system.slice/docker-ha1.scope", Cmdline: "python3 -m homeassistant", PPID: 4200, Parents: []string{"containerd-shim"}, Started: started, StartTicks: startTicksDevMode}
+	}
+	return &processOwner{Kind: ownerProcess, Name: fmt.Sprintf("mock_process%d", pid), Cmdline: fmt.Sprintf("mock_process%d --simulated", pid), PPID: 1, Started: started, StartTicks: startTicksDevMode}
+}
+
+func stopUnitDevMode(unit string) error {
+	time.Sleep(200 * time.Millisecond) // Simulate delay
+	if strings.Contains(unit, "fail") {
+		return fmt.Errorf("simulated failure stopping %s", unit)
+	}
+	return nil
+}
+
+func terminateSessionDevMode(id string) error {
+	time.Sleep(100 * time.Millisecond) // Simulate delay
+	return nil
+}
+
 func getDiskFreeSpaceDevMode() (string, int, error) {
 	time.Sleep(50 * time.Millisecond) // Simulate delay
 	return "1.23 GB", 60, nil         // Simulated free space and percentage
 }
+
+// Simulated self-tests by disk, the value is the start time.
+var selfTestsDevMode sync.Map
+
+func readSMARTDevMode(disk string) *smartReport {
+	time.Sleep(200 * time.Millisecond) // Simulate delay
+	report := &smartReport{Source: "smartctl", Model: "Simulated USB HDD", Serial: "DEV" + strings.ToUpper(disk[len(disk)-1:]), Passed: true,
+		Temperature: 38, PowerOnHours: 12345, ReadAt: time.Now(),
+		SelfTest: smartSelfTest{Last: "Short offline: Completed without error", LastHours: 12300, LastPassed: true}}
+	switch {
+	case strings.Contains(disk, "sdb"): // Simulate a bridge without SAT
+		return &smartReport{Error: "SMART not supported by this USB bridge (simulated)"}
+	case strings.Contains(disk, "sdc"): // Simulate a failing disk
+		report.Passed, report.Reallocated, report.Pending = false, 12, 3
+		report.SelfTest = smartSelfTest{Last: "Short offline: Completed: read failure", LastHours: 12340}
+	}
+	if started, ok := selfTestsDevMode.Load(disk); ok {
+		elapsed := time.Since(started.(time.Time))
+		if elapsed < 2*time.Minute {
+			report.SelfTest.Running, report.SelfTest.Remaining = true, 90-int(elapsed/(15*time.Second))*10
+		} else {
+			selfTestsDevMode.Delete(disk)
+			report.SelfTest.Last, report.SelfTest.LastHours, report.SelfTest.LastPassed = "Short offline: Completed without error", report.PowerOnHours, true
+		}
+	}
+	return report
+}
+
+func startSelfTestDevMode(disk string) error {
+	if strings.Contains(disk, "sdb") {
+		return fmt.Errorf("simulated: SMART not supported by this USB bridge")
+	}
+	selfTestsDevMode.Store(disk, time.Now())
+	return nil
+}
+
+// readDiskSectorsDevMode simulates I/O on sda every minute, the other disks are idle.
+func readDiskSectorsDevMode(disk string) uint64 {
+	if strings.Contains(disk, "sda") {
+		return uint64(time.Now().Unix()/60) * 2048
+	}
+	return 4096
+}
+
+func spinDownDevMode(disk string) error {
+	time.Sleep(100 * time.Millisecond) // Simulate delay
+	if strings.Contains(disk, "sdb") {
+		return fmt.Errorf("simulated: %s does not support standby", disk)
+	}
+	return nil
+}
+
+func mountPathDevMode(path string) error {
+	time.Sleep(200 * time.Millisecond) // Simulate delay
+	if strings.Contains(path, "fail") {
+		return fmt.Errorf("simulated: mount: %s: can't find in /etc/fstab", path)
+	}
+	return nil
+}
+
+func ejectDiskDevMode(disk string) error {
+	time.Sleep(200 * time.Millisecond) // Simulate delay
+	return nil
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Container is a Docker container with a bind mount on or above a drive, or
+// with a process using it.
+type Container struct {
+	ID      string   `json:"id"`
+	Name    string   `json:"name"`
+	Image   string   `json:"image"`
+	State   string   `json:"state"`  // running, exited, ...
+	Mounts  []string `json:"mounts"` // host paths of the mounts that reach the drive
+	Restart bool     `json:"restartAfterRemount,omitempty"`
+}
+
+func (c Container) Running() bool {
+	return c.State == "running"
+}
+
+// dockerClient talks to the Docker Engine API over its Unix socket.
+type dockerClient struct {
+	http *http.Client
+}
+
+func newDockerClient(socket string) *dockerClient {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socket)
+		},
+		MaxIdleConns:    2,
+		IdleConnTimeout: time.Minute,
+	}
+	return &dockerClient{http: &http.Client{Transport: transport}}
+}
+
+// dockerClients keeps one client, and so its idle connection, per socket.
+var dockerClients struct {
+	mu     sync.Mutex
+	socket string
+	client *dockerClient
+}
+
+// docker returns the client for the configured socket. A socket changed by a
+// reload gets a new client, the connections of the old one are closed.
+func docker() *dockerClient {
+	socket := config().Docker.Socket
+	dockerClients.mu.Lock()
+	defer dockerClients.mu.Unlock()
+	if dockerClients.client == nil || dockerClients.socket != socket {
+		if dockerClients.client != nil {
+			dockerClients.client.http.CloseIdleConnections()
+		}
+		dockerClients.client, dockerClients.socket = newDockerClient(socket), socket
+	}
+	return dockerClients.client
+}
+
+func (c *dockerClient) do(ctx context.Context, method, path string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, method, "http://docker"+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("docker: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4<<20))
+	if err != nil {
+		return fmt.Errorf("docker: %v", err)
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotModified:
+		return nil // already stopped or started
+	case resp.StatusCode >= 300:
+		var apiErr struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(body, &apiErr) == nil && apiErr.Message != "" {
+			return fmt.Errorf("docker: %s", apiErr.Message)
+		}
+		return fmt.Errorf("docker: %s %s: %s", method, path, resp.Status)
+	case v != nil:
+		if err := json.Unmarshal(body, v); err != nil {
+			return fmt.Errorf("docker: unexpected response to %s: %v", path, err)
+		}
+	}
+	return nil
+}
+
+// Containers lists all containers, running or not.
+func (c *dockerClient) Containers(ctx context.Context) ([]dockerContainer, error) {
+	var list []dockerContainer
+	err := c.do(ctx, http.MethodGet, "/containers/json?all=1", &list)
+	return list, err
+}
+
+type dockerContainer struct {
+	ID     string   `json:"Id"`
+	Names  []string `json:"Names"`
+	Image  string   `json:"Image"`
+	State  string   `json:"State"`
+	Mounts []struct {
+		Type   string `json:"Type"`
+		Source string `json:"Source"`
+	} `json:"Mounts"`
+}
+
+func (d dockerContainer) Name() string {
+	if len(d.Names) == 0 {
+		return d.ID[:min(12, len(d.ID))]
+	}
+	return strings.TrimPrefix(d.Names[0], "/")
+}
+
+// PIDs lists the host PIDs of the processes of a running container.
+func (c *dockerClient) PIDs(ctx context.Context, id string) ([]int, error) {
+	var top struct {
+		Titles    []string   `json:"Titles"`
+		Processes [][]string `json:"Processes"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/containers/"+url.PathEscape(id)+"/top", &top); err != nil {
+		return nil, err
+	}
+	column := slices.Index(top.Titles, "PID")
+	if column < 0 {
+		return nil, fmt.Errorf("docker: no PID column in the processes of %s", id)
+	}
+	pids := []int{}
+	for _, process := range top.Processes {
+		if column < len(process) {
+			if pid, err := strconv.Atoi(process[column]); err == nil {
+				pids = append(pids, pid)
+			}
+		}
+	}
+	return pids, nil
+}
+
+// Stop stops a container, killing it after docker.stop_timeout.
+func (c *dockerClient) Stop(ctx context.Context, id string) error {
+	timeout := config().Docker.StopTimeout
+	ctx, cancel := context.WithTimeout(ctx, timeout+config().Timeouts.Command)
+	defer cancel()
+	return c.do(ctx, http.MethodPost, "/containers/"+url.PathEscape(id)+"/stop?t="+strconv.Itoa(int(timeout.Seconds())), nil)
+}
+
+func (c *dockerClient) Start(ctx context.Context, id string) error {
+	ctx, cancel := context.WithTimeout(ctx, config().Timeouts.Command)
+	defer cancel()
+	return c.do(ctx, http.MethodPost, "/containers/"+url.PathEscape(id)+"/start", nil)
+}
+
+func (c *dockerClient) Ping(ctx context.Context) error {
+	return c.do(ctx, http.MethodGet, "/_ping", nil)
+}
+
+// reaches reports whether a bind mount of source makes path visible in a
+// container, i.e. source is path, below it, or above it like /mnt.
+func reaches(source, path string) bool {
+	source, path = filepath.Clean(source), filepath.Clean(path)
+	return source == path || strings.HasPrefix(source, path+"/") || strings.HasPrefix(path, source+"/")
+}
+
+// collectContainers sets the containers of each mount: those with a bind
+// mount reaching it and those owning a process using it. Containers of
+// processes whose cgroup could not be read are looked up by their PIDs.
+// Containers not using a managed drive are left out.
+func collectContainers(ctx context.Context, mounts []Mount) error {
+	client := docker()
+	list, err := client.Containers(ctx)
+	if err != nil {
+		return err
+	}
+	byPID := map[int]*dockerContainer{}
+	listed := map[string]bool{}
+	for i := range mounts {
+		m := &mounts[i]
+		unknown := slices.ContainsFunc(m.Usages, func(u Usage) bool { return u.Owner == nil || u.Owner.Kind == ownerProcess })
+		for j := range list {
+			d := &list[j]
+			container := Container{ID: d.ID, Name: d.Name(), Image: d.Image, State: d.State, Restart: containerRestarts.Pending(d.ID)}
+			for _, mount := range d.Mounts {
+				if mount.Type == "bind" && reaches(mount.Source, m.Path) {
+					container.Mounts = append(container.Mounts, mount.Source)
+				}
+			}
+			owns := slices.ContainsFunc(m.Usages, func(u Usage) bool {
+				return u.Owner != nil && u.Owner.Kind == ownerContainer && strings.HasPrefix(d.ID, u.Owner.ID)
+			})
+			if len(container.Mounts) == 0 && !owns {
+				continue
+			}
+			m.Containers = append(m.Containers, container)
+			if !unknown || !container.Running() || listed[d.ID] {
+				continue
+			}
+			listed[d.ID] = true
+			pids, err := client.PIDs(ctx, d.ID)
+			if err != nil {
+				// It may have stopped since it was listed, the others still count.
+				logger.Warningf("[docker] processes of %s: %v", d.Name(), err)
+				continue
+			}
+			for _, pid := range pids {
+				byPID[pid] = d
+			}
+		}
+	}
+
+	for i := range mounts {
+		for j := range mounts[i].Usages {
+			u := &mounts[i].Usages[j]
+			if u.Owner != nil && u.Owner.Kind == ownerContainer {
+				for k := range list {
+					if strings.HasPrefix(list[k].ID, u.Owner.ID) {
+						owner := *u.Owner
+						owner.ID, owner.Name = list[k].ID, list[k].Name()
+						u.Owner = &owner
+					}
+				}
+			} else if d, ok := byPID[u.PID]; ok {
+				owner := processOwner{}
+				if u.Owner != nil {
+					owner = *u.Owner
+				}
+				owner.Kind, owner.ID, owner.Name = ownerContainer, d.ID, d.Name()
+				u.Owner = &owner
+			}
+		}
+	}
+	return nil
+}
+
+// findContainer returns a container reaching a managed mount, the only ones
+// that may be stopped and started from here.
+func findContainer(ctx context.Context, id string) (Container, Mount, error) {
+	status := systemStatusCache.Get(ctx, true)
+	if status.ErrorMounts != nil {
+		return Container{}, Mount{}, status.ErrorMounts
+	}
+	if status.ErrorDocker != nil {
+		return Container{}, Mount{}, status.ErrorDocker
+	}
+	for _, m := range status.Mounts {
+		for _, c := range m.Containers {
+			if c.ID == id {
+				return c, m, nil
+			}
+		}
+	}
+	return Container{}, Mount{}, fmt.Errorf("no container %s uses a managed drive", id)
+}
+
+// restartEntry is a container to start once its drive is mounted again.
+type restartEntry struct {
+	Name  string
+	UUID  string
+	Path  string
+	Actor auditEntry // who stopped it
+}
+
+// containerRestartList remembers stopped containers until their drive is
+// mounted again. It is kept in memory only.
+type containerRestartList struct {
+	mu      sync.Mutex
+	entries map[string]restartEntry // by container ID
+}
+
+var containerRestarts = &containerRestartList{entries: map[string]restartEntry{}}
+
+func (l *containerRestartList) Add(id string, entry restartEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries[id] = entry
+}
+
+func (l *containerRestartList) Remove(id string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.entries, id)
+}
+
+func (l *containerRestartList) Pending(id string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.entries[id]
+	return ok
+}
+
+func (l *containerRestartList) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.entries)
+}
+
+// Mounted starts the containers waiting for a drive that was just mounted.
+func (l *containerRestartList) Mounted(ctx context.Context, m Mount) {
+	l.mu.Lock()
+	due := map[string]restartEntry{}
+	for id, entry := range l.entries {
+		if (entry.UUID != "" && entry.UUID == m.UUID) || entry.Path == m.Path {
+			due[id] = entry
+			delete(l.entries, id)
+		}
+	}
+	l.mu.Unlock()
+
+	for _, id := range sortedKeys(due) {
+		entry := due[id]
+		audited := entry.Actor
+		audited.Source, audited.Action, audited.Target, audited.Outcome = "remount", "container.start", entry.Name+" ("+m.Path+")", auditSuccess
+		err := docker().Start(ctx, id)
+		if err != nil {
+			audited.Outcome, audited.Error = auditFailure, err.Error()
+		}
+		audit.Record(audited)
+	}
+	if len(due) > 0 {
+		systemStatusCache.Invalidate()
+	}
+}
+
+var errDockerDisabled = errors.New("docker is not enabled in the config")
+
+// stopContainer stops a container using a managed drive and optionally
+// starts it again once the drive is mounted again.
+func stopContainer(ctx context.Context, id string, restart bool, actor auditEntry) (Container, error) {
+	if !config().Docker.Enabled {
+		return Container{}, errDockerDisabled
+	}
+	c, m, err := findContainer(ctx, id)
+	if err != nil {
+		return c, err
+	}
+	if err := docker().Stop(ctx, id); err != nil {
+		return c, err
+	}
+	if restart {
+		containerRestarts.Add(id, restartEntry{Name: c.Name, UUID: m.UUID, Path: m.Path, Actor: actor})
+	}
+	return c, nil
+}
+
+func startContainer(ctx context.Context, id string) (Container, error) {
+	if !config().Docker.Enabled {
+		return Container{}, errDockerDisabled
+	}
+	c, _, err := findContainer(ctx, id)
+	if err != nil {
+		return c, err
+	}
+	containerRestarts.Remove(id)
+	return c, docker().Start(ctx, id)
+}
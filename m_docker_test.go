@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// newTestDocker serves handler on a Unix socket like the Docker daemon and
+// returns a client for it.
+func newTestDocker(t *testing.T, handler http.HandlerFunc) *dockerClient {
+	t.Helper()
+	if config() == nil {
+		currentConfig.Store(defaultConfig())
+	}
+	socket := filepath.Join(t.TempDir(), "docker.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(handler)
+	server.Listener = listener
+	server.Start()
+	t.Cleanup(server.Close)
+
+	client := newDockerClient(socket)
+	t.Cleanup(client.http.CloseIdleConnections)
+	return client
+}
+
+func TestDockerContainers(t *testing.T) {
+	client := newTestDocker(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/containers/json" || r.URL.Query().Get("all") != "1" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`[{"Id":"0123456789abcdef","Names":["/plex"],"Image":"plex:latest","State":"running","Mounts":[{"Type":"bind","Source":"/mnt/external/media"}]},{"Id":"fedcba9876543210","Names":[],"State":"exited"}]`))
+	})
+
+	list, err := client.Containers(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 {
+		t.Fatalf("got %d containers, want 2", len(list))
+	}
+	if got := list[0].Name(); got != "plex" {
+		t.Errorf("name = %q, want plex", got)
+	}
+	if got := list[1].Name(); got != "fedcba987654" {
+		t.Errorf("name without Names = %q, want the short ID", got)
+	}
+	if len(list[0].Mounts) != 1 || list[0].Mounts[0].Type != "bind" || list[0].Mounts[0].Source != "/mnt/external/media" {
+		t.Errorf("mounts = %+v", list[0].Mounts)
+	}
+}
+
+func TestDockerPIDs(t *testing.T) {
+	client := newTestDocker(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/containers/plex/top":
+			w.Write([]byte(`{"Titles":["UID","PID","PPID","CMD"],"Processes":[["root","4242","1","plex"],["root","4243","4242","transcoder"],["root"]]}`))
+		case "/containers/odd/top":
+			w.Write([]byte(`{"Titles":["UID","CMD"],"Processes":[["root","sh"]]}`))
+		default:
+			http.NotFound(w, r)
+		}
+	})
+
+	pids, err := client.PIDs(context.Background(), "plex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(pids, []int{4242, 4243}) {
+		t.Errorf("pids = %v, want [4242 4243]", pids)
+	}
+	if _, err := client.PIDs(context.Background(), "odd"); err == nil {
+		t.Error("no error without a PID column")
+	}
+}
+
+func TestDockerStop(t *testing.T) {
+	var stopped []string
+	client := newTestDocker(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method", http.StatusMethodNotAllowed)
+			return
+		}
+		stopped = append(stopped, r.URL.Path+"?"+r.URL.RawQuery)
+		if r.URL.Path == "/containers/done/stop" {
+			w.WriteHeader(http.StatusNotModified) // already stopped
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	for _, id := range []string{"plex", "done"} {
+		if err := client.Stop(context.Background(), id); err != nil {
+			t.Errorf("stop %s: %v", id, err)
+		}
+	}
+	want := []string{"/containers/plex/stop?t=10", "/containers/done/stop?t=10"}
+	if !slices.Equal(stopped, want) {
+		t.Errorf("requests = %v, want %v", stopped, want)
+	}
+}
+
+func TestDockerErrors(t *testing.T) {
+	client := newTestDocker(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/containers/gone/start":
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"message":"No such container: gone"}`))
+		case "/containers/broken/start":
+			http.Error(w, "upstream failed", http.StatusInternalServerError)
+		case "/containers/json":
+			w.Write([]byte(`not json`))
+		}
+	})
+
+	tests := []struct {
+		name string
+		call func() error
+		want string
+	}{
+		{"message", func() error { return client.Start(context.Background(), "gone") }, "docker: No such container: gone"},
+		{"status", func() error { return client.Start(context.Background(), "broken") }, "docker: POST /containers/broken/start: 500 Internal Server Error"},
+		{"body", func() error { _, err := client.Containers(context.Background()); return err }, "docker: unexpected response to /containers/json?all=1: invalid character 'o' in literal null (expecting 'u')"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.call()
+			if err == nil || err.Error() != test.want {
+				t.Errorf("error = %v, want %s", err, test.want)
+			}
+		})
+	}
+}
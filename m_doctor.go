@@ -0,0 +1,476 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	autofsMasterFile = "/etc/auto.master"
+	autofsMasterDir  = "/etc/auto.master.d"
+	sambaConfigFile  = "/etc/samba/smb.conf"
+)
+
+// doctorCheck is the result of one host setup check.
+type doctorCheck struct {
+	Group  string
+	Name   string
+	OK     bool
+	Detail string
+	Hint   string
+}
+
+func pass(group, name, detail string) doctorCheck {
+	return doctorCheck{Group: group, Name: name, OK: true, Detail: detail}
+}
+
+func fail(group, name, detail, hint string) doctorCheck {
+	return doctorCheck{Group: group, Name: name, Detail: detail, Hint: hint}
+}
+
+// runDoctor checks the host setup the service depends on. inServer skips the
+// port checks, the running server holds the ports itself.
+func runDoctor(inServer bool) []doctorCheck {
+	c := config()
+	checks := []doctorCheck{}
+	checks = append(checks, checkCommands(c)...)
+	checks = append(checks, checkSudoRules(c)...)
+	checks = append(checks, checkServiceUser(c)...)
+	checks = append(checks, checkAutofsMaps(c)...)
+	if c.Samba.Enabled {
+		checks = append(checks, checkSambaShares(c)...)
+	}
+	if c.Docker.Enabled {
+		checks = append(checks, checkDocker(c))
+	}
+	if !inServer {
+		checks = append(checks, checkListenPorts(c)...)
+	}
+	return checks
+}
+
+func checkCommands(c *Config) []doctorCheck {
+	checks := []doctorCheck{}
+	names := []string{c.Commands.Sudo, c.Commands.Mount, c.Commands.Umount, c.Commands.Lsof, c.Commands.Kill, c.Commands.Systemctl, c.Commands.Smbstatus, c.Commands.Loginctl}
+	if c.SMART.Enabled {
+		names = append(names, c.Commands.Smartctl)
+	}
+	for _, name := range names {
+		path, err := exec.LookPath(name)
+		if err != nil {
+			hint := "install it or set its path under commands: in the config file"
+			switch name {
+			case c.Commands.Lsof, c.Commands.Smbstatus:
+				hint = "sudo apt install lsof samba-common-bin, or set its path under commands: in the config file"
+			case c.Commands.Smartctl:
+				hint = "sudo apt install smartmontools, set its path under commands: or disable smart: in the config file"
+			}
+			checks = append(checks, fail("commands", name, err.Error(), hint))
+			continue
+		}
+		checks = append(checks, pass("commands", name, path))
+	}
+	for _, event := range hookEvents {
+		for _, hook := range c.Hooks.For(event) {
+			if hook.User != "" {
+				continue // looked up as that user by sudo, see the sudo checks
+			}
+			name := event + " hook " + hook.Name
+			if path, err := exec.LookPath(hook.Command[0]); err != nil {
+				checks = append(checks, fail("commands", name, err.Error(), "install "+hook.Command[0]+" or fix the command of the hook in the config file"))
+			} else {
+				checks = append(checks, pass("commands", name, path))
+			}
+		}
+	}
+	return checks
+}
+
+// checkSudoRules asks sudo whether each privileged command would be allowed
+// without a password. Run as root, the rules of the service user are checked.
+func checkSudoRules(c *Config) []doctorCheck {
+	serviceUser := newServiceConfig().UserName
+	if _, err := exec.LookPath(c.Commands.Sudo); err != nil {
+		return []doctorCheck{fail("sudo", "rules", "not checked, "+c.Commands.Sudo+" is missing", "sudo apt install sudo")}
+	}
+	listArgs := []string{"-n", "-l"}
+	checkedAs := "the current user"
+	if os.Geteuid() == 0 {
+		if _, err := user.Lookup(serviceUser); err == nil {
+			listArgs = append(listArgs, "-U", serviceUser)
+			checkedAs = serviceUser
+		}
+	}
+
+	commands := [][]string{{c.Commands.Kill, "-" + c.Kill.Signal, "--", "1"}}
+	if c.Samba.Enabled {
+		commands = append(commands, []string{c.Commands.Smbstatus, "--locked"})
+	}
+	for _, svc := range c.Services {
+		if svc.Restartable {
+			commands = append(commands, []string{c.Commands.Systemctl, "restart", svc.Unit})
+		}
+	}
+	mounts, err := managedMountPoints(c)
+	if err != nil {
+		return []doctorCheck{fail("sudo", "mounts", err.Error(), "")}
+	}
+	for _, path := range mounts {
+		commands = append(commands, []string{c.Commands.Umount, "--", path}, []string{c.Commands.Lsof, "--", path})
+	}
+
+	checks := []doctorCheck{}
+	for _, command := range commands {
+		name := strings.Join(command, " ")
+		output, err := runCommand(false, c.Commands.Sudo, append(listArgs, command...)...)
+		if err != nil {
+			detail := strings.TrimSpace(string(output))
+			if detail == "" {
+				detail = err.Error()
+			}
+			checks = append(checks, fail("sudo", name, "not allowed for "+checkedAs+": "+detail,
+				"add a NOPASSWD rule for "+serviceUser+" with 'sudo visudo -f /etc/sudoers.d/unmounter', see README step 3"))
+			continue
+		}
+		checks = append(checks, pass("sudo", name, "allowed for "+checkedAs+" without password"))
+	}
+	if len(mounts) == 0 {
+		checks = append(checks, pass("sudo", "umount/lsof", "no managed mount is mounted, rules not checked"))
+	}
+	for _, event := range hookEvents {
+		for _, hook := range c.Hooks.For(event) {
+			if hook.User == "" {
+				continue
+			}
+			name := fmt.Sprintf("%s hook %s as %s", event, hook.Name, hook.User)
+			args := append(append(slices.Clone(listArgs), "-u", hook.User), hook.Command...)
+			if output, err := runCommand(false, c.Commands.Sudo, args...); err != nil {
+				detail := strings.TrimSpace(string(output))
+				if detail == "" {
+					detail = err.Error()
+				}
+				checks = append(checks, fail("sudo", name, "not allowed for "+checkedAs+": "+detail,
+					"add a NOPASSWD:SETENV rule for "+serviceUser+" as "+hook.User+", see README Hooks"))
+			} else {
+				checks = append(checks, pass("sudo", name, "allowed for "+checkedAs+" without password"))
+			}
+		}
+	}
+	return checks
+}
+
+func checkDocker(c *Config) doctorCheck {
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeouts.Command)
+	defer cancel()
+	client := newDockerClient(c.Docker.Socket) // for the checked config, not the running one
+	defer client.http.CloseIdleConnections()
+	if err := client.Ping(ctx); err != nil {
+		return fail("docker", c.Docker.Socket, err.Error(), "start docker, or add "+newServiceConfig().UserName+" to the docker group with 'sudo usermod -aG docker "+newServiceConfig().UserName+"'")
+	}
+	return pass("docker", c.Docker.Socket, "the Engine API answers")
+}
+
+func checkServiceUser(c *Config) []doctorCheck {
+	serviceUser := newServiceConfig().UserName
+	checks := []doctorCheck{}
+
+	account, err := user.Lookup(serviceUser)
+	if err != nil {
+		checks = append(checks, fail("user", serviceUser, err.Error(), "sudo useradd -r -s /bin/false "+serviceUser))
+		return checks
+	}
+	checks = append(checks, pass("user", serviceUser, "uid "+account.Uid))
+	uid, _ := strconv.Atoi(account.Uid)
+
+	dirs := map[string]bool{}
+	for _, path := range []string{c.Auth.KeysFile, c.Auth.TokensFile, c.Auth.TOTPFile} {
+		dirs[filepath.Dir(path)] = true
+	}
+	for dir := range dirs {
+		info, err := os.Stat(dir)
+		hint := fmt.Sprintf("sudo install -d -o %s -g %s -m 700 %s", serviceUser, serviceUser, dir)
+		if err != nil {
+			checks = append(checks, fail("user", "state dir "+dir, err.Error(), hint))
+			continue
+		}
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		switch {
+		case !info.IsDir():
+			checks = append(checks, fail("user", "state dir "+dir, "not a directory", hint))
+		case ok && int(stat.Uid) != uid && !dirWritableBy(info, uid):
+			checks = append(checks, fail("user", "state dir "+dir, "not writable by "+serviceUser, hint))
+		case info.Mode().Perm()&0o007 != 0:
+			checks = append(checks, fail("user", "state dir "+dir, "accessible by all users ("+info.Mode().Perm().String()+")", "sudo chmod 700 "+dir))
+		default:
+			checks = append(checks, pass("user", "state dir "+dir, info.Mode().Perm().String()))
+		}
+	}
+
+	if configFile != "" {
+		info, err := os.Stat(configFile)
+		switch {
+		case err != nil:
+			checks = append(checks, fail("user", "config file", err.Error(), ""))
+		case info.Mode().Perm()&0o004 != 0:
+			checks = append(checks, fail("user", "config file "+configFile, "readable by all users but contains passwords",
+				fmt.Sprintf("sudo chown %s %s && sudo chmod 600 %s", serviceUser, configFile, configFile)))
+		default:
+			checks = append(checks, pass("user", "config file "+configFile, info.Mode().Perm().String()))
+		}
+	}
+	return checks
+}
+
+// dirWritableBy is a rough check via the group and other permission bits.
+func dirWritableBy(info fs.FileInfo, uid int) bool {
+	if uid == 0 {
+		return true
+	}
+	return info.Mode().Perm()&0o022 != 0
+}
+
+// autofsMapEntry is a line of an autofs map that mounts a local device.
+type autofsMapEntry struct {
+	MapFile    string
+	MountPoint string
+	Device     string
+}
+
+// checkAutofsMaps verifies that every device referenced in the autofs maps
+// exists, e.g. that the UUID in /dev/disk/by-uuid is still the right one.
+func checkAutofsMaps(c *Config) []doctorCheck {
+	entries, err := readAutofsMaps()
+	if err != nil {
+		return []doctorCheck{fail("autofs", autofsMasterFile, err.Error(), "see README step 1")}
+	}
+	if len(entries) == 0 {
+		return []doctorCheck{pass("autofs", autofsMasterFile, "no local devices in the autofs maps")}
+	}
+
+	checks := []doctorCheck{}
+	for _, entry := range entries {
+		name := entry.MountPoint + " (" + entry.MapFile + ")"
+		target, err := filepath.EvalSymlinks(entry.Device)
+		switch {
+		case err != nil:
+			checks = append(checks, fail("autofs", name, entry.Device+" does not exist",
+				"plug in the disk or fix the UUID in "+entry.MapFile+", see 'ls -l /dev/disk/by-uuid'"))
+		case !isManagedMountPath(entry.MountPoint):
+			checks = append(checks, fail("autofs", name, "mount point is not below mounts.path_prefixes, unmounter will not list it",
+				"add its parent directory to mounts.path_prefixes"))
+		case !isManagedDevice(target):
+			checks = append(checks, fail("autofs", name, entry.Device+" resolves to "+target+" which is not matched by mounts.device_prefixes",
+				"add a matching prefix to mounts.device_prefixes"))
+		default:
+			checks = append(checks, pass("autofs", name, entry.Device+" -> "+target))
+		}
+	}
+	return checks
+}
+
+func readAutofsMaps() ([]autofsMapEntry, error) {
+	masters := []string{autofsMasterFile}
+	extra, _ := filepath.Glob(filepath.Join(autofsMasterDir, "*.autofs"))
+	masters = append(masters, extra...)
+
+	entries := []autofsMapEntry{}
+	for i, master := range masters {
+		lines, err := readConfigLines(master)
+		if err != nil {
+			if i == 0 {
+				return nil, err
+			}
+			continue
+		}
+		for _, fields := range lines {
+			if len(fields) < 2 || !strings.HasPrefix(fields[1], "/") {
+				continue // +auto.master, program maps etc.
+			}
+			mapLines, err := readConfigLines(fields[1])
+			if err != nil {
+				continue
+			}
+			for _, mapFields := range mapLines {
+				device := ""
+				for _, field := range mapFields[1:] {
+					if strings.HasPrefix(field, ":/dev/") {
+						device = strings.TrimPrefix(field, ":")
+					}
+				}
+				if device == "" {
+					continue
+				}
+				mountPoint := mapFields[0]
+				if fields[0] != "/-" {
+					mountPoint = filepath.Join(fields[0], mountPoint)
+				}
+				entries = append(entries, autofsMapEntry{MapFile: fields[1], MountPoint: mountPoint, Device: device})
+			}
+		}
+	}
+	return entries, nil
+}
+
+// checkSambaShares warns about shares below a managed mount directory that
+// is not mounted; clients would write to the root file system.
+func checkSambaShares(c *Config) []doctorCheck {
+	lines, err := readConfigLines(sambaConfigFile)
+	if err != nil {
+		return []doctorCheck{fail("samba", sambaConfigFile, err.Error(), "install samba or set samba.enabled: false")}
+	}
+	mounted, err := mountPoints()
+	if err != nil {
+		return []doctorCheck{fail("samba", "mounts", err.Error(), "")}
+	}
+
+	checks := []doctorCheck{}
+	section := ""
+	for _, fields := range lines {
+		line := strings.Join(fields, " ")
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.Trim(line, "[]")
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok || strings.TrimSpace(key) != "path" || section == "global" || section == "printers" || section == "print$" {
+			continue
+		}
+		path := strings.TrimSpace(value)
+		name := "[" + section + "] " + path
+		if _, err := os.Stat(path); err != nil {
+			checks = append(checks, fail("samba", name, err.Error(), "create the directory or fix the path in "+sambaConfigFile))
+			continue
+		}
+		if isManagedMountPath(path) && !underMountPoint(path, mounted) {
+			checks = append(checks, fail("samba", name, "share is below a managed mount directory but nothing is mounted there",
+				"mount the disk (e.g. ls "+path+" to trigger autofs) before clients connect"))
+			continue
+		}
+		checks = append(checks, pass("samba", name, "exists"))
+	}
+	if len(checks) == 0 {
+		checks = append(checks, pass("samba", sambaConfigFile, "no shares with a path"))
+	}
+	return checks
+}
+
+func checkListenPorts(c *Config) []doctorCheck {
+	addresses := []string{c.Listen.Address}
+	if c.Listen.RedirectAddress != "" {
+		addresses = append(addresses, c.Listen.RedirectAddress)
+	}
+	checks := []doctorCheck{}
+	for _, address := range addresses {
+		listener, err := net.Listen("tcp", address)
+		if err != nil {
+			checks = append(checks, fail("network", "listen "+address, err.Error(),
+				"fine if the unmounter service is running, otherwise change listen.address or stop the other program (sudo ss -tlnp)"))
+			continue
+		}
+		listener.Close()
+		checks = append(checks, pass("network", "listen "+address, "available"))
+	}
+	return checks
+}
+
+// readConfigLines returns the whitespace separated fields of every line that
+// is not empty or a comment.
+func readConfigLines(path string) ([][]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	lines := [][]string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		lines = append(lines, strings.Fields(line))
+	}
+	return lines, scanner.Err()
+}
+
+// mountPoints reads the mount points of all file systems from /proc/mounts.
+func mountPoints() ([]string, error) {
+	lines, err := readConfigLines("/proc/mounts")
+	if err != nil {
+		return nil, err
+	}
+	points := []string{}
+	for _, fields := range lines {
+		if len(fields) > 1 {
+			points = append(points, strings.ReplaceAll(fields[1], `\040`, " "))
+		}
+	}
+	return points, nil
+}
+
+// managedMountPoints returns the mounted paths unmounter manages.
+func managedMountPoints(c *Config) ([]string, error) {
+	lines, err := readConfigLines("/proc/mounts")
+	if err != nil {
+		return nil, err
+	}
+	managed := []string{}
+	for _, fields := range lines {
+		if len(fields) > 1 && isManagedDevice(fields[0]) && isManagedMountPath(fields[1]) {
+			managed = append(managed, strings.ReplaceAll(fields[1], `\040`, " "))
+		}
+	}
+	return managed, nil
+}
+
+func underMountPoint(path string, mounted []string) bool {
+	for _, point := range mounted {
+		if isManagedMountPath(point) && (path == point || strings.HasPrefix(path, point+"/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// failedChecks counts the checks that did not pass.
+func failedChecks(checks []doctorCheck) int {
+	failed := 0
+	for _, check := range checks {
+		if !check.OK {
+			failed++
+		}
+	}
+	return failed
+}
+
+func handleDoctorArgs(args []string) int {
+	checks := runDoctor(false)
+	for _, check := range checks {
+		mark := "ok  "
+		if !check.OK {
+			mark = "FAIL"
+		}
+		fmt.Printf("[%s] %-8s %s: %s\n", mark, check.Group, check.Name, check.Detail)
+		if !check.OK && check.Hint != "" {
+			fmt.Println("                hint:", check.Hint)
+		}
+	}
+	if failed := failedChecks(checks); failed > 0 {
+		fmt.Printf("%d of %d checks failed\n", failed, len(checks))
+		return exitFailure
+	}
+	fmt.Printf("All %d checks passed\n", len(checks))
+	return exitOK
+}
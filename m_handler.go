@@ -2,20 +2,25 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"embed"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
-	"os/exec"
-	"regexp"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/google/safehtml"
 	"github.com/google/safehtml/template"
 
 	"github.com/gorilla/csrf"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/sessions"
+	"gopkg.in/yaml.v3"
 )
 
 var store *sessions.CookieStore
@@ -33,138 +38,973 @@ var flashFuncs = template.FuncMap{
 		}
 		return ""
 	},
+	"is_warning": func(input string) string { // shown, but the action did not fail
+		if strings.HasPrefix(input, "[warning]") {
+			return input
+		}
+		return ""
+	},
 }
 
-//go:embed main.html
+//go:embed *.html
 var templateFS embed.FS
-var mainTemplate = template.Must(template.New("main").Funcs(flashFuncs).ParseFS(template.TrustedFSFromEmbed(templateFS), "main.html"))
+var mainTemplate = template.Must(template.New("main").Funcs(flashFuncs).ParseFS(template.TrustedFSFromEmbed(templateFS), "*.html"))
+
+var tokens *tokenStore
 
 type ViewData struct {
 	CsrfToken string
 	Flashes   []any
 	*SystemStatus
 	DevModeEnabled bool // Added DevModeEnabled field
+	IsAdmin        bool
+	StepUpRequired bool
+	Alerts         []alert
+}
+
+type TwoFactorViewData struct {
+	*ViewData
+	User              string
+	Enabled           bool
+	Pending           bool
+	Secret            string
+	QRCode            safehtml.URL
+	RecoveryCodes     []string
+	RecoveryCodesLeft int
+	Mode              string
+}
+
+type LocksViewData struct {
+	*ViewData
+	Entries []attemptEntry
+}
+
+type AuditViewData struct {
+	*ViewData
+	Entries  []auditEntry
+	Filter   auditFilter
+	Since    string
+	Outcomes []string
+}
+
+type DrivesViewData struct {
+	*ViewData
+	Drives []*driveHistory
+}
+
+type DriveViewData struct {
+	*ViewData
+	Drive *driveHistory
+}
+
+type DoctorViewData struct {
+	*ViewData
+	Checks []doctorCheck
+	Failed int
+}
+
+type ConfigViewData struct {
+	*ViewData
+	File       string
+	YAML       string
+	LastReload *reloadResult
+}
+
+type SchedulesViewData struct {
+	*ViewData
+	Jobs    []scheduledJob
+	Actions []string
+}
+
+type TokensViewData struct {
+	*ViewData
+	Tokens   []*apiToken
+	Scopes   []string
+	NewToken string
 }
 
-func runWebServer() {
-	store = sessions.NewCookieStore(generateRandomKey(32))
-	store.Options = &sessions.Options{Path: "/", MaxAge: 3600 * 8, HttpOnly: true, Secure: false}
+// newViewData fills the fields shared by all pages. Flashes are consumed, so
+// the session has to be saved afterwards.
+func newViewData(r *http.Request, session *sessions.Session) *ViewData {
+	return &ViewData{
+		CsrfToken:      csrf.Token(r),
+		Flashes:        session.Flashes(),
+		DevModeEnabled: config().DevMode,
+		IsAdmin:        principalFrom(r).Can(scopeAdmin),
+		Alerts:         alerts.Active(),
+	}
+}
+
+// runWebServer serves until ctx is cancelled, then shuts down gracefully.
+func runWebServer(ctx context.Context) error {
+	keys, err := loadOrCreateKeyRing(config().Auth.KeysFile)
+	if err != nil {
+		return err
+	}
+
+	store = keys.sessionStore()
+	store.Options = &sessions.Options{Path: "/", MaxAge: 3600 * 8, HttpOnly: true, Secure: config().TLS.Enabled}
+
+	tokens, err = loadTokenStore(config().Auth.TokensFile)
+	if err != nil {
+		return err
+	}
+
+	totps, err = loadTOTPStore(config().Auth.TOTPFile)
+	if err != nil {
+		return err
+	}
+
+	history, err = loadHistoryStore(config().History.File)
+	if err != nil {
+		return err
+	}
+
+	webhooks, err = loadWebhookDispatcher(config().Webhooks.Outbox)
+	if err != nil {
+		return err
+	}
+
+	schedules, err = loadScheduler(config().Schedules.State)
+	if err != nil {
+		return err
+	}
+
+	loginAttempts = newAttemptTracker(config().Auth.MaxFailures, config().Auth.Lockout, config().Auth.MaxLockout)
+	actionLimiter = newRateLimiter(config().Auth.ActionRateLimit, max(1, config().Auth.ActionRateLimit/6))
 
 	r := mux.NewRouter()
 
-	r.HandleFunc("/", withBasicAuth(handlerListMounts)).Methods("GET")
-	r.HandleFunc("/unmount", withBasicAuth(handlerUnmount)).Methods("POST")
-	r.HandleFunc("/restart-autofs", withBasicAuth(handlerRestartAutoFs)).Methods("POST")
-	r.HandleFunc("/kill-process", withBasicAuth(handlerKillProcess)).Methods("POST")
+	r.HandleFunc("/", withAuth(scopeStatusRead, handlerListMounts)).Methods("GET")
+	r.HandleFunc("/api/status", withAuth(scopeStatusRead, handlerAPIStatus)).Methods("GET")
+	r.HandleFunc("/metrics", withMetricsAuth(handlerMetrics)).Methods("GET")
+	r.HandleFunc("/drives", withAuth(scopeStatusRead, handlerListDrives)).Methods("GET")
+	r.HandleFunc("/drives/{uuid}", withAuth(scopeStatusRead, handlerDriveTimeline)).Methods("GET")
+	r.HandleFunc("/api/drives", withAuth(scopeStatusRead, handlerAPIDrives)).Methods("GET")
+	r.HandleFunc("/api/drives/{uuid}", withAuth(scopeStatusRead, handlerAPIDrive)).Methods("GET")
+	r.HandleFunc("/api/alerts", withAuth(scopeStatusRead, handlerAPIAlerts)).Methods("GET")
+	r.HandleFunc("/unmount", withAuth(scopeMountUnmount, withRateLimit(withOperation(handlerUnmount)))).Methods("POST")
+	r.HandleFunc("/restart-autofs", withAuth(scopeServiceRestart, withRateLimit(withOperation(handlerRestartService)))).Methods("POST")
+	r.HandleFunc("/restart-service", withAuth(scopeServiceRestart, withRateLimit(withOperation(handlerRestartService)))).Methods("POST")
+	r.HandleFunc("/kill-process", withAuth(scopeProcessKill, withRateLimit(withOperation(handlerKillProcess)))).Methods("POST")
+	r.HandleFunc("/containers/stop", withAuth(scopeContainerManage, withRateLimit(withOperation(handlerStopContainer)))).Methods("POST")
+	r.HandleFunc("/containers/start", withAuth(scopeContainerManage, withRateLimit(withOperation(handlerStartContainer)))).Methods("POST")
+	r.HandleFunc("/units/stop", withAuth(scopeServiceRestart, withRateLimit(withOperation(handlerStopUnit)))).Methods("POST")
+	r.HandleFunc("/sessions/terminate", withAuth(scopeProcessKill, withRateLimit(withOperation(handlerTerminateSession)))).Methods("POST")
+	r.HandleFunc("/schedules", withAuth(scopeStatusRead, handlerListSchedules)).Methods("GET")
+	r.HandleFunc("/api/schedules", withAuth(scopeStatusRead, handlerAPISchedules)).Methods("GET")
+	r.HandleFunc("/schedules/run", withAuth(scopeStatusRead, withRateLimit(handlerRunSchedule))).Methods("POST")
+	r.HandleFunc("/schedules/add", withAuth(scopeAdmin, handlerAddSchedule)).Methods("POST")
+	r.HandleFunc("/schedules/delete", withAuth(scopeAdmin, handlerDeleteSchedule)).Methods("POST")
+	r.HandleFunc("/smart/test", withAuth(scopeDiskTest, withRateLimit(withOperation(handlerSMARTSelfTest)))).Methods("POST")
+
+	r.HandleFunc("/login/2fa", withCredentials(handlerTwoFactorLogin)).Methods("GET")
+	r.HandleFunc("/login/2fa", withCredentials(handlerTwoFactorLoginVerify)).Methods("POST")
+	r.HandleFunc("/account/2fa", withAuth(scopeStatusRead, browserOnly(handlerTwoFactor))).Methods("GET")
+	r.HandleFunc("/account/2fa/enroll", withAuth(scopeStatusRead, browserOnly(handlerTwoFactorEnroll))).Methods("POST")
+	r.HandleFunc("/account/2fa/confirm", withAuth(scopeStatusRead, browserOnly(handlerTwoFactorConfirm))).Methods("POST")
+	r.HandleFunc("/account/2fa/disable", withAuth(scopeStatusRead, browserOnly(handlerTwoFactorDisable))).Methods("POST")
+
+	r.HandleFunc("/admin/tokens", withAuth(scopeAdmin, handlerListTokens)).Methods("GET")
+	r.HandleFunc("/admin/tokens/create", withAuth(scopeAdmin, handlerCreateToken)).Methods("POST")
+	r.HandleFunc("/admin/tokens/revoke", withAuth(scopeAdmin, handlerRevokeToken)).Methods("POST")
+	r.HandleFunc("/admin/locks", withAuth(scopeAdmin, handlerListLocks)).Methods("GET")
+	r.HandleFunc("/admin/locks/clear", withAuth(scopeAdmin, handlerClearLocks)).Methods("POST")
+	r.HandleFunc("/admin/audit", withAuth(scopeAdmin, handlerListAudit)).Methods("GET")
+	r.HandleFunc("/api/audit", withAuth(scopeAdmin, handlerAPIAudit)).Methods("GET")
+	r.HandleFunc("/admin/doctor", withAuth(scopeAdmin, handlerDoctor)).Methods("GET")
+	r.HandleFunc("/admin/config", withAuth(scopeAdmin, handlerShowConfig)).Methods("GET")
+	r.HandleFunc("/admin/config/reload", withAuth(scopeAdmin, handlerReloadConfig)).Methods("POST")
 
-	CSRF := csrf.Protect(generateRandomKey(32), csrf.SameSite(csrf.SameSiteStrictMode), csrf.FieldName("csrf"), csrf.Secure(false), csrf.CookieName("csrf"))
-	CSRFRouter := CSRF(r)
+	r.Use(withHTTPMetrics)
+
+	CSRF := keys.csrfProtect(csrf.SameSite(csrf.SameSiteStrictMode), csrf.FieldName("csrf"), csrf.Secure(config().TLS.Enabled), csrf.CookieName("csrf"))
+	CSRFRouter := skipCSRFForBearer(CSRF(r))
+
+	servers := []*http.Server{}
+	listeners := []net.Listener{}
+	listen := func(server *http.Server) error {
+		listener, err := net.Listen("tcp", server.Addr)
+		if err != nil {
+			return err
+		}
+		servers = append(servers, server)
+		listeners = append(listeners, listener)
+		return nil
+	}
 
-	fmt.Println("Server started at http://localhost:8080")
-	if err := http.ListenAndServe(":8080", CSRFRouter); err != nil {
+	if !config().TLS.Enabled {
+		// Without TLS the CSRF middleware must not enforce https origins.
+		plaintextRouter := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			CSRFRouter.ServeHTTP(w, csrf.PlaintextHTTPRequest(r))
+		})
+		if err := listen(&http.Server{Addr: config().Listen.Address, Handler: plaintextRouter}); err != nil {
+			return err
+		}
+		fmt.Println("Server started at http://localhost" + config().Listen.Address)
+	} else {
+		if err := ensureSelfSignedCert(config().TLS.CertFile, config().TLS.KeyFile); err != nil {
+			return fmt.Errorf("failed to create self-signed certificate: %v", err)
+		}
+		certs, err = newCertReloader(config().TLS.CertFile, config().TLS.KeyFile)
+		if err != nil {
+			return err
+		}
+
+		server := &http.Server{
+			Addr:      config().Listen.Address,
+			Handler:   CSRFRouter,
+			TLSConfig: &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: certs.GetCertificate},
+		}
+		if err := listen(server); err != nil {
+			return err
+		}
+		listeners[0] = tls.NewListener(listeners[0], server.TLSConfig)
+		if config().Listen.RedirectAddress != "" {
+			if err := listen(&http.Server{Addr: config().Listen.RedirectAddress, Handler: redirectToHTTPS(config().Listen.Address)}); err != nil {
+				listeners[0].Close()
+				return err
+			}
+		}
+		fmt.Println("Server started at https://localhost" + config().Listen.Address)
+	}
+
+	serveErrors := make(chan error, len(servers))
+	for i, server := range servers {
+		go func() {
+			if err := server.Serve(listeners[i]); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				serveErrors <- err
+			}
+		}()
+	}
+
+	watchCtx, stopWatchers := context.WithCancel(ctx)
+	defer stopWatchers()
+	go watchReloadSignal(watchCtx)
+	bridge := startMQTT(watchCtx)
+	go webhooks.Run(watchCtx)
+	go alerts.Run(watchCtx, bridge)
+	go idle.Run(watchCtx)
+	go schedules.Run(watchCtx)
+	go hooks.Run(watchCtx)
+	sdNotify("READY=1\nSTATUS=listening on " + config().Listen.Address)
+
+	select {
+	case <-ctx.Done():
+	case err = <-serveErrors:
+		logger.Error("Server failed:", err)
+	}
+	stopWatchers()
+	bridge.Stop()
+	shutdown(servers)
+	return err
+}
+
+func handlerListMounts(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, "sid")
+
+	viewData := newViewData(r, session)
+	viewData.SystemStatus = systemStatusCache.Get(r.Context(), r.URL.Query().Get("fresh") == "1")
+	viewData.StepUpRequired = stepUpRequired(principalFrom(r))
+
+	session.Save(r, w)
+	err := mainTemplate.Execute(w, viewData)
+	if err != nil {
 		logger.Error(err)
 	}
 }
 
-func withBasicAuth(handler http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		user, pass, ok := r.BasicAuth()
-		if !ok || user != username || pass != password {
-			w.Header().Set("WWW-Authenticate", `Basic realm="restricted"`)
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
+func handlerAPIStatus(w http.ResponseWriter, r *http.Request) {
+	status := systemStatusCache.Get(r.Context(), r.URL.Query().Get("fresh") == "1")
+	w.Header().Set("Age", strconv.Itoa(int(status.Age().Seconds())))
+	writeJSON(w, http.StatusOK, status)
+}
+
+// finishAction reports the outcome of a mutating action. Browsers get the
+// flash messages after a redirect, API token clients get them as JSON.
+func finishAction(w http.ResponseWriter, r *http.Request, session *sessions.Session) {
+	finishActionAt(w, r, session, "/")
+}
+
+// finishActionAt is finishAction for actions of other pages than the main page.
+func finishActionAt(w http.ResponseWriter, r *http.Request, session *sessions.Session, page string) {
+	// The action changed mounts, processes or services.
+	systemStatusCache.Invalidate()
+
+	if !principalFrom(r).IsToken() {
+		session.Save(r, w)
+		http.Redirect(w, r, page, http.StatusSeeOther)
+		return
+	}
+
+	result := actionResult{Success: true}
+	for _, flash := range session.Flashes() {
+		message, _ := flash.(string)
+		if strings.HasPrefix(message, "[error]") {
+			result.Success = false
 		}
-		handler(w, r)
+		result.Messages = append(result.Messages, message)
 	}
+	status := http.StatusOK
+	if !result.Success {
+		status = http.StatusBadRequest
+	}
+	writeJSON(w, status, result)
 }
 
-func handlerListMounts(w http.ResponseWriter, r *http.Request) {
+type actionResult struct {
+	Success  bool     `json:"success"`
+	Messages []string `json:"messages"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Error(err)
+	}
+}
+
+func handlerListDrives(w http.ResponseWriter, r *http.Request) {
 	session, _ := store.Get(r, "sid")
 
-	viewData := &ViewData{
-		CsrfToken:      csrf.Token(r),
-		Flashes:        session.Flashes(),
-		SystemStatus:   getSystemStatus(),
-		DevModeEnabled: devModeEnabled, // Pass devModeEnabled to ViewData
+	viewData := &DrivesViewData{
+		ViewData: newViewData(r, session),
+		Drives:   history.Drives(),
 	}
 
 	session.Save(r, w)
-	err := mainTemplate.Execute(w, viewData)
+	err := mainTemplate.ExecuteTemplate(w, "drives", viewData)
 	if err != nil {
 		logger.Error(err)
 	}
 }
 
-func handlerRestartAutoFs(w http.ResponseWriter, r *http.Request) {
+func handlerDriveTimeline(w http.ResponseWriter, r *http.Request) {
+	drive, ok := history.Drive(mux.Vars(r)["uuid"])
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
 	session, _ := store.Get(r, "sid")
-	if !devModeEnabled {
-		cmd := exec.Command("sudo", "systemctl", "restart", "autofs")
-		err := cmd.Run()
+
+	viewData := &DriveViewData{
+		ViewData: newViewData(r, session),
+		Drive:    drive,
+	}
+
+	session.Save(r, w)
+	err := mainTemplate.ExecuteTemplate(w, "drive", viewData)
+	if err != nil {
+		logger.Error(err)
+	}
+}
+
+func handlerAPIDrives(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, history.Drives())
+}
+
+func handlerAPIAlerts(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, alerts.Active())
+}
+
+func handlerAPIDrive(w http.ResponseWriter, r *http.Request) {
+	drive, ok := history.Drive(mux.Vars(r)["uuid"])
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, http.StatusOK, drive)
+}
+
+func handlerRestartService(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, "sid")
+
+	unit := r.FormValue("unit")
+	if unit == "" {
+		unit = "autofs" // POST /restart-autofs
+	}
+	err := restartService(unit)
+	auditRequest(r, "restart", unit, err)
+	history.RecordRestart(unit, principalFrom(r).Name, err)
+	if err != nil {
+		session.AddFlash("[error] Failed to restart " + unit + ": " + err.Error())
+	} else {
+		session.AddFlash("[success] restarted " + unit)
+	}
+	finishAction(w, r, session)
+}
+
+func handlerSMARTSelfTest(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, "sid")
+
+	path, kind := r.FormValue("device"), r.FormValue("test")
+	if !validMountPath(path) || (kind != "short" && kind != "long") {
+		session.AddFlash("[error] invalid self-test request")
+		auditRequest(r, "smart.test", strconv.Quote(path+" "+kind), errors.New("invalid request"))
+	} else {
+		err := startSelfTest(r.Context(), path, kind)
+		auditRequest(r, "smart.test", path+" "+kind, err)
 		if err != nil {
-			session.AddFlash("[error] Failed to restart autofs: " + err.Error())
-			logger.Error("[error] Failed to restart autofs:", err)
+			session.AddFlash("[error] failed to start self-test: " + err.Error())
 		} else {
-			time.Sleep(2 * time.Second)
-			session.AddFlash("[success] restarted autofs")
-			logger.Info("[success] restarted autofs")
+			session.AddFlash("[success] started " + kind + " self-test on " + path)
 		}
-	} else {
-		time.Sleep(1 * time.Second) // Simulate delay
-		session.AddFlash("[success] restarted autofs (simulated)")
-		logger.Info("[success] restarted autofs (simulated)")
 	}
-	session.Save(r, w)
-	http.Redirect(w, r, "/", http.StatusSeeOther)
+	finishAction(w, r, session)
 }
 
-var regexDevice = regexp.MustCompile(`^/(mnt|media)/[\/a-zA-Z0-9_ -]+$`)
-
 func handlerUnmount(w http.ResponseWriter, r *http.Request) {
 	session, _ := store.Get(r, "sid")
 
 	userInputDevice := r.FormValue("device")
 
-	if !regexDevice.MatchString(userInputDevice) {
+	if !validMountPath(userInputDevice) {
 		// Validation NOT OK
 		session.AddFlash("[error] invalid device " + userInputDevice)
-		logger.Error("[error] invalid device from user input")
+		auditRequest(r, "unmount", strconv.Quote(userInputDevice), errors.New("invalid device"))
+	} else if err := verifyStepUp(r); err != nil {
+		session.AddFlash("[error] unmount not confirmed: " + err.Error())
+		auditRequest(r, "unmount", userInputDevice, fmt.Errorf("not confirmed: %v", err))
 	} else {
 		// Validation OK
-		err := unmountDevice(r.FormValue("device"))
+		results, err := unmountWithHooks(r.Context(), userInputDevice, requestActor(r))
+		auditRequest(r, "unmount", userInputDevice, err)
+		history.RecordUnmount(userInputDevice, principalFrom(r).Name, err)
+		for _, result := range results {
+			if result.Err != nil {
+				session.AddFlash("[warning] " + result.String())
+			} else {
+				session.AddFlash("[success] " + result.String())
+			}
+		}
 		if err != nil {
 			session.AddFlash("[error] unmount failed: " + err.Error())
-			logger.Error("[error] unmount failed: ", err)
 		} else {
 			session.AddFlash("[success] unmounting " + userInputDevice)
-			logger.Info("[success] unmounting " + userInputDevice)
 		}
 	}
 
-	session.Save(r, w)
-	http.Redirect(w, r, "/", http.StatusSeeOther)
+	finishAction(w, r, session)
 }
 
 func handlerKillProcess(w http.ResponseWriter, r *http.Request) {
 	session, _ := store.Get(r, "sid")
 
-	pidStr := r.FormValue("pid")
+	pidStr, startedStr := r.FormValue("pid"), r.FormValue("started")
 	pid, err := strconv.Atoi(pidStr)
+	// The start time of the listed process tells it apart from a later one
+	// with the same PID, the command is optional.
+	started, startedErr := strconv.ParseUint(startedStr, 10, 64)
+	target := processIdentity{PID: pid, Started: started, Command: r.FormValue("command")}
 	if err != nil || pid <= 0 {
 		// Validation NOT OK
 		session.AddFlash("[error] Invalid PID: " + pidStr)
-		logger.Error("[error] Invalid PID:", pidStr)
+		auditRequest(r, "kill", strconv.Quote(pidStr), errors.New("invalid pid"))
+	} else if startedErr != nil || started == 0 {
+		session.AddFlash("[error] Invalid start time " + strconv.Quote(startedStr) + ", reload the list and kill from there")
+		auditRequest(r, "kill", pidStr, errors.New("invalid start time"))
+	} else if err = verifyStepUp(r); err != nil {
+		session.AddFlash("[error] kill not confirmed: " + err.Error())
+		auditRequest(r, "kill", pidStr, fmt.Errorf("not confirmed: %v", err))
 	} else {
 		// Validation OK
-		err = killProcess(pid)
-		if err != nil {
+		command, err := killProcess(target)
+		auditRequest(r, "kill", processTarget(pid, command), err)
+		history.RecordKill(pid, command, principalFrom(r).Name, err)
+		switch {
+		case errors.Is(err, errStaleProcess):
+			session.AddFlash("[error] Not killed, " + err.Error() + ". Check the list again.")
+		case err != nil:
 			session.AddFlash("[error] Failed to kill process: " + err.Error())
-			logger.Error("[error] Failed to kill process:", err)
-		} else {
+		default:
 			session.AddFlash("[success] killed process: " + strconv.Itoa(pid))
-			logger.Info("[success] killed process: " + strconv.Itoa(pid))
+		}
+	}
+
+	finishAction(w, r, session)
+}
+
+func handlerStopContainer(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, "sid")
+
+	id, restart := r.FormValue("id"), r.FormValue("restart") == "on"
+	c, err := stopContainer(r.Context(), id, restart, requestActor(r))
+	target := c.Name
+	if target == "" {
+		target = strconv.Quote(id)
+	}
+	auditRequest(r, "container.stop", target, err)
+	switch {
+	case err != nil:
+		session.AddFlash("[error] failed to stop container: " + err.Error())
+	case restart:
+		session.AddFlash("[success] stopped container " + c.Name + ", it is started again when its drive is mounted")
+	default:
+		session.AddFlash("[success] stopped container " + c.Name)
+	}
+	finishAction(w, r, session)
+}
+
+func handlerStartContainer(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, "sid")
+
+	id := r.FormValue("id")
+	c, err := startContainer(r.Context(), id)
+	target := c.Name
+	if target == "" {
+		target = strconv.Quote(id)
+	}
+	auditRequest(r, "container.start", target, err)
+	if err != nil {
+		session.AddFlash("[error] failed to start container: " + err.Error())
+	} else {
+		session.AddFlash("[success] started container " + c.Name)
+	}
+	finishAction(w, r, session)
+}
+
+func handlerStopUnit(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, "sid")
+
+	unit := r.FormValue("unit")
+	err := stopUnit(r.Context(), unit)
+	auditRequest(r, "unit.stop", strconv.Quote(unit), err)
+	if err != nil {
+		session.AddFlash("[error] failed to stop " + unit + ": " + err.Error())
+	} else {
+		session.AddFlash("[success] stopped " + unit)
+	}
+	finishAction(w, r, session)
+}
+
+func handlerTerminateSession(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, "sid")
+
+	id := r.FormValue("session")
+	if err := verifyStepUp(r); err != nil {
+		session.AddFlash("[error] terminating the session not confirmed: " + err.Error())
+		auditRequest(r, "session.terminate", strconv.Quote(id), fmt.Errorf("not confirmed: %v", err))
+	} else {
+		err := terminateSession(r.Context(), id)
+		auditRequest(r, "session.terminate", strconv.Quote(id), err)
+		if err != nil {
+			session.AddFlash("[error] failed to terminate session " + id + ": " + err.Error())
+		} else {
+			session.AddFlash("[success] terminated session " + id)
+		}
+	}
+	finishAction(w, r, session)
+}
+
+func handlerListSchedules(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, "sid")
+
+	viewData := &SchedulesViewData{
+		ViewData: newViewData(r, session),
+		Jobs:     schedules.Jobs(),
+		Actions:  scheduleActions,
+	}
+	viewData.StepUpRequired = stepUpRequired(principalFrom(r))
+
+	session.Save(r, w)
+	err := mainTemplate.ExecuteTemplate(w, "schedules", viewData)
+	if err != nil {
+		logger.Error(err)
+	}
+}
+
+func handlerAPISchedules(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, schedules.Jobs())
+}
+
+func handlerRunSchedule(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, "sid")
+
+	name := r.FormValue("name")
+	p := principalFrom(r)
+	job, ok := schedules.Job(name)
+	switch {
+	case !ok:
+		session.AddFlash("[error] no scheduled job " + strconv.Quote(name))
+	case !p.Can(job.Scope()):
+		session.AddFlash("[error] running " + name + " needs the scope " + job.Scope())
+		audit.Record(auditEntry{User: p.Name, Token: p.TokenID, Source: clientIP(r), Action: job.Action, Target: job.Target() + " (schedule " + name + ")", Outcome: auditDenied, Error: "missing scope " + job.Scope()})
+	default:
+		if job.Unmounts() {
+			if err := verifyStepUp(r); err != nil {
+				session.AddFlash("[error] " + name + " not confirmed: " + err.Error())
+				audit.Record(auditEntry{User: p.Name, Token: p.TokenID, Source: clientIP(r), Action: job.Action, Target: job.Target() + " (schedule " + name + ")", Outcome: auditFailure, Error: "not confirmed: " + err.Error()})
+				break
+			}
+		}
+		err := schedules.Execute(r.Context(), job.ScheduleJob, auditEntry{User: p.Name, Token: p.TokenID, Source: clientIP(r)})
+		if err != nil {
+			session.AddFlash("[error] " + name + " failed: " + err.Error())
+		} else {
+			session.AddFlash("[success] ran " + name + ": " + job.Action + " " + job.Target())
+		}
+	}
+	finishActionAt(w, r, session, "/schedules")
+}
+
+func handlerAddSchedule(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, "sid")
+
+	job := ScheduleJob{
+		Name:   strings.TrimSpace(r.FormValue("name")),
+		Cron:   strings.TrimSpace(r.FormValue("cron")),
+		Action: r.FormValue("action"),
+		Drive:  strings.TrimSpace(r.FormValue("drive")),
+		Unit:   strings.TrimSpace(r.FormValue("unit")),
+	}
+	err := schedules.Add(job)
+	auditRequest(r, "schedule.add", job.Name+" ("+job.Cron+" "+job.Action+" "+job.Target()+")", err)
+	if err != nil {
+		session.AddFlash("[error] failed to add job: " + err.Error())
+	} else {
+		session.AddFlash("[success] added job " + job.Name)
+	}
+	finishActionAt(w, r, session, "/schedules")
+}
+
+func handlerDeleteSchedule(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, "sid")
+
+	name := r.FormValue("name")
+	err := schedules.Remove(name)
+	auditRequest(r, "schedule.delete", name, err)
+	if err != nil {
+		session.AddFlash("[error] failed to delete job: " + err.Error())
+	} else {
+		session.AddFlash("[success] deleted job " + name)
+	}
+	finishActionAt(w, r, session, "/schedules")
+}
+
+func handlerListTokens(w http.ResponseWriter, r *http.Request) {
+	renderTokens(w, r, "")
+}
+
+func renderTokens(w http.ResponseWriter, r *http.Request, newToken string) {
+	session, _ := store.Get(r, "sid")
+
+	list, err := tokens.List()
+	if err != nil {
+		session.AddFlash("[error] failed to load tokens: " + err.Error())
+	}
+	viewData := &TokensViewData{
+		ViewData: newViewData(r, session),
+		Tokens:   list,
+		Scopes:   allScopes,
+		NewToken: newToken,
+	}
+
+	session.Save(r, w)
+	err = mainTemplate.ExecuteTemplate(w, "tokens", viewData)
+	if err != nil {
+		logger.Error(err)
+	}
+}
+
+func handlerCreateToken(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, "sid")
+
+	var ttl time.Duration
+	var err error
+	if ttlStr := strings.TrimSpace(r.FormValue("ttl")); ttlStr != "" {
+		ttl, err = time.ParseDuration(ttlStr)
+	}
+	if err != nil {
+		session.AddFlash("[error] invalid expiry: " + err.Error())
+	} else {
+		name := strings.TrimSpace(r.FormValue("name"))
+		plain, token, err := tokens.Create(name, r.PostForm["scope"], ttl)
+		if err != nil {
+			session.AddFlash("[error] failed to create token: " + err.Error())
+			auditRequest(r, "token.create", name, err)
+		} else {
+			session.Save(r, w)
+			auditRequest(r, "token.create", token.ID+" ("+token.Name+": "+token.ScopeList()+")", nil)
+			// The plain token is rendered once instead of being stored in a flash cookie.
+			renderTokens(w, r, plain)
+			return
 		}
 	}
 
+	session.Save(r, w)
+	http.Redirect(w, r, "/admin/tokens", http.StatusSeeOther)
+}
+
+func handlerRevokeToken(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, "sid")
+
+	id := r.FormValue("id")
+	err := tokens.Revoke(id)
+	auditRequest(r, "token.revoke", id, err)
+	if err != nil {
+		session.AddFlash("[error] failed to revoke token: " + err.Error())
+	} else {
+		session.AddFlash("[success] revoked token " + id)
+	}
+
+	session.Save(r, w)
+	http.Redirect(w, r, "/admin/tokens", http.StatusSeeOther)
+}
+
+func handlerListLocks(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, "sid")
+
+	viewData := &LocksViewData{
+		ViewData: newViewData(r, session),
+		Entries:  loginAttempts.Entries(),
+	}
+
+	session.Save(r, w)
+	err := mainTemplate.ExecuteTemplate(w, "locks", viewData)
+	if err != nil {
+		logger.Error(err)
+	}
+}
+
+func handlerClearLocks(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, "sid")
+
+	key := r.FormValue("key")
+	if key == "" {
+		loginAttempts.ClearAll()
+		session.AddFlash("[success] cleared all login locks")
+		auditRequest(r, "locks.clear", "all", nil)
+	} else if loginAttempts.Clear(key) {
+		session.AddFlash("[success] cleared lock " + key)
+		auditRequest(r, "locks.clear", key, nil)
+	} else {
+		session.AddFlash("[error] no lock for " + key)
+	}
+
+	session.Save(r, w)
+	http.Redirect(w, r, "/admin/locks", http.StatusSeeOther)
+}
+
+func handlerListAudit(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, "sid")
+
+	filter, err := auditFilterFrom(r)
+	var entries []auditEntry
+	if err == nil {
+		entries, err = audit.Query(filter)
+	}
+	if err != nil {
+		session.AddFlash("[error] " + err.Error())
+	}
+	viewData := &AuditViewData{
+		ViewData: newViewData(r, session),
+		Entries:  entries,
+		Filter:   filter,
+		Since:    r.URL.Query().Get("since"),
+		Outcomes: []string{auditSuccess, auditFailure, auditDenied},
+	}
+
+	session.Save(r, w)
+	err = mainTemplate.ExecuteTemplate(w, "audit", viewData)
+	if err != nil {
+		logger.Error(err)
+	}
+}
+
+func handlerAPIAudit(w http.ResponseWriter, r *http.Request) {
+	filter, err := auditFilterFrom(r)
+	if err != nil {
+		http.Error(w, "Bad Request - "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	entries, err := audit.Query(filter)
+	if err != nil {
+		logger.Error(err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+func handlerDoctor(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, "sid")
+
+	checks := runDoctor(true)
+	viewData := &DoctorViewData{
+		ViewData: newViewData(r, session),
+		Checks:   checks,
+		Failed:   failedChecks(checks),
+	}
+
+	session.Save(r, w)
+	err := mainTemplate.ExecuteTemplate(w, "doctor", viewData)
+	if err != nil {
+		logger.Error(err)
+	}
+}
+
+func handlerShowConfig(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, "sid")
+
+	data, err := yaml.Marshal(config().Redacted())
+	if err != nil {
+		logger.Error(err)
+	}
+	reloadMu.Lock()
+	last := lastReload
+	reloadMu.Unlock()
+
+	viewData := &ConfigViewData{
+		ViewData:   newViewData(r, session),
+		File:       configFile,
+		YAML:       string(data),
+		LastReload: last,
+	}
+
+	session.Save(r, w)
+	err = mainTemplate.ExecuteTemplate(w, "config", viewData)
+	if err != nil {
+		logger.Error(err)
+	}
+}
+
+func handlerReloadConfig(w http.ResponseWriter, r *http.Request) {
+	result := reloadConfig(principalFrom(r).Name)
+	var reloadErr error
+	if !result.Success() {
+		reloadErr = errors.New(result.Error)
+	}
+	auditRequest(r, "config.reload", configFile, reloadErr)
+
+	if principalFrom(r).IsToken() {
+		status := http.StatusOK
+		if !result.Success() {
+			status = http.StatusBadRequest
+		}
+		writeJSON(w, status, result)
+		return
+	}
+
+	session, _ := store.Get(r, "sid")
+	if !result.Success() {
+		session.AddFlash("[error] config not reloaded: " + result.Error)
+	} else {
+		message := fmt.Sprintf("[success] config reloaded, %d changes", len(result.Changes))
+		if len(result.Restart) > 0 {
+			message += "; restart required to apply " + strings.Join(result.Restart, ", ")
+		}
+		session.AddFlash(message)
+	}
+	session.Save(r, w)
+	http.Redirect(w, r, "/admin/config", http.StatusSeeOther)
+}
+
+func renderTwoFactor(w http.ResponseWriter, r *http.Request, name string, recoveryCodes []string) {
+	session, _ := store.Get(r, "sid")
+	user := principalFrom(r).Name
+
+	viewData := &TwoFactorViewData{
+		ViewData:          newViewData(r, session),
+		User:              user,
+		Enabled:           totps.Enabled(user),
+		RecoveryCodes:     recoveryCodes,
+		RecoveryCodesLeft: totps.RecoveryCodesLeft(user),
+		Mode:              config().Auth.TOTPMode,
+	}
+	if secret, ok := totps.Pending(user); ok {
+		qrCode, err := totpQRCode(user, secret)
+		if err != nil {
+			logger.Error(err)
+		}
+		viewData.Pending = true
+		viewData.Secret = secret
+		viewData.QRCode = qrCode
+	}
+
+	session.Save(r, w)
+	err := mainTemplate.ExecuteTemplate(w, name, viewData)
+	if err != nil {
+		logger.Error(err)
+	}
+}
+
+func handlerTwoFactorLogin(w http.ResponseWriter, r *http.Request) {
+	renderTwoFactor(w, r, "twofactor_login", nil)
+}
+
+func handlerTwoFactorLoginVerify(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, "sid")
+	user := principalFrom(r).Name
+
+	err := totps.Verify(user, r.FormValue("otp"))
+	if err != nil {
+		recordLoginFailure(r, user)
+		session.AddFlash("[error] " + err.Error())
+		session.Save(r, w)
+		http.Redirect(w, r, "/login/2fa", http.StatusSeeOther)
+		return
+	}
+
+	session.Values[sessionKeyTOTPUser] = user
 	session.Save(r, w)
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
+
+func handlerTwoFactor(w http.ResponseWriter, r *http.Request) {
+	renderTwoFactor(w, r, "twofactor", nil)
+}
+
+func handlerTwoFactorEnroll(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, "sid")
+
+	_, err := totps.Begin(principalFrom(r).Name)
+	if err != nil {
+		session.AddFlash("[error] " + err.Error())
+	}
+
+	session.Save(r, w)
+	http.Redirect(w, r, "/account/2fa", http.StatusSeeOther)
+}
+
+func handlerTwoFactorConfirm(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, "sid")
+	user := principalFrom(r).Name
+
+	recoveryCodes, err := totps.Confirm(user, r.FormValue("otp"))
+	if err != nil {
+		session.AddFlash("[error] " + err.Error())
+		session.Save(r, w)
+		http.Redirect(w, r, "/account/2fa", http.StatusSeeOther)
+		return
+	}
+
+	session.Values[sessionKeyTOTPUser] = user
+	session.AddFlash("[success] two-factor authentication enabled")
+	auditRequest(r, "2fa.enable", user, nil)
+	session.Save(r, w)
+	// The recovery codes are rendered once instead of being stored in a flash cookie.
+	renderTwoFactor(w, r, "twofactor", recoveryCodes)
+}
+
+func handlerTwoFactorDisable(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, "sid")
+	user := principalFrom(r).Name
+
+	err := totps.Verify(user, r.FormValue("otp"))
+	if err == nil {
+		err = totps.Disable(user)
+	} else {
+		recordLoginFailure(r, user)
+	}
+	auditRequest(r, "2fa.disable", user, err)
+	if err != nil {
+		session.AddFlash("[error] " + err.Error())
+	} else {
+		delete(session.Values, sessionKeyTOTPUser)
+		session.AddFlash("[success] two-factor authentication disabled")
+	}
+
+	session.Save(r, w)
+	http.Redirect(w, r, "/account/2fa", http.StatusSeeOther)
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of drive events.
+const (
+	eventMounted       = "mounted"
+	eventUnmounted     = "unmounted"
+	eventUnmountFailed = "unmount-failed"
+	eventInUse         = "in-use"
+	eventIdle          = "idle"
+	eventStandby       = "standby"
+	eventKill          = "kill"
+	eventRestart       = "restart"
+	eventUsage         = "usage"
+)
+
+// driveEvent is one entry of a drive's timeline.
+type driveEvent struct {
+	Time   time.Time `json:"time"`
+	Kind   string    `json:"kind"`
+	User   string    `json:"user,omitempty"` // empty if observed by a status collection
+	Path   string    `json:"path,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// driveHistory is the timeline of one drive, keyed by its filesystem UUID so
+// it follows the drive across device names and mount points.
+type driveHistory struct {
+	UUID         string       `json:"uuid"`
+	Device       string       `json:"device"`
+	Path         string       `json:"path"`
+	Mounted      bool         `json:"mounted"`
+	LastSeen     time.Time    `json:"lastSeen"`
+	Blockers     []Usage      `json:"blockers,omitempty"` // processes seen using it, one per pid
+	LastSnapshot time.Time    `json:"lastSnapshot"`
+	Events       []driveEvent `json:"events,omitempty"`
+}
+
+// LastEvent returns the newest event of the given kind, if any.
+func (d *driveHistory) LastEvent(kind string) *driveEvent {
+	for i := len(d.Events) - 1; i >= 0; i-- {
+		if d.Events[i].Kind == kind {
+			return &d.Events[i]
+		}
+	}
+	return nil
+}
+
+// historyStore keeps the drive timelines in a JSON file. It is only written
+// when something changed and old events are pruned, to spare the SD card.
+type historyStore struct {
+	path string // empty keeps the history in memory
+
+	mu     sync.Mutex
+	drives map[string]*driveHistory
+}
+
+var history = &historyStore{drives: map[string]*driveHistory{}}
+
+func loadHistoryStore(path string) (*historyStore, error) {
+	s := &historyStore{path: path, drives: map[string]*driveHistory{}}
+	if path == "" {
+		return s, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read history file %s: %v", path, err)
+	}
+	drives := []*driveHistory{}
+	if err := json.Unmarshal(data, &drives); err != nil {
+		return nil, fmt.Errorf("failed to parse history file %s: %v", path, err)
+	}
+	for _, d := range drives {
+		s.drives[d.UUID] = d
+	}
+	return s, nil
+}
+
+// save prunes and writes the history file. Callers hold s.mu.
+func (s *historyStore) save() {
+	s.prune()
+	if s.path == "" {
+		return
+	}
+	drives := make([]*driveHistory, 0, len(s.drives))
+	for _, d := range s.drives {
+		drives = append(drives, d)
+	}
+	slices.SortFunc(drives, func(a, b *driveHistory) int { return strings.Compare(a.UUID, b.UUID) })
+
+	data, err := json.Marshal(drives)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(s.path), 0o700)
+	}
+	if err == nil {
+		tmp := s.path + ".tmp"
+		if err = os.WriteFile(tmp, data, 0o600); err == nil {
+			err = os.Rename(tmp, s.path)
+		}
+	}
+	if err != nil {
+		logger.Errorf("[history] failed to write %s: %v", s.path, err)
+	}
+}
+
+// prune drops events beyond the configured age and count, and drives that
+// were not seen within the age and have no events left. Callers hold s.mu.
+func (s *historyStore) prune() {
+	cfg := config().History
+	cutoff := time.Now().Add(-cfg.MaxAge)
+	for key, d := range s.drives {
+		d.Events = slices.DeleteFunc(d.Events, func(e driveEvent) bool { return e.Time.Before(cutoff) })
+		if len(d.Events) > cfg.MaxEvents {
+			d.Events = slices.Delete(d.Events, 0, len(d.Events)-cfg.MaxEvents)
+		}
+		if !d.Mounted && len(d.Events) == 0 && d.LastSeen.Before(cutoff) {
+			delete(s.drives, key)
+		}
+	}
+}
+
+// Observe compares a status collection with the known state of the drives
+// and records mounts, unmounts, changed blockers and usage snapshots.
+func (s *historyStore) Observe(status *SystemStatus) {
+	if status.ErrorMounts != nil {
+		return // an unknown mount list must not look like unmounts
+	}
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	changed := false
+	seen := map[string]bool{}
+	for _, m := range status.Mounts {
+		if m.UUID == "" {
+			continue
+		}
+		seen[m.UUID] = true
+		d, ok := s.drives[m.UUID]
+		if !ok {
+			d = &driveHistory{UUID: m.UUID}
+			s.drives[m.UUID] = d
+		}
+		d.Device, d.LastSeen = m.Device, now
+
+		if !d.Mounted || d.Path != m.Path {
+			d.Mounted, d.Path = true, m.Path
+			d.Events = append(d.Events, driveEvent{Time: now, Kind: eventMounted, Path: m.Path, Detail: m.Device})
+			webhooks.Emit(webhookDriveMounted, webhookDriveData{UUID: d.UUID, Device: d.Device, Path: d.Path})
+			changed = true
+		}
+		if m.UsageError == "" {
+			blockers := uniqueBlockers(m.Usages)
+			if !slices.Equal(blockers, d.Blockers) {
+				if len(blockers) > 0 {
+					d.Events = append(d.Events, driveEvent{Time: now, Kind: eventInUse, Path: m.Path, Detail: describeBlockers(blockers)})
+				} else {
+					d.Events = append(d.Events, driveEvent{Time: now, Kind: eventIdle, Path: m.Path})
+				}
+				d.Blockers = blockers
+				changed = true
+			}
+		}
+		if m.TotalSpace != "" && now.Sub(d.LastSnapshot) >= config().History.SnapshotInterval {
+			detail := fmt.Sprintf("%s free of %s (%d%% used)", m.FreeSpace, m.TotalSpace, m.UsedSpacePercentage)
+			d.Events = append(d.Events, driveEvent{Time: now, Kind: eventUsage, Path: m.Path, Detail: detail})
+			d.LastSnapshot = now
+			changed = true
+		}
+	}
+
+	for key, d := range s.drives {
+		if d.Mounted && !seen[key] {
+			d.Mounted, d.Blockers = false, nil
+			d.Events = append(d.Events, driveEvent{Time: now, Kind: eventUnmounted, Path: d.Path, Detail: "no longer mounted"})
+			webhooks.Emit(webhookDriveUnmounted, webhookDriveData{UUID: d.UUID, Device: d.Device, Path: d.Path})
+			changed = true
+		}
+	}
+	if changed {
+		s.save()
+	}
+}
+
+// RecordUnmount records an unmount of the drive mounted at path by user.
+func (s *historyStore) RecordUnmount(path, user string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, d := range s.drives {
+		if !d.Mounted || d.Path != path {
+			continue
+		}
+		if err != nil {
+			detail := err.Error()
+			if len(d.Blockers) > 0 {
+				detail += "; in use by " + describeBlockers(d.Blockers)
+			}
+			d.Events = append(d.Events, driveEvent{Time: time.Now(), Kind: eventUnmountFailed, User: user, Path: path, Detail: detail})
+			webhooks.Emit(webhookUnmountFailed, webhookDriveData{UUID: d.UUID, Device: d.Device, Path: path, User: user, Error: err.Error(), Blockers: d.Blockers})
+		} else {
+			d.Mounted, d.Blockers = false, nil
+			d.Events = append(d.Events, driveEvent{Time: time.Now(), Kind: eventUnmounted, User: user, Path: path})
+			webhooks.Emit(webhookDriveUnmounted, webhookDriveData{UUID: d.UUID, Device: d.Device, Path: path, User: user})
+		}
+		s.save()
+		return
+	}
+}
+
+// RecordStandby records a spin-down of the disk of the drive mounted at path
+// by the idle policy.
+func (s *historyStore) RecordStandby(path string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, d := range s.drives {
+		if !d.Mounted || d.Path != path {
+			continue
+		}
+		event := driveEvent{Time: time.Now(), Kind: eventStandby, User: "idle", Path: path}
+		if err != nil {
+			event.Detail = "failed: " + err.Error()
+		}
+		d.Events = append(d.Events, event)
+		s.save()
+		return
+	}
+}
+
+// RecordKill records a killed process on the drives it was seen using.
+func (s *historyStore) RecordKill(pid int, command, user string, err error) {
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	paths := []string{}
+	for _, d := range s.drives {
+		if !slices.ContainsFunc(d.Blockers, func(u Usage) bool { return u.PID == pid }) {
+			continue
+		}
+		d.Events = append(d.Events, driveEvent{Time: time.Now(), Kind: eventKill, User: user, Path: d.Path, Detail: processTarget(pid, command)})
+		paths = append(paths, d.Path)
+	}
+	webhooks.Emit(webhookProcessKilled, webhookProcessData{PID: pid, Command: command, User: user, Paths: paths})
+	if len(paths) > 0 {
+		s.save()
+	}
+}
+
+// RecordRestart records a service restart on all mounted drives.
+func (s *historyStore) RecordRestart(unit, user string, err error) {
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changed := false
+	for _, d := range s.drives {
+		if d.Mounted {
+			d.Events = append(d.Events, driveEvent{Time: time.Now(), Kind: eventRestart, User: user, Path: d.Path, Detail: unit})
+			changed = true
+		}
+	}
+	if changed {
+		s.save()
+	}
+}
+
+// Drives returns copies of the known drives, mounted ones first, then by the
+// time they were last seen.
+func (s *historyStore) Drives() []*driveHistory {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	drives := []*driveHistory{}
+	for _, d := range s.drives {
+		drive := *d
+		drive.Events = slices.Clone(d.Events)
+		drives = append(drives, &drive)
+	}
+	slices.SortFunc(drives, func(a, b *driveHistory) int {
+		if a.Mounted != b.Mounted {
+			if a.Mounted {
+				return -1
+			}
+			return 1
+		}
+		return b.LastSeen.Compare(a.LastSeen)
+	})
+	return drives
+}
+
+// Drive returns a copy of one drive with its events newest first.
+func (s *historyStore) Drive(uuid string) (*driveHistory, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.drives[uuid]
+	if !ok {
+		return nil, false
+	}
+	drive := *d
+	drive.Events = slices.Clone(d.Events)
+	slices.Reverse(drive.Events)
+	return &drive, true
+}
+
+// uniqueBlockers reduces the open files to one entry per process, sorted by pid.
+func uniqueBlockers(usages []Usage) []Usage {
+	blockers := []Usage{}
+	for _, u := range usages {
+		if !slices.ContainsFunc(blockers, func(b Usage) bool { return b.PID == u.PID }) {
+			blockers = append(blockers, Usage{Command: u.Command, PID: u.PID, User: u.User})
+		}
+	}
+	slices.SortFunc(blockers, func(a, b Usage) int { return a.PID - b.PID })
+	return blockers
+}
+
+func describeBlockers(blockers []Usage) string {
+	parts := make([]string, len(blockers))
+	for i, b := range blockers {
+		parts[i] = processTarget(b.PID, b.Command) + " by " + b.User
+	}
+	return strings.Join(parts, ", ")
+}
+
+// filesystemUUID looks up the UUID of a device in /dev/disk/by-uuid. Devices
+// without one are keyed by their name, see deviceKey.
+func filesystemUUID(device string) string {
+	const dir = "/dev/disk/by-uuid"
+	entries, err := os.ReadDir(dir)
+	if err == nil {
+		for _, entry := range entries {
+			target, err := filepath.EvalSymlinks(filepath.Join(dir, entry.Name()))
+			if err == nil && target == device {
+				return entry.Name()
+			}
+		}
+	}
+	return deviceKey(device)
+}
+
+// deviceKey keys a device without a UUID by its name, e.g. "dev-sda1". The
+// name is given to whatever drive is attached next, so it doesn't identify one.
+func deviceKey(device string) string {
+	return strings.ReplaceAll(strings.TrimPrefix(device, "/"), "/", "-")
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Events hooks run for.
+const (
+	hookPreUnmount  = "pre-unmount"
+	hookPostUnmount = "post-unmount"
+	hookPostMount   = "post-mount"
+	hookOnAttach    = "on-attach"
+)
+
+var hookEvents = []string{hookPreUnmount, hookPostUnmount, hookPostMount, hookOnAttach}
+
+const (
+	defaultHookTimeout = time.Minute
+	hookOutputLimit    = 4096 // bytes of output kept, the end of it
+)
+
+// hookDrive is the drive a hook runs for, passed in UNMOUNTER_* variables.
+type hookDrive struct {
+	Device string
+	UUID   string
+	Path   string // empty for on-attach if the drive was never mounted
+}
+
+// hookResult is a finished hook, shown as a flash message after an unmount.
+type hookResult struct {
+	Event  string
+	Hook   string
+	Output string
+	Err    error
+}
+
+func (r hookResult) String() string {
+	s := fmt.Sprintf("%s hook %s", r.Event, r.Hook)
+	if r.Err != nil {
+		s += " failed: " + r.Err.Error()
+	}
+	if line := lastLine(r.Output); line != "" {
+		s += ": " + line
+	}
+	return s
+}
+
+// hookRunner runs the post-mount and on-attach hooks for drives that show up
+// while the service runs, and starts the containers waiting for a remount.
+// Mounts and attached drives are listed every hooks.interval, what is there
+// on the first listing doesn't count.
+type hookRunner struct {
+	mounted  map[string]Mount  // by path
+	attached map[string]string // device by UUID
+}
+
+var hooks = &hookRunner{}
+
+// Run watches for new mounts and drives until ctx is done.
+func (h *hookRunner) Run(ctx context.Context) {
+	for {
+		h.poll(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(config().Hooks.Interval):
+		}
+	}
+}
+
+func (h *hookRunner) poll(ctx context.Context) {
+	cfg := config().Hooks
+	actor := auditEntry{User: "hooks", Source: "hooks"}
+
+	if len(cfg.PostMount) == 0 && containerRestarts.Len() == 0 {
+		h.mounted = nil
+	} else if mounts, err := currentMounts(ctx); err != nil {
+		logger.Warningf("[hooks] failed to list mounts: %v", err)
+	} else {
+		current := map[string]Mount{}
+		for _, m := range mounts {
+			current[m.Path] = m
+			if previous, ok := h.mounted[m.Path]; h.mounted != nil && (!ok || previous.Device != m.Device) {
+				h.track(hookPostMount, m.Path, func() {
+					containerRestarts.Mounted(ctx, m) // before the hooks, e.g. a rescan may need the container
+					h.Fire(ctx, hookPostMount, hookDrive{Device: m.Device, UUID: m.UUID, Path: m.Path}, actor)
+				})
+			}
+		}
+		h.mounted = current
+	}
+
+	if len(cfg.OnAttach) == 0 {
+		h.attached = nil
+	} else if attached, err := attachedDrives(); err != nil {
+		logger.Warningf("[hooks] failed to list attached drives: %v", err)
+	} else {
+		for _, uuid := range sortedKeys(attached) {
+			if _, ok := h.attached[uuid]; h.attached != nil && !ok {
+				drive := hookDrive{Device: attached[uuid], UUID: uuid}
+				if known, ok := history.Drive(uuid); ok {
+					drive.Path = known.Path
+				}
+				h.track(hookOnAttach, drive.Device, func() { h.Fire(ctx, hookOnAttach, drive, actor) })
+			}
+		}
+		h.attached = attached
+	}
+}
+
+// track runs what the poller does for a new mount or drive as an operation,
+// so a shutdown waits for it. Nothing is started once draining began.
+func (h *hookRunner) track(event, target string, run func()) {
+	done, ok := operations.Begin(event + " " + target)
+	if !ok {
+		logger.Warningf("[hooks] %s hooks for %s skipped, shutting down", event, target)
+		return
+	}
+	defer done()
+	run()
+}
+
+// Fire runs the hooks of an event that apply to a drive one after another
+// and audits each of them as run by actor. A failing pre-unmount hook with
+// abort_on_failure stops the remaining hooks and its error is returned. The
+// caller tracks the hooks as part of its operation.
+func (h *hookRunner) Fire(ctx context.Context, event string, drive hookDrive, actor auditEntry) ([]hookResult, error) {
+	results := []hookResult{}
+	for _, hook := range config().Hooks.For(event) {
+		if !hook.AppliesTo(drive) {
+			continue
+		}
+		output, err := runHook(ctx, hook, event, drive, actor.User)
+
+		entry := actor
+		entry.Action, entry.Target, entry.Outcome, entry.Output = "hook."+event, fmt.Sprintf("%s (%s)", hookTarget(drive), hook.Name), auditSuccess, output
+		if err != nil {
+			entry.Outcome, entry.Error = auditFailure, err.Error()
+		}
+		audit.Record(entry)
+		results = append(results, hookResult{Event: event, Hook: hook.Name, Output: output, Err: err})
+		if err != nil && hook.AbortOnFailure {
+			return results, fmt.Errorf("%s hook %s failed: %v", event, hook.Name, err)
+		}
+	}
+	return results, nil
+}
+
+// AppliesTo reports whether a hook runs for a drive.
+func (hook Hook) AppliesTo(drive hookDrive) bool {
+	return len(hook.Drives) == 0 || slices.Contains(hook.Drives, drive.UUID) || (drive.Path != "" && slices.Contains(hook.Drives, drive.Path))
+}
+
+// hooksApply reports whether any hook of an event runs for a drive.
+func hooksApply(event string, drive hookDrive) bool {
+	return slices.ContainsFunc(config().Hooks.For(event), func(hook Hook) bool { return hook.AppliesTo(drive) })
+}
+
+func hookTarget(drive hookDrive) string {
+	if drive.Path != "" {
+		return drive.Path
+	}
+	return drive.Device
+}
+
+// runHook runs the command of a hook and returns the end of its combined
+// output. A browser that disconnects doesn't cancel it, only its timeout.
+func runHook(ctx context.Context, hook Hook, event string, drive hookDrive, by string) (string, error) {
+	timeout := hook.Timeout
+	if timeout == 0 {
+		timeout = defaultHookTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), timeout)
+	defer cancel()
+
+	env := map[string]string{
+		"UNMOUNTER_EVENT":  event,
+		"UNMOUNTER_HOOK":   hook.Name,
+		"UNMOUNTER_DEVICE": drive.Device,
+		"UNMOUNTER_DISK":   "",
+		"UNMOUNTER_UUID":   drive.UUID,
+		"UNMOUNTER_PATH":   drive.Path,
+		"UNMOUNTER_USER":   by,
+	}
+	if drive.Device != "" {
+		env["UNMOUNTER_DISK"] = wholeDisk(drive.Device)
+	}
+	for name, value := range hook.Env {
+		env[name] = value
+	}
+	names := sortedKeys(env)
+
+	name, args := hook.Command[0], hook.Command[1:]
+	if hook.User != "" && hook.User != currentUserName() {
+		// sudo drops the environment, the variables have to be allowed with SETENV.
+		args = append([]string{"-n", "-u", hook.User, "--preserve-env=" + strings.Join(names, ","), "--", name}, args...)
+		name = config().Commands.Sudo
+	}
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Dir = "/"
+	cmd.Env = os.Environ()
+	for _, name := range names {
+		cmd.Env = append(cmd.Env, name+"="+env[name])
+	}
+	cmd.WaitDelay = time.Second // don't wait for children that keep the output open
+	output := &tailBuffer{limit: hookOutputLimit}
+	cmd.Stdout, cmd.Stderr = output, output
+
+	err := cmd.Run()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("timed out after %s", timeout)
+	}
+	return output.String(), err
+}
+
+// unmountWithHooks unmounts a managed path like unmountDevice, running the
+// pre-unmount hooks before and the post-unmount hooks after it.
+func unmountWithHooks(ctx context.Context, path string, actor auditEntry) ([]hookResult, error) {
+	cfg := config().Hooks
+	if len(cfg.PreUnmount) == 0 && len(cfg.PostUnmount) == 0 {
+		return nil, unmountDevice(path)
+	}
+	drive := hookDrive{Path: path}
+	if mounts, err := currentMounts(ctx); err == nil {
+		i := slices.IndexFunc(mounts, func(m Mount) bool { return m.Path == path })
+		if i < 0 {
+			return nil, fmt.Errorf("%w: %s", errNotMounted, path)
+		}
+		drive.Device, drive.UUID = mounts[i].Device, mounts[i].UUID
+	}
+
+	results, err := hooks.Fire(ctx, hookPreUnmount, drive, actor)
+	if err != nil {
+		return results, err
+	}
+	if err := unmountDevice(path); err != nil {
+		return results, err
+	}
+	post, err := hooks.Fire(ctx, hookPostUnmount, drive, actor)
+	if err != nil {
+		// The drive is unmounted, the failed hook is reported with the results.
+		logger.Warningf("[hooks] %s: %v", path, err)
+	}
+	return append(results, post...), nil
+}
+
+// currentMounts lists the managed mounts without probing usages and free
+// space.
+func currentMounts(ctx context.Context) ([]Mount, error) {
+	if config().DevMode {
+		mounts := getMountsDevMode()
+		for i := range mounts {
+			mounts[i].UUID = filesystemUUID(mounts[i].Device)
+		}
+		return mounts, nil
+	}
+	return listMounts(ctx)
+}
+
+func currentUserName() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return ""
+}
+
+// tailBuffer keeps the last limit bytes written to it.
+type tailBuffer struct {
+	mu        sync.Mutex
+	limit     int
+	data      []byte
+	truncated bool
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.data = append(b.data, p...)
+	if len(b.data) > b.limit {
+		b.data = slices.Clone(b.data[len(b.data)-b.limit:])
+		b.truncated = true
+	}
+	return len(p), nil
+}
+
+func (b *tailBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := strings.TrimSpace(strings.ToValidUTF8(string(b.data), "?"))
+	if b.truncated && s != "" {
+		s = "…" + s
+	}
+	return s
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/safehtml"
+	"github.com/google/safehtml/uncheckedconversions"
+)
+
+// Actions of idle policies.
+const (
+	idleStandby = "standby"
+	idleUnmount = "unmount"
+)
+
+const (
+	activitySlot   = 15 * time.Minute
+	activitySlots  = int(24 * time.Hour / activitySlot)
+	idleRetryAfter = 30 * time.Minute // after a failed unmount or spin-down
+)
+
+// diskActivity is the I/O seen on one disk. A disk is idle while its I/O
+// counters don't move and no file is open on its mounts.
+type diskActivity struct {
+	sectors    uint64 // read and written, from /sys/block/<disk>/stat
+	lastActive time.Time
+	standby    bool      // spun down by a policy and no I/O since
+	retryAt    time.Time // no action before, after one was taken
+	slots      [activitySlots]activitySample
+}
+
+type activitySample struct {
+	slot    int64 // start of the slot in units of activitySlot since the epoch
+	sectors uint64
+}
+
+// idleStatus is the activity of a disk as shown on a drive card.
+type idleStatus struct {
+	Disk        string        `json:"disk"`
+	IdleMinutes int           `json:"idleMinutes"`
+	InUse       bool          `json:"inUse"`   // files are open on a mount of the disk
+	Standby     bool          `json:"standby"` // spun down by the idle policy
+	Policy      string        `json:"policy,omitempty"`
+	Graph       []activityBar `json:"graph"` // the last 24h, oldest first
+}
+
+type activityBar struct {
+	Start   time.Time      `json:"start"`
+	Sectors uint64         `json:"sectors"`
+	Style   safehtml.Style `json:"-"`
+}
+
+// Label describes a bar of the activity graph.
+func (b activityBar) Label() string {
+	return fmt.Sprintf("%s: %s", b.Start.Format("15:04"), formatBytes(b.Sectors*512))
+}
+
+// idleMonitor reads the I/O counters every idle.interval and applies the idle
+// policies. The counters are read from sysfs, which doesn't wake a disk.
+type idleMonitor struct {
+	mu    sync.Mutex
+	disks map[string]*diskActivity
+}
+
+var idle = &idleMonitor{disks: map[string]*diskActivity{}}
+
+// Run samples until ctx is done.
+func (m *idleMonitor) Run(ctx context.Context) {
+	for {
+		m.sample(ctx, systemStatusCache.Get(ctx, false))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(config().Idle.Interval):
+		}
+	}
+}
+
+func (m *idleMonitor) sample(ctx context.Context, status *SystemStatus) {
+	if status.ErrorMounts != nil {
+		return
+	}
+	now := time.Now()
+	mountsByDisk := map[string][]Mount{}
+	for _, mount := range status.Mounts {
+		disk := wholeDisk(mount.Device)
+		mountsByDisk[disk] = append(mountsByDisk[disk], mount)
+	}
+
+	due := map[string][]Mount{} // disks whose policy is due, with the mounts it applies to
+	m.mu.Lock()
+	for disk, mounts := range mountsByDisk {
+		sectors, err := readDiskSectors(disk)
+		if err != nil {
+			logger.Warningf("[idle] %v", err)
+			continue
+		}
+		d, ok := m.disks[disk]
+		if !ok {
+			d = &diskActivity{sectors: sectors, lastActive: now}
+			m.disks[disk] = d
+		}
+		delta := sectors - d.sectors
+		if sectors < d.sectors {
+			delta = sectors // the counters restart when the disk is attached again
+		}
+		d.sectors = sectors
+		d.add(now, delta)
+		if delta > 0 || slices.ContainsFunc(mounts, func(m Mount) bool { return len(m.Usages) > 0 }) {
+			d.lastActive, d.standby = now, false
+		}
+
+		for _, mount := range mounts {
+			policy, ok := idlePolicy(mount)
+			if !ok || d.standby || now.Before(d.retryAt) {
+				continue
+			}
+			if after := policy.Timeout(now); after > 0 && now.Sub(d.lastActive) >= after {
+				due[disk] = append(due[disk], mount)
+			}
+		}
+	}
+	for disk := range m.disks {
+		if _, ok := mountsByDisk[disk]; !ok {
+			delete(m.disks, disk) // unmounted or detached, the graph starts over
+		}
+	}
+	m.mu.Unlock()
+
+	for _, disk := range sortedKeys(due) {
+		m.apply(ctx, disk, due[disk])
+	}
+}
+
+// apply runs the action of the policies that are due on a disk. Unmounting
+// comes first, a disk is only spun down with nothing left to unmount.
+func (m *idleMonitor) apply(ctx context.Context, disk string, mounts []Mount) {
+	var err error
+	standby := false
+	for _, mount := range mounts {
+		policy, _ := idlePolicy(mount)
+		if policy.Action == idleStandby {
+			standby = true
+			continue
+		}
+		e := m.run("unmount", mount.Path, func() error {
+			_, err := unmountWithHooks(ctx, mount.Path, auditEntry{User: "idle", Source: "idle"})
+			return err
+		})
+		history.RecordUnmount(mount.Path, "idle", e)
+		if e != nil {
+			err = e
+		}
+	}
+	if standby && err == nil {
+		if report := smartReports.Get(disk); report != nil && report.SelfTest.Running {
+			return // spinning down would abort the self-test
+		}
+		err = m.run("standby", disk, func() error { return spinDown(ctx, disk) })
+		for _, mount := range mounts {
+			history.RecordStandby(mount.Path, err)
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if d, ok := m.disks[disk]; ok {
+		// A failed action is retried later, a drive unmounted by autofs may be mounted again on access.
+		d.retryAt = time.Now().Add(idleRetryAfter)
+		d.standby = standby && err == nil
+	}
+}
+
+// run runs an action like one started by a user, audited as the user idle.
+func (m *idleMonitor) run(action, target string, fn func() error) error {
+	entry := auditEntry{User: "idle", Source: "idle", Action: action, Target: target, Outcome: auditSuccess}
+	done, ok := operations.Begin("idle " + action + " " + target)
+	if !ok {
+		return errors.New("shutting down")
+	}
+	err := fn()
+	done()
+	systemStatusCache.Invalidate()
+	if err != nil {
+		entry.Outcome, entry.Error = auditFailure, err.Error()
+	}
+	audit.Record(entry)
+	return err
+}
+
+func (d *diskActivity) add(now time.Time, sectors uint64) {
+	slot := now.Unix() / int64(activitySlot/time.Second)
+	sample := &d.slots[slot%int64(activitySlots)]
+	if sample.slot != slot {
+		*sample = activitySample{slot: slot}
+	}
+	sample.sectors += sectors
+}
+
+// Status returns the activity of the disk of a mount, nil if it was not
+// sampled yet.
+func (m *idleMonitor) Status(mount Mount) *idleStatus {
+	disk := wholeDisk(mount.Device)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d, ok := m.disks[disk]
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	status := &idleStatus{Disk: disk, InUse: len(mount.Usages) > 0, Standby: d.standby, IdleMinutes: int(now.Sub(d.lastActive).Minutes())}
+	if policy, ok := idlePolicy(mount); ok {
+		status.Policy = policy.String()
+	}
+
+	current := now.Unix() / int64(activitySlot/time.Second)
+	peak := uint64(1)
+	for slot := current - int64(activitySlots) + 1; slot <= current; slot++ {
+		bar := activityBar{Start: time.Unix(slot*int64(activitySlot/time.Second), 0)}
+		if sample := d.slots[slot%int64(activitySlots)]; sample.slot == slot {
+			bar.Sectors = sample.sectors
+		}
+		peak = max(peak, bar.Sectors)
+		status.Graph = append(status.Graph, bar)
+	}
+	for i := range status.Graph {
+		height := int(status.Graph[i].Sectors * 100 / peak)
+		status.Graph[i].Style = uncheckedconversions.StyleFromStringKnownToSatisfyTypeContract("height: " + strconv.Itoa(height) + "%")
+	}
+	return status
+}
+
+// idlePolicy returns the first policy that applies to a mount.
+func idlePolicy(mount Mount) (IdlePolicy, bool) {
+	for _, policy := range config().Idle.Policies {
+		if len(policy.Drives) == 0 || slices.Contains(policy.Drives, mount.UUID) || slices.Contains(policy.Drives, mount.Path) {
+			return policy, true
+		}
+	}
+	return IdlePolicy{}, false
+}
+
+// Timeout returns how long a disk has to be idle at t, 0 if the policy
+// doesn't act at t.
+func (p IdlePolicy) Timeout(t time.Time) time.Duration {
+	if p.QuietHours != "" {
+		if start, end, err := parseQuietHours(p.QuietHours); err == nil && inQuietHours(start, end, t) {
+			return p.QuietAfter
+		}
+	}
+	return p.After
+}
+
+func (p IdlePolicy) String() string {
+	s := ""
+	if p.After > 0 {
+		s = fmt.Sprintf("%s after %s idle", p.Action, p.After)
+	}
+	if p.QuietHours != "" {
+		if s != "" {
+			s += ", "
+		}
+		s += fmt.Sprintf("%s after %s in quiet hours %s", p.Action, p.QuietAfter, p.QuietHours)
+	}
+	return s
+}
+
+// parseQuietHours parses a local time range like 22:00-07:00, as minutes of
+// the day.
+func parseQuietHours(spec string) (start, end int, err error) {
+	from, to, ok := strings.Cut(spec, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("%q is not a range like 22:00-07:00", spec)
+	}
+	minutes := func(s string) (int, error) {
+		t, err := time.Parse("15:04", strings.TrimSpace(s))
+		if err != nil {
+			return 0, fmt.Errorf("%q is not a time like 22:00", s)
+		}
+		return t.Hour()*60 + t.Minute(), nil
+	}
+	if start, err = minutes(from); err != nil {
+		return 0, 0, err
+	}
+	if end, err = minutes(to); err != nil {
+		return 0, 0, err
+	}
+	return start, end, nil
+}
+
+func inQuietHours(start, end int, t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	if start <= end {
+		return minute >= start && minute < end
+	}
+	return minute >= start || minute < end // across midnight
+}
+
+// readDiskSectors returns the sectors read and written of a disk since it
+// was attached.
+func readDiskSectors(disk string) (uint64, error) {
+	if config().DevMode {
+		return readDiskSectorsDevMode(disk), nil
+	}
+	data, err := os.ReadFile(filepath.Join("/sys/block", filepath.Base(disk), "stat"))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read I/O counters of %s: %v", disk, err)
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 7 {
+		return 0, fmt.Errorf("unexpected I/O counters of %s: %q", disk, data)
+	}
+	read, err1 := strconv.ParseUint(fields[2], 10, 64)
+	written, err2 := strconv.ParseUint(fields[6], 10, 64)
+	if err := errors.Join(err1, err2); err != nil {
+		return 0, fmt.Errorf("unexpected I/O counters of %s: %v", disk, err)
+	}
+	return read + written, nil
+}
+
+// spinDown puts a disk into standby with STANDBY IMMEDIATE, or with smartctl
+// if ATA pass-through is not permitted.
+func spinDown(ctx context.Context, disk string) error {
+	if config().DevMode {
+		return spinDownDevMode(disk)
+	}
+	err := standbyNative(disk)
+	if err == nil {
+		return nil
+	}
+	output, smartctlErr := runCommandContext(ctx, true, config().Commands.Smartctl, "-s", "standby,now", "--", disk)
+	if smartctlErr != nil {
+		return fmt.Errorf("smartctl: %v: %s (sg_io: %v)", smartctlErr, lastLine(string(output)), err)
+	}
+	return nil
+}
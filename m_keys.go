@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gorilla/csrf"
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// keyRing holds the secrets for the session store and the CSRF middleware.
+// After a rotation the previous generation is still accepted for
+// the configured grace period, so open pages and sessions survive the switch.
+type keyRing struct {
+	Current  keySet  `json:"current"`
+	Previous *keySet `json:"previous,omitempty"`
+}
+
+type keySet struct {
+	Session   []byte    `json:"session"`
+	CSRF      []byte    `json:"csrf"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func newKeySet() keySet {
+	return keySet{
+		Session:   generateRandomKey(32),
+		CSRF:      generateRandomKey(32),
+		CreatedAt: time.Now(),
+	}
+}
+
+// loadOrCreateKeyRing reads the key file or, if it does not exist yet,
+// generates a fresh key ring and writes it.
+func loadOrCreateKeyRing(path string) (*keyRing, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		ring := &keyRing{Current: newKeySet()}
+		if err := saveKeyRing(path, ring); err != nil {
+			return nil, err
+		}
+		return ring, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file %s: %v", path, err)
+	}
+
+	ring := &keyRing{}
+	if err := json.Unmarshal(data, ring); err != nil {
+		return nil, fmt.Errorf("failed to parse key file %s: %v", path, err)
+	}
+	if len(ring.Current.Session) != 32 || len(ring.Current.CSRF) != 32 {
+		return nil, fmt.Errorf("key file %s contains invalid keys", path)
+	}
+	return ring, nil
+}
+
+// rotateKeyRing moves the current keys to the previous slot and generates a
+// new current generation.
+func rotateKeyRing(path string) (*keyRing, error) {
+	ring, err := loadOrCreateKeyRing(path)
+	if err != nil {
+		return nil, err
+	}
+	previous := ring.Current
+	ring.Previous = &previous
+	ring.Current = newKeySet()
+	if err := saveKeyRing(path, ring); err != nil {
+		return nil, err
+	}
+	return ring, nil
+}
+
+// saveKeyRing writes the key file atomically and readable by the owner only.
+func saveKeyRing(path string, ring *keyRing) error {
+	data, err := json.MarshalIndent(ring, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return fmt.Errorf("failed to create key directory: %v", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".keys-*")
+	if err != nil {
+		return fmt.Errorf("failed to write key file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0o600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write key file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// previousInGrace returns the previous key generation if it is still within
+// the grace period, nil otherwise.
+func (k *keyRing) previousInGrace() *keySet {
+	if k.Previous == nil || time.Since(k.Current.CreatedAt) > config().Auth.KeysGracePeriod {
+		return nil
+	}
+	return k.Previous
+}
+
+// sessionStore returns the cookie store for sessions. Cookies are encoded
+// with the current key, the previous key decodes them only while it is in its
+// grace period, checked on every request.
+func (k *keyRing) sessionStore() *sessions.CookieStore {
+	pairs := [][]byte{k.Current.Session, nil}
+	if k.Previous != nil {
+		pairs = append(pairs, k.Previous.Session, nil)
+	}
+	store := sessions.NewCookieStore(pairs...)
+	if k.Previous != nil {
+		store.Codecs[1] = graceCodec{Codec: store.Codecs[1], ring: k}
+	}
+	return store
+}
+
+// graceCodec is the codec of the previous session key.
+type graceCodec struct {
+	securecookie.Codec
+	ring *keyRing
+}
+
+func (c graceCodec) Decode(name, value string, dst any) error {
+	if c.ring.previousInGrace() == nil {
+		return errors.New("the previous session key is past its grace period")
+	}
+	return c.Codec.Decode(name, value, dst)
+}
+
+// csrfProtect wraps csrf.Protect with the current key. While the previous key
+// is in its grace period, requests whose token only validates against the
+// previous key are passed to a second middleware using that key.
+func (k *keyRing) csrfProtect(opts ...csrf.Option) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		if k.Previous == nil {
+			return csrf.Protect(k.Current.CSRF, opts...)(h)
+		}
+
+		fallback := csrf.Protect(k.Previous.CSRF, opts...)(h)
+		onError := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if csrf.FailureReason(r) == csrf.ErrBadToken && k.previousInGrace() != nil {
+				fallback.ServeHTTP(w, r)
+				return
+			}
+			http.Error(w, fmt.Sprintf("%s - %s", http.StatusText(http.StatusForbidden), csrf.FailureReason(r)), http.StatusForbidden)
+		})
+
+		currentOpts := append(append([]csrf.Option{}, opts...), csrf.ErrorHandler(onError))
+		return csrf.Protect(k.Current.CSRF, currentOpts...)(h)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// operationTracker counts the running mutating operations (unmount, kill,
+// restart) so a shutdown can wait for them instead of cutting them off.
+type operationTracker struct {
+	mu       sync.Mutex
+	running  map[int]string
+	nextID   int
+	draining bool
+	idle     chan struct{} // closed while nothing is running
+}
+
+func newOperationTracker() *operationTracker {
+	idle := make(chan struct{})
+	close(idle)
+	return &operationTracker{running: map[int]string{}, idle: idle}
+}
+
+var operations = newOperationTracker()
+
+// Begin registers an operation. It fails once draining started.
+func (t *operationTracker) Begin(name string) (func(), bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.draining {
+		return nil, false
+	}
+	if len(t.running) == 0 {
+		t.idle = make(chan struct{})
+	}
+	t.nextID++
+	id := t.nextID
+	t.running[id] = name
+
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		delete(t.running, id)
+		if len(t.running) == 0 {
+			close(t.idle)
+		}
+	}, true
+}
+
+// Running returns the names of the running operations.
+func (t *operationTracker) Running() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	names := []string{}
+	for _, name := range t.running {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// Drain rejects new operations and waits until the running ones finished or
+// ctx is done.
+func (t *operationTracker) Drain(ctx context.Context) error {
+	t.mu.Lock()
+	t.draining = true
+	idle := t.idle
+	t.mu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// withOperation tracks the request as a running operation and answers 503
+// while the service is shutting down.
+func withOperation(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		done, ok := operations.Begin(r.URL.Path + " by " + principalFrom(r).Name)
+		if !ok {
+			w.Header().Set("Retry-After", "30")
+			http.Error(w, "Service Unavailable - shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		defer done()
+		handler(w, r)
+	}
+}
+
+// shutdown stops accepting operations and connections and waits for running
+// requests and operations up to the configured deadline.
+func shutdown(servers []*http.Server) {
+	deadline := config().Timeouts.Shutdown
+	logger.Infof("[lifecycle] shutting down, waiting up to %s for running operations", deadline)
+	ctx, cancel := context.WithTimeout(context.Background(), deadline)
+	defer cancel()
+
+	if running := operations.Running(); len(running) > 0 {
+		logger.Infof("[lifecycle] waiting for %d operations: %s", len(running), strings.Join(running, ", "))
+	}
+	drained := make(chan error, 1)
+	go func() { drained <- operations.Drain(ctx) }()
+
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			logger.Warningf("[lifecycle] closing %s: %v", server.Addr, err)
+			server.Close()
+		}
+	}
+	if err := <-drained; err != nil {
+		logger.Warningf("[lifecycle] shutdown deadline exceeded, aborting: %s", strings.Join(operations.Running(), ", "))
+		return
+	}
+	logger.Info("[lifecycle] stopped")
+}
+
+// sdNotify sends a state change to systemd if the service runs with
+// Type=notify. It does nothing otherwise.
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:] // abstract namespace
+	}
+	conn, err := net.DialTimeout("unixgram", socket, time.Second)
+	if err != nil {
+		logger.Warningf("[lifecycle] sd_notify: %v", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		logger.Warningf("[lifecycle] sd_notify: %v", err)
+	}
+}
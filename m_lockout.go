@@ -0,0 +1,238 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// attemptTracker counts failed logins per client IP and per username. After
+// maxFailures failures a key is locked, and every further failure doubles the
+// lockout up to maxLockout. A successful login resets the key.
+type attemptTracker struct {
+	maxFailures int
+	baseLockout time.Duration
+	maxLockout  time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*attemptEntry
+}
+
+type attemptEntry struct {
+	Key         string
+	Failures    int
+	LastFailure time.Time
+	LockedUntil time.Time
+}
+
+func (e attemptEntry) Locked() bool {
+	return time.Now().Before(e.LockedUntil)
+}
+
+// Kind is "ip" or "user".
+func (e attemptEntry) Kind() string {
+	kind, _, _ := strings.Cut(e.Key, ":")
+	return kind
+}
+
+func (e attemptEntry) Value() string {
+	_, value, _ := strings.Cut(e.Key, ":")
+	return value
+}
+
+// attemptForgetAfter is how long an unlocked entry is kept after its last failure.
+const attemptForgetAfter = 24 * time.Hour
+
+func newAttemptTracker(maxFailures int, baseLockout, maxLockout time.Duration) *attemptTracker {
+	return &attemptTracker{
+		maxFailures: maxFailures,
+		baseLockout: baseLockout,
+		maxLockout:  maxLockout,
+		entries:     map[string]*attemptEntry{},
+	}
+}
+
+// SetLimits changes the thresholds, existing entries are kept.
+func (t *attemptTracker) SetLimits(maxFailures int, baseLockout, maxLockout time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.maxFailures = maxFailures
+	t.baseLockout = baseLockout
+	t.maxLockout = maxLockout
+}
+
+// LockedUntil returns the latest lockout end of the given keys, or the zero
+// time if none of them is locked.
+func (t *attemptTracker) LockedUntil(keys ...string) time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var until time.Time
+	for _, key := range keys {
+		if e, ok := t.entries[key]; ok && e.Locked() && e.LockedUntil.After(until) {
+			until = e.LockedUntil
+		}
+	}
+	return until
+}
+
+// Fail records a failed attempt and reports whether the key got locked by it.
+func (t *attemptTracker) Fail(key string) (time.Time, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.forgetStale()
+
+	e, ok := t.entries[key]
+	if !ok {
+		e = &attemptEntry{Key: key}
+		t.entries[key] = e
+	}
+	e.Failures++
+	e.LastFailure = time.Now()
+	if e.Failures < t.maxFailures {
+		return time.Time{}, false
+	}
+
+	lockout := time.Duration(float64(t.baseLockout) * math.Pow(2, float64(e.Failures-t.maxFailures)))
+	if lockout <= 0 || lockout > t.maxLockout {
+		lockout = t.maxLockout
+	}
+	e.LockedUntil = e.LastFailure.Add(lockout)
+	return e.LockedUntil, true
+}
+
+func (t *attemptTracker) Succeed(keys ...string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, key := range keys {
+		delete(t.entries, key)
+	}
+}
+
+func (t *attemptTracker) Clear(key string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, ok := t.entries[key]
+	delete(t.entries, key)
+	return ok
+}
+
+func (t *attemptTracker) ClearAll() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.entries = map[string]*attemptEntry{}
+}
+
+// Entries returns a snapshot of all tracked keys, locked ones first.
+func (t *attemptTracker) Entries() []attemptEntry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.forgetStale()
+	entries := make([]attemptEntry, 0, len(t.entries))
+	for _, e := range t.entries {
+		entries = append(entries, *e)
+	}
+	slices.SortFunc(entries, func(a, b attemptEntry) int {
+		if a.Locked() != b.Locked() {
+			if a.Locked() {
+				return -1
+			}
+			return 1
+		}
+		return b.LastFailure.Compare(a.LastFailure)
+	})
+	return entries
+}
+
+// forgetStale drops unlocked entries without recent failures. Callers hold t.mu.
+func (t *attemptTracker) forgetStale() {
+	for key, e := range t.entries {
+		if !e.Locked() && time.Since(e.LastFailure) > attemptForgetAfter {
+			delete(t.entries, key)
+		}
+	}
+}
+
+// rateLimiter is a token bucket shared by all callers of the mutating endpoints.
+type rateLimiter struct {
+	perSecond float64
+	burst     float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(perMinute int, burst int) *rateLimiter {
+	return &rateLimiter{perSecond: float64(perMinute) / 60, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// SetRate changes the refill rate and burst size.
+func (l *rateLimiter) SetRate(perMinute int, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.perSecond = float64(perMinute) / 60
+	l.burst = float64(burst)
+	l.tokens = min(l.tokens, l.burst)
+}
+
+// Allow takes a token if one is available, otherwise it returns how long to
+// wait for the next one.
+func (l *rateLimiter) Allow() (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.perSecond)
+	l.last = now
+	if l.tokens >= 1 {
+		l.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - l.tokens) / l.perSecond * float64(time.Second))
+}
+
+var loginAttempts *attemptTracker
+var actionLimiter *rateLimiter
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func setRetryAfter(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+}
+
+// recordLoginFailure tracks a failed login for the client IP and, if given,
+// the username, and logs lockouts.
+func recordLoginFailure(r *http.Request, user string) {
+	keys := []string{"ip:" + clientIP(r)}
+	if user != "" {
+		keys = append(keys, "user:"+user)
+	}
+	logger.Warningf("[auth] failed login from %s, user: %q", clientIP(r), user)
+	for _, key := range keys {
+		if until, locked := loginAttempts.Fail(key); locked {
+			audit.Record(auditEntry{User: user, Source: clientIP(r), Action: "login.lockout", Target: key, Outcome: auditDenied, Error: "locked until " + until.Format(time.RFC3339)})
+		}
+	}
+}
+
+// withRateLimit rejects requests with 429 once the shared action budget is used up.
+func withRateLimit(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if ok, wait := actionLimiter.Allow(); !ok {
+			setRetryAfter(w, wait)
+			http.Error(w, "Too Many Requests - try again later", http.StatusTooManyRequests)
+			return
+		}
+		handler(w, r)
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// The metrics are written in the Prometheus text format by hand, the few
+// counters and histograms here don't justify the client library on a Pi.
+
+// labelSet renders label pairs as {name="value",...}.
+func labelSet(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(values[i]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+type counterVec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	values map[string]float64 // by rendered label set
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: map[string]float64{}}
+}
+
+func (c *counterVec) Inc(values ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[labelSet(c.labels, values)]++
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, labels := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, labels, formatFloat(c.values[labels]))
+	}
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+type histogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	values map[string]*histogram
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, values: map[string]*histogram{}}
+}
+
+func (h *histogramVec) Observe(value float64, values ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := strings.Join(values, "\x00")
+	hist, ok := h.values[key]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hist
+	}
+	if i, _ := slices.BinarySearch(h.buckets, value); i < len(h.buckets) {
+		hist.counts[i]++
+	}
+	hist.count++
+	hist.sum += value
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	labelNames := append(slices.Clone(h.labels), "le")
+	for _, key := range sortedKeys(h.values) {
+		hist := h.values[key]
+		values := strings.Split(key, "\x00")
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += hist.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelSet(labelNames, append(slices.Clone(values), formatFloat(bound))), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelSet(labelNames, append(slices.Clone(values), "+Inf")), hist.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labelSet(h.labels, values), formatFloat(hist.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labelSet(h.labels, values), hist.count)
+	}
+}
+
+// gauge writes the header and samples of a gauge computed at scrape time.
+func gauge(w io.Writer, name, help string, samples func(sample func(value float64, labels ...string))) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	samples(func(value float64, labels ...string) {
+		names := make([]string, 0, len(labels)/2)
+		values := make([]string, 0, len(labels)/2)
+		for i := 0; i+1 < len(labels); i += 2 {
+			names = append(names, labels[i])
+			values = append(values, labels[i+1])
+		}
+		fmt.Fprintf(w, "%s%s %s\n", name, labelSet(names, values), formatFloat(value))
+	})
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+var (
+	latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+	actionsTotal        = newCounterVec("unmounter_actions_total", "Audited actions by outcome.", "action", "outcome")
+	probeTimeoutsTotal  = newCounterVec("unmounter_probe_timeouts_total", "Status probes that did not finish in time.", "probe")
+	probeDuration       = newHistogramVec("unmounter_probe_duration_seconds", "Duration of the status probes.", latencyBuckets, "probe")
+	httpRequestsTotal   = newCounterVec("unmounter_http_requests_total", "HTTP requests by route, method and status code.", "route", "method", "code")
+	httpRequestDuration = newHistogramVec("unmounter_http_request_duration_seconds", "Duration of the HTTP requests.", latencyBuckets, "route", "method")
+
+	webhookDeliveriesTotal = newCounterVec("unmounter_webhook_deliveries_total", "Webhook delivery attempts by endpoint and outcome.", "endpoint", "outcome")
+)
+
+// observeProbe records a probe result. Probes are grouped by kind, e.g. all
+// "lsof /mnt/..." probes as lsof.
+func observeProbe(result ProbeResult) {
+	kind, _, _ := strings.Cut(result.Name, " ")
+	probeDuration.Observe(float64(result.DurationMs)/1000, kind)
+	if result.TimedOut {
+		probeTimeoutsTotal.Inc(kind)
+	}
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// withHTTPMetrics is a router middleware counting requests per route template,
+// so /drives/{uuid} is one series.
+func withHTTPMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := r.URL.Path
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+		httpRequestsTotal.Inc(route, r.Method, strconv.Itoa(recorder.code))
+		httpRequestDuration.Observe(time.Since(start).Seconds(), route, r.Method)
+	})
+}
+
+// withMetricsAuth lets the scraper in with metrics.token or without
+// credentials if metrics.public is set; otherwise the usual users and API
+// tokens with status:read are accepted.
+func withMetricsAuth(handler http.HandlerFunc) http.HandlerFunc {
+	authenticated := withAuth(scopeStatusRead, handler)
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := config().Metrics
+		if !cfg.Enabled {
+			http.NotFound(w, r)
+			return
+		}
+		if cfg.Public {
+			handler(w, r)
+			return
+		}
+		if raw, ok := bearerToken(r); ok && cfg.Token != "" && subtle.ConstantTimeCompare([]byte(raw), []byte(cfg.Token)) == 1 {
+			handler(w, r)
+			return
+		}
+		authenticated(w, r)
+	}
+}
+
+func handlerMetrics(w http.ResponseWriter, r *http.Request) {
+	status := systemStatusCache.Get(r.Context(), false)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	out := bufio.NewWriter(w)
+	defer out.Flush()
+	writeMetrics(out, status)
+}
+
+func writeMetrics(w io.Writer, status *SystemStatus) {
+	mountLabels := func(m Mount) []string {
+		return []string{"path", m.Path, "device", m.Device, "uuid", m.UUID}
+	}
+	gauge(w, "unmounter_mount_size_bytes", "Total size of the managed mount.", func(sample func(float64, ...string)) {
+		for _, m := range status.Mounts {
+			if m.TotalBytes > 0 {
+				sample(float64(m.TotalBytes), mountLabels(m)...)
+			}
+		}
+	})
+	gauge(w, "unmounter_mount_free_bytes", "Space available to unprivileged users on the managed mount.", func(sample func(float64, ...string)) {
+		for _, m := range status.Mounts {
+			if m.TotalBytes > 0 {
+				sample(float64(m.FreeBytes), mountLabels(m)...)
+			}
+		}
+	})
+	gauge(w, "unmounter_mount_open_files", "Files held open on the mount, as listed by lsof.", func(sample func(float64, ...string)) {
+		for _, m := range status.Mounts {
+			if m.UsageError == "" {
+				sample(float64(len(m.Usages)), mountLabels(m)...)
+			}
+		}
+	})
+	gauge(w, "unmounter_mount_processes", "Processes using the mount.", func(sample func(float64, ...string)) {
+		for _, m := range status.Mounts {
+			if m.UsageError == "" {
+				sample(float64(len(uniqueBlockers(m.Usages))), mountLabels(m)...)
+			}
+		}
+	})
+	smartKnown := func(m Mount) bool {
+		return m.SMART != nil && m.SMART.Source != "" && m.SMART.Error == ""
+	}
+	gauge(w, "unmounter_smart_passed", "Whether the SMART overall health of the disk of the mount passed.", func(sample func(float64, ...string)) {
+		for _, m := range status.Mounts {
+			if smartKnown(m) {
+				sample(boolValue(m.SMART.Passed), mountLabels(m)...)
+			}
+		}
+	})
+	gauge(w, "unmounter_smart_temperature_celsius", "Temperature of the disk of the mount as of the last SMART read.", func(sample func(float64, ...string)) {
+		for _, m := range status.Mounts {
+			if smartKnown(m) && m.SMART.Temperature > 0 {
+				sample(float64(m.SMART.Temperature), mountLabels(m)...)
+			}
+		}
+	})
+	gauge(w, "unmounter_smart_bad_sectors", "Reallocated and pending sectors of the disk of the mount.", func(sample func(float64, ...string)) {
+		for _, m := range status.Mounts {
+			if smartKnown(m) {
+				sample(float64(m.SMART.Reallocated), append(mountLabels(m), "kind", "reallocated")...)
+				sample(float64(m.SMART.Pending), append(mountLabels(m), "kind", "pending")...)
+			}
+		}
+	})
+	gauge(w, "unmounter_service_active", "Whether the managed systemd unit is active.", func(sample func(float64, ...string)) {
+		for _, svc := range status.Services {
+			sample(boolValue(svc.Active), "unit", svc.Unit, "name", svc.Name)
+		}
+	})
+	if status.Samba != nil && status.ErrorSamba == nil {
+		gauge(w, "unmounter_samba_locked_files", "Files locked by samba clients.", func(sample func(float64, ...string)) {
+			sample(float64(status.Samba.Locks))
+		})
+	}
+	gauge(w, "unmounter_probe_failed", "Whether a probe of the last status collection failed or timed out.", func(sample func(float64, ...string)) {
+		for _, p := range status.Probes {
+			sample(boolValue(p.Error != ""), "probe", p.Name)
+		}
+	})
+	gauge(w, "unmounter_status_collected_timestamp_seconds", "When the reported status was collected.", func(sample func(float64, ...string)) {
+		sample(float64(status.CollectedAt.UnixMilli()) / 1000)
+	})
+	gauge(w, "unmounter_operations_running", "Unmounts, kills and restarts in progress.", func(sample func(float64, ...string)) {
+		sample(float64(len(operations.Running())))
+	})
+	gauge(w, "unmounter_webhook_pending", "Webhook deliveries waiting in the outbox.", func(sample func(float64, ...string)) {
+		sample(float64(webhooks.Pending()))
+	})
+
+	actionsTotal.write(w)
+	probeDuration.write(w)
+	probeTimeoutsTotal.write(w)
+	httpRequestsTotal.write(w)
+	httpRequestDuration.write(w)
+	webhookDeliveriesTotal.write(w)
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// mqttBridge publishes drives and services to an MQTT broker, announces them
+// to Home Assistant by MQTT discovery and runs the unmount and restart
+// buttons pressed there.
+//
+// Topics, below topic_prefix/node_id:
+//
+//	availability                  online / offline (last will)
+//	drive/<uuid>/state            {"mounted":true,"path":...,"free_bytes":...,"in_use":1}
+//	drive/<uuid>/unmount          command, any payload
+//	service/<unit>/state          ON / OFF
+//	service/<unit>/restart        command, any payload
+//	alert/<rule>_<uuid>/state     the alert as JSON, "resolved":true once it is over
+type mqttBridge struct {
+	cfg    MQTTConfig
+	node   string
+	client mqtt.Client
+
+	mu        sync.Mutex
+	announced map[string]bool // discovery topics already published
+}
+
+var regexMQTTID = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+// mqttID makes a name usable in topics and Home Assistant object ids.
+func mqttID(name string) string {
+	return strings.Trim(regexMQTTID.ReplaceAllString(name, "_"), "_")
+}
+
+// startMQTT connects to the broker in the background and publishes until ctx
+// is done. It returns nil if MQTT is disabled.
+func startMQTT(ctx context.Context) *mqttBridge {
+	cfg := config().MQTT
+	if !cfg.Enabled {
+		return nil
+	}
+	node := cfg.NodeID
+	if node == "" {
+		node, _ = os.Hostname()
+	}
+	b := &mqttBridge{cfg: cfg, node: mqttID(node), announced: map[string]bool{}}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(cfg.Broker).
+		SetClientID(cfg.ClientID).
+		SetUsername(cfg.Username).
+		SetPassword(cfg.Password).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(10*time.Second).
+		SetOrderMatters(false).
+		SetWill(b.topic("availability"), "offline", 1, true).
+		SetOnConnectHandler(func(mqtt.Client) { b.onConnect() }).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			logger.Warningf("[mqtt] connection to %s lost: %v", cfg.Broker, err)
+		})
+	b.client = mqtt.NewClient(opts)
+	b.client.Connect() // retried in the background until it succeeds
+
+	go b.run(ctx)
+	return b
+}
+
+func (b *mqttBridge) topic(parts ...string) string {
+	return b.cfg.TopicPrefix + "/" + b.node + "/" + strings.Join(parts, "/")
+}
+
+// onConnect runs on every (re)connect: the broker may have lost the retained
+// messages and the subscriptions.
+func (b *mqttBridge) onConnect() {
+	logger.Infof("[mqtt] connected to %s as %s", b.cfg.Broker, b.node)
+	b.mu.Lock()
+	b.announced = map[string]bool{}
+	b.mu.Unlock()
+
+	// The id is the level before the command, the prefix may contain slashes.
+	id := func(topic string) string {
+		parts := strings.Split(topic, "/")
+		return parts[len(parts)-2]
+	}
+	// A retained command would run again on every reconnect, only a press
+	// sent while connected counts.
+	retained := func(msg mqtt.Message) bool {
+		if msg.Retained() {
+			logger.Warningf("[mqtt] ignoring retained message on %s, publish commands without the retain flag", msg.Topic())
+		}
+		return msg.Retained()
+	}
+	b.client.Subscribe(b.topic("drive", "+", "unmount"), 1, func(_ mqtt.Client, msg mqtt.Message) {
+		if retained(msg) {
+			return
+		}
+		go b.handleUnmount(id(msg.Topic()))
+	})
+	b.client.Subscribe(b.topic("service", "+", "restart"), 1, func(_ mqtt.Client, msg mqtt.Message) {
+		if retained(msg) {
+			return
+		}
+		go b.handleRestart(id(msg.Topic()))
+	})
+	b.publish(b.topic("availability"), "online")
+	go b.publishState(context.Background())
+}
+
+func (b *mqttBridge) run(ctx context.Context) {
+	ticker := time.NewTicker(b.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if b.client.IsConnectionOpen() {
+				b.publishState(ctx)
+			}
+		}
+	}
+}
+
+// Stop marks the node offline and disconnects.
+func (b *mqttBridge) Stop() {
+	if b == nil {
+		return
+	}
+	if b.client.IsConnectionOpen() {
+		b.publish(b.topic("availability"), "offline")
+	}
+	b.client.Disconnect(250)
+}
+
+// publish sends a retained message and logs failures.
+func (b *mqttBridge) publish(topic string, payload any) {
+	var data []byte
+	switch payload := payload.(type) {
+	case string:
+		data = []byte(payload)
+	default:
+		var err error
+		if data, err = json.Marshal(payload); err != nil {
+			logger.Errorf("[mqtt] %s: %v", topic, err)
+			return
+		}
+	}
+	token := b.client.Publish(topic, 1, true, data)
+	if !token.WaitTimeout(5 * time.Second) {
+		logger.Warningf("[mqtt] publishing %s timed out", topic)
+	} else if err := token.Error(); err != nil {
+		logger.Warningf("[mqtt] publishing %s: %v", topic, err)
+	}
+}
+
+type driveState struct {
+	Mounted     bool   `json:"mounted"`
+	Path        string `json:"path"`
+	Device      string `json:"device"`
+	FreeBytes   uint64 `json:"free_bytes,omitempty"`
+	TotalBytes  uint64 `json:"total_bytes,omitempty"`
+	UsedPercent int    `json:"used_percent,omitempty"`
+	InUse       int    `json:"in_use"` // processes using the drive
+}
+
+// publishState publishes the discovery configs of new entities and the
+// current state of all drives and services.
+func (b *mqttBridge) publishState(ctx context.Context) {
+	status := systemStatusCache.Get(ctx, false)
+
+	states := map[string]driveState{}
+	for _, d := range history.Drives() {
+		states[d.UUID] = driveState{Path: d.Path, Device: d.Device}
+	}
+	if status.ErrorMounts == nil {
+		for _, m := range status.Mounts {
+			state := driveState{Mounted: true, Path: m.Path, Device: m.Device, FreeBytes: m.FreeBytes, TotalBytes: m.TotalBytes, UsedPercent: m.UsedSpacePercentage}
+			if m.UsageError == "" {
+				state.InUse = len(uniqueBlockers(m.Usages))
+			}
+			states[m.UUID] = state
+		}
+	}
+	for uuid, state := range states {
+		b.announceDrive(uuid, state)
+		b.publish(b.topic("drive", mqttID(uuid), "state"), state)
+	}
+
+	for _, a := range alerts.Active() {
+		b.publishAlert(a)
+	}
+
+	for _, svc := range status.Services {
+		b.announceService(svc)
+		value := "OFF"
+		if svc.Active {
+			value = "ON"
+		}
+		b.publish(b.topic("service", mqttID(svc.Unit), "state"), value)
+	}
+}
+
+// announce publishes a Home Assistant discovery config once per connection.
+func (b *mqttBridge) announce(component, objectID string, entity map[string]any) {
+	topic := fmt.Sprintf("%s/%s/%s/%s/config", b.cfg.DiscoveryPrefix, component, b.node, objectID)
+	b.mu.Lock()
+	done := b.announced[topic]
+	b.announced[topic] = true
+	b.mu.Unlock()
+	if done {
+		return
+	}
+
+	entity["unique_id"] = b.node + "_" + objectID
+	entity["object_id"] = b.node + "_" + objectID
+	entity["availability_topic"] = b.topic("availability")
+	entity["device"] = map[string]any{
+		"identifiers":  []string{"unmounter_" + b.node},
+		"name":         "Unmounter " + b.node,
+		"manufacturer": "dryaf",
+		"model":        "unmounter",
+	}
+	b.publish(topic, entity)
+}
+
+func (b *mqttBridge) announceDrive(uuid string, state driveState) {
+	id := mqttID(uuid)
+	stateTopic := b.topic("drive", id, "state")
+	name := state.Path
+	b.announce("binary_sensor", id+"_mounted", map[string]any{
+		"name":           name + " mounted",
+		"state_topic":    stateTopic,
+		"value_template": "{{ 'ON' if value_json.mounted else 'OFF' }}",
+		"icon":           "mdi:harddisk",
+	})
+	b.announce("sensor", id+"_free", map[string]any{
+		"name":                          name + " free space",
+		"state_topic":                   stateTopic,
+		"value_template":                "{{ value_json.free_bytes if value_json.mounted else None }}",
+		"device_class":                  "data_size",
+		"unit_of_measurement":           "B",
+		"suggested_unit_of_measurement": "GB",
+		"state_class":                   "measurement",
+	})
+	b.announce("sensor", id+"_in_use", map[string]any{
+		"name":                name + " in use by",
+		"state_topic":         stateTopic,
+		"value_template":      "{{ value_json.in_use }}",
+		"unit_of_measurement": "processes",
+		"state_class":         "measurement",
+		"icon":                "mdi:file-lock",
+	})
+	b.announce("button", id+"_unmount", map[string]any{
+		"name":          name + " unmount",
+		"command_topic": b.topic("drive", id, "unmount"),
+		"icon":          "mdi:eject",
+	})
+}
+
+func (b *mqttBridge) announceService(svc ServiceStatus) {
+	id := mqttID(svc.Unit)
+	b.announce("binary_sensor", "service_"+id, map[string]any{
+		"name":         svc.Name,
+		"state_topic":  b.topic("service", id, "state"),
+		"device_class": "running",
+	})
+	if svc.Restartable {
+		b.announce("button", "service_"+id+"_restart", map[string]any{
+			"name":          svc.Name + " restart",
+			"command_topic": b.topic("service", id, "restart"),
+			"device_class":  "restart",
+		})
+	}
+}
+
+// publishAlert announces a problem sensor per alert and publishes whether it
+// fires. It is a no-op without MQTT.
+func (b *mqttBridge) publishAlert(a alert) {
+	if b == nil || !b.client.IsConnectionOpen() {
+		return
+	}
+	id := mqttID(a.Key())
+	stateTopic := b.topic("alert", id, "state")
+	b.announce("binary_sensor", "alert_"+id, map[string]any{
+		"name":                  a.Rule + " " + a.Path,
+		"state_topic":           stateTopic,
+		"value_template":        "{{ 'OFF' if value_json.resolved | default(false) else 'ON' }}",
+		"json_attributes_topic": stateTopic,
+		"device_class":          "problem",
+	})
+	b.publish(stateTopic, a)
+}
+
+// principal is the user commands from the broker run as, nil if commands
+// are not allowed.
+func (b *mqttBridge) principal() *principal {
+	account, ok := config().User(b.cfg.User)
+	if b.cfg.User == "" || !ok {
+		return nil
+	}
+	return &principal{Name: account.Name, Scopes: roleScopes[account.Role]}
+}
+
+// command runs an action pressed in Home Assistant like a request: it needs
+// the scope, counts against the rate limit, is tracked for a graceful
+// shutdown and audited.
+func (b *mqttBridge) command(scope, action, target string, fn func(p *principal) error) {
+	entry := auditEntry{User: "mqtt", Source: "mqtt", Action: action, Target: target, Outcome: auditSuccess}
+	p := b.principal()
+	if p != nil {
+		entry.User = p.Name
+	}
+	if !p.Can(scope) {
+		entry.Outcome, entry.Error = auditDenied, "missing scope "+scope+", see mqtt.user"
+		audit.Record(entry)
+		return
+	}
+
+	var err error
+	if ok, _ := actionLimiter.Allow(); !ok {
+		err = errors.New("rate limit exceeded")
+	} else if done, ok := operations.Begin("mqtt " + action + " " + target); !ok {
+		err = errors.New("shutting down")
+	} else {
+		err = fn(p)
+		done()
+		systemStatusCache.Invalidate()
+	}
+	if err != nil {
+		entry.Outcome, entry.Error = auditFailure, err.Error()
+	}
+	audit.Record(entry)
+	b.publishState(context.Background())
+}
+
+func (b *mqttBridge) handleUnmount(id string) {
+	var drive *driveHistory
+	for _, d := range history.Drives() {
+		if mqttID(d.UUID) == id {
+			drive = d
+		}
+	}
+	if drive == nil || !drive.Mounted {
+		audit.Record(auditEntry{User: "mqtt", Source: "mqtt", Action: "unmount", Target: id, Outcome: auditFailure, Error: errNotMounted.Error()})
+		return
+	}
+	b.command(scopeMountUnmount, "unmount", drive.Path, func(p *principal) error {
+		if !validMountPath(drive.Path) {
+			return errors.New("invalid device")
+		}
+		_, err := unmountWithHooks(context.Background(), drive.Path, auditEntry{User: p.Name, Source: "mqtt"})
+		history.RecordUnmount(drive.Path, p.Name, err)
+		return err
+	})
+}
+
+func (b *mqttBridge) handleRestart(id string) {
+	for _, svc := range config().Services {
+		if mqttID(svc.Unit) == id {
+			b.command(scopeServiceRestart, "restart", svc.Unit, func(p *principal) error {
+				err := restartService(svc.Unit)
+				history.RecordRestart(svc.Unit, p.Name, err)
+				return err
+			})
+			return
+		}
+	}
+	audit.Record(auditEntry{User: "mqtt", Source: "mqtt", Action: "restart", Target: id, Outcome: auditFailure, Error: "unknown service"})
+}
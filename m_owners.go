@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of process owners, each with its own way to stop the process.
+const (
+	ownerUnit      = "unit"      // a system service: stop the unit
+	ownerContainer = "container" // stop the container
+	ownerSession   = "session"   // a login session: terminate it
+	ownerUserUnit  = "user-unit" // a service of a user's systemd: kill the process
+	ownerProcess   = "process"   // nothing known: kill the process
+)
+
+const (
+	clockTicks     = 100 // USER_HZ, the unit of the start time in /proc/<pid>/stat
+	maxParentDepth = 8
+)
+
+// processOwner describes what a process belongs to, read from /proc.
+type processOwner struct {
+	Kind    string    `json:"kind"`
+	Name    string    `json:"name"`         // unit, container or session name; the command for process
+	ID      string    `json:"id,omitempty"` // container or session ID
+	Cgroup  string    `json:"cgroup,omitempty"`
+	Cmdline string    `json:"cmdline"`
+	PPID    int       `json:"ppid"`
+	Parents []string  `json:"parents,omitempty"` // commands of the parents, nearest first, up to PID 1
+	Started time.Time `json:"started"`
+
+	StartTicks uint64 `json:"startTicks"` // identifies the process with its PID, see processIdentity
+}
+
+// Label describes the kind for the UI.
+func (o *processOwner) Label() string {
+	switch o.Kind {
+	case ownerUnit:
+		return "systemd unit"
+	case ownerContainer:
+		return "container"
+	case ownerSession:
+		return "login session"
+	case ownerUserUnit:
+		return "user service"
+	}
+	return "process"
+}
+
+// usageGroup are the usages of a mount with the same owner.
+type usageGroup struct {
+	Owner  *processOwner // of the first usage, nil if it could not be read
+	Kind   string
+	Name   string
+	Usages []Usage
+}
+
+// UsageGroups groups the usages of a mount by owner, processes without a
+// known owner are a group each.
+func (m Mount) UsageGroups() []usageGroup {
+	groups := []usageGroup{}
+	for _, u := range m.Usages {
+		kind, name := ownerProcess, strconv.Itoa(u.PID)
+		if u.Owner != nil && u.Owner.Kind != ownerProcess {
+			kind, name = u.Owner.Kind, u.Owner.Name
+		}
+		i := slices.IndexFunc(groups, func(g usageGroup) bool { return g.Kind == kind && g.Name == name })
+		if i < 0 {
+			groups = append(groups, usageGroup{Owner: u.Owner, Kind: kind, Name: name})
+			i = len(groups) - 1
+		}
+		groups[i].Usages = append(groups[i].Usages, u)
+	}
+	order := []string{ownerContainer, ownerUnit, ownerSession, ownerUserUnit, ownerProcess}
+	slices.SortStableFunc(groups, func(a, b usageGroup) int {
+		return slices.Index(order, a.Kind) - slices.Index(order, b.Kind)
+	})
+	return groups
+}
+
+// resolveOwners sets the owner of each usage. A process is read once even
+// if it has many files open.
+func resolveOwners(usages []Usage) {
+	owners := map[int]*processOwner{}
+	for i := range usages {
+		pid := usages[i].PID
+		owner, ok := owners[pid]
+		if !ok {
+			var err error
+			if owner, err = readProcessOwner(pid); err != nil {
+				logger.Warningf("[owners] %v", err)
+			}
+			owners[pid] = owner
+		}
+		usages[i].Owner = owner
+	}
+}
+
+var (
+	regexContainerScope = regexp.MustCompile(`^(?:docker|cri-containerd|libpod|crio)-([0-9a-f]{12,64})\.scope$`)
+	regexContainerID    = regexp.MustCompile(`^[0-9a-f]{64}$`)
+	regexSessionScope   = regexp.MustCompile(`^session-([a-z0-9]+)\.scope$`)
+)
+
+// readProcessOwner reads the owner of a process from its cgroup, falling back
+// to a containerd shim among its parents.
+func readProcessOwner(pid int) (*processOwner, error) {
+	if config().DevMode {
+		return processOwnerDevMode(pid), nil
+	}
+	stat, err := readProcStat(pid)
+	if err != nil {
+		return nil, err
+	}
+	owner := &processOwner{Kind: ownerProcess, Name: stat.comm, PPID: stat.ppid, Started: stat.started, StartTicks: stat.ticks}
+	if cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid)); err == nil {
+		owner.Cmdline = strings.TrimSpace(strings.ReplaceAll(string(cmdline), "\x00", " "))
+	}
+	if cgroup, err := readCgroup(pid); err == nil {
+		owner.Cgroup = cgroup
+		classifyCgroup(owner, cgroup)
+	}
+
+	for parent, depth := stat.ppid, 0; parent > 1 && depth < maxParentDepth; depth++ {
+		ps, err := readProcStat(parent)
+		if err != nil {
+			break
+		}
+		owner.Parents = append(owner.Parents, ps.comm)
+		if owner.Kind == ownerProcess && strings.HasPrefix(ps.comm, "containerd-shim") {
+			// The cgroup is not visible from here, e.g. in a cgroup namespace.
+			if id := shimContainerID(parent); id != "" {
+				owner.Kind, owner.ID, owner.Name = ownerContainer, id, id[:12]
+			}
+		}
+		parent = ps.ppid
+	}
+	return owner, nil
+}
+
+// classifyCgroup sets the owner from a cgroup path like
+// /system.slice/smbd.service or /user.slice/user-1000.slice/session-3.scope.
+func classifyCgroup(owner *processOwner, cgroup string) {
+	parts := strings.Split(strings.Trim(cgroup, "/"), "/")
+	for i, part := range parts {
+		if m := regexContainerScope.FindStringSubmatch(part); m != nil {
+			owner.Kind, owner.ID, owner.Name = ownerContainer, m[1], m[1][:12]
+			return
+		}
+		if (part == "docker" || part == "kubepods") && i+1 < len(parts) && regexContainerID.MatchString(parts[len(parts)-1]) {
+			id := parts[len(parts)-1] // cgroupfs driver: /docker/<id>
+			owner.Kind, owner.ID, owner.Name = ownerContainer, id, id[:12]
+			return
+		}
+	}
+	for i := len(parts) - 1; i >= 0; i-- {
+		part := parts[i]
+		if m := regexSessionScope.FindStringSubmatch(part); m != nil {
+			owner.Kind, owner.ID, owner.Name = ownerSession, m[1], m[1]
+			return
+		}
+		if strings.HasPrefix(part, "user@") && strings.HasSuffix(part, ".service") {
+			owner.Kind, owner.Name = ownerUserUnit, path.Base(cgroup)
+			return
+		}
+	}
+	last := parts[len(parts)-1]
+	if len(parts) >= 2 && parts[0] == "system.slice" && (strings.HasSuffix(last, ".service") || strings.HasSuffix(last, ".scope")) {
+		owner.Kind, owner.Name = ownerUnit, last
+	}
+}
+
+// readCgroup returns the unified (v2) cgroup of a process, or the systemd
+// one of cgroup v1.
+func readCgroup(pid int) (string, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	found := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		switch {
+		case fields[1] == "name=systemd":
+			return fields[2], nil
+		case fields[0] == "0" && fields[1] == "":
+			found = fields[2]
+		}
+	}
+	if found == "" {
+		return "", fmt.Errorf("no systemd cgroup for pid %d", pid)
+	}
+	return found, scanner.Err()
+}
+
+// shimContainerID reads the container ID from the command line of a
+// containerd-shim, "... -id <id> ...".
+func shimContainerID(pid int) string {
+	cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return ""
+	}
+	args := strings.Split(string(cmdline), "\x00")
+	for i, arg := range args {
+		if arg == "-id" && i+1 < len(args) && regexContainerID.MatchString(args[i+1]) {
+			return args[i+1]
+		}
+	}
+	return ""
+}
+
+type procStat struct {
+	comm    string
+	state   byte // R, S, D, Z, ...
+	ppid    int
+	ticks   uint64 // start time in clock ticks after boot
+	started time.Time
+}
+
+// readProcStat reads command, parent and start time of a process from
+// /proc/<pid>/stat.
+func readProcStat(pid int) (procStat, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return procStat{}, fmt.Errorf("failed to read process %d: %v", pid, err)
+	}
+	// The command is in parentheses and may contain spaces and parentheses itself.
+	start, end := strings.IndexByte(string(data), '('), strings.LastIndexByte(string(data), ')')
+	if start < 0 || end < start {
+		return procStat{}, fmt.Errorf("unexpected stat of process %d", pid)
+	}
+	fields := strings.Fields(string(data[end+1:]))
+	if len(fields) < 20 {
+		return procStat{}, fmt.Errorf("unexpected stat of process %d", pid)
+	}
+	ppid, err1 := strconv.Atoi(fields[1])
+	ticks, err2 := strconv.ParseUint(fields[19], 10, 64)
+	boot, err3 := bootTime()
+	if err := errors.Join(err1, err2, err3); err != nil {
+		return procStat{}, fmt.Errorf("unexpected stat of process %d: %v", pid, err)
+	}
+	started := boot.Add(time.Duration(ticks) * time.Second / clockTicks)
+	return procStat{comm: string(data[start+1 : end]), state: fields[0][0], ppid: ppid, ticks: ticks, started: started}, nil
+}
+
+// bootTime is btime of /proc/stat, the start times of processes count from
+// it.
+var bootTime = sync.OnceValues(func() (time.Time, error) {
+	data, err := os.ReadFile("/proc/stat")
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if value, ok := strings.CutPrefix(line, "btime "); ok {
+			seconds, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+			if err != nil {
+				return time.Time{}, err
+			}
+			return time.Unix(seconds, 0), nil
+		}
+	}
+	return time.Time{}, errors.New("no btime in /proc/stat")
+})
+
+// findOwner looks up an owner among the current usages of the managed
+// mounts, the only owners that may be stopped from here. It returns the
+// commands of its processes.
+func findOwner(ctx context.Context, kind, name string) (*processOwner, []string, error) {
+	status := systemStatusCache.Get(ctx, true)
+	if status.ErrorMounts != nil {
+		return nil, nil, status.ErrorMounts
+	}
+	var found *processOwner
+	commands := []string{}
+	for _, m := range status.Mounts {
+		for _, u := range m.Usages {
+			if u.Owner != nil && u.Owner.Kind == kind && u.Owner.Name == name {
+				found = u.Owner
+				if !slices.Contains(commands, u.Command) {
+					commands = append(commands, u.Command)
+				}
+			}
+		}
+	}
+	if found == nil {
+		return nil, nil, fmt.Errorf("no %s %s is using a managed drive", (&processOwner{Kind: kind}).Label(), name)
+	}
+	return found, commands, nil
+}
+
+// stopUnit stops a system service using a managed drive.
+func stopUnit(ctx context.Context, unit string) error {
+	if !regexUnit.MatchString(unit) {
+		return fmt.Errorf("invalid unit %q", unit)
+	}
+	_, commands, err := findOwner(ctx, ownerUnit, unit)
+	if err != nil {
+		return err
+	}
+	if err := refuseProtected(commands); err != nil {
+		return err
+	}
+	if self, err := readCgroup(os.Getpid()); err == nil && path.Base(self) == unit {
+		return fmt.Errorf("refusing to stop %s, unmounter runs in it", unit)
+	}
+	if config().DevMode {
+		return stopUnitDevMode(unit)
+	}
+	output, err := runCommandContext(ctx, true, config().Commands.Systemctl, "stop", "--", unit)
+	if err != nil {
+		return fmt.Errorf("systemctl stop: %v: %s", err, lastLine(string(output)))
+	}
+	return nil
+}
+
+// terminateSession ends a login session using a managed drive with all its
+// processes.
+func terminateSession(ctx context.Context, id string) error {
+	owner, commands, err := findOwner(ctx, ownerSession, id)
+	if err != nil {
+		return err
+	}
+	if err := refuseProtected(commands); err != nil {
+		return err
+	}
+	if config().DevMode {
+		return terminateSessionDevMode(owner.ID)
+	}
+	output, err := runCommandContext(ctx, true, config().Commands.Loginctl, "terminate-session", "--", owner.ID)
+	if err != nil {
+		return fmt.Errorf("loginctl: %v: %s", err, lastLine(string(output)))
+	}
+	return nil
+}
+
+func refuseProtected(commands []string) error {
+	for _, command := range commands {
+		if slices.Contains(config().Kill.ProtectedCommands, command) {
+			return fmt.Errorf("refusing to stop the protected process %s", command)
+		}
+	}
+	return nil
+}
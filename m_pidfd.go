@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+var errStaleProcess = errors.New("process changed")
+
+// processIdentity tells a process apart from a later one that got the same
+// PID after it exited.
+type processIdentity struct {
+	PID     int
+	Started uint64 // clock ticks after boot from /proc/<pid>/stat, 0 if not known
+	Command string // as listed by lsof, which cuts it to 9 characters
+}
+
+func (id processIdentity) String() string {
+	if id.Command == "" {
+		return strconv.Itoa(id.PID)
+	}
+	return fmt.Sprintf("%d (%s)", id.PID, id.Command)
+}
+
+// verify checks that the process with the PID is still the identified one.
+func (id processIdentity) verify() error {
+	stat, err := readProcStat(id.PID)
+	if err != nil {
+		return unreadableProcess(id, err)
+	}
+	if (id.Started != 0 && stat.ticks != id.Started) || !strings.HasPrefix(stat.comm, id.Command) {
+		return fmt.Errorf("%w: %s has exited, the PID now belongs to %s started %s", errStaleProcess, id, stat.comm, stat.started.Format("2006-01-02 15:04:05"))
+	}
+	return nil
+}
+
+// unreadableProcess returns the error of reading a process from /proc, or
+// that it exited if it is gone.
+func unreadableProcess(id processIdentity, err error) error {
+	if err == nil || syscall.Kill(id.PID, 0) == syscall.ESRCH {
+		return fmt.Errorf("%w: %s has exited", errStaleProcess, id)
+	}
+	return fmt.Errorf("%v, is /proc mounted with hidepid?", err)
+}
+
+// signalProcess sends the kill.signal to the identified process. It is
+// pinned with a pidfd before its identity is checked, so the signal can't
+// reach a process that got its PID in between. Without permission to signal
+// it, e.g. without CAP_KILL for a process of another user, the identity is
+// checked again and the kill goes through sudo, which leaves a short window.
+// A process still running kill.escalate_after after a TERM gets a KILL; the
+// caller's operation covers the wait, so a shutdown drains it.
+func signalProcess(id processIdentity) error {
+	fd, err := unix.PidfdOpen(id.PID, 0)
+	switch {
+	case errors.Is(err, unix.ESRCH):
+		return fmt.Errorf("%w: %s has exited", errStaleProcess, id)
+	case errors.Is(err, unix.ENOSYS):
+		return escalate(id, func(signal syscall.Signal) error { return killWithSudo(id, signal) }) // before Linux 5.3
+	case err != nil:
+		return fmt.Errorf("pidfd_open %d: %v", id.PID, err)
+	}
+	defer unix.Close(fd)
+
+	if err := id.verify(); err != nil {
+		return err
+	}
+	return escalate(id, func(signal syscall.Signal) error {
+		err := unix.PidfdSendSignal(fd, signal, nil, 0)
+		switch {
+		case err == nil:
+			return nil
+		case errors.Is(err, unix.ESRCH):
+			return fmt.Errorf("%w: %s has exited", errStaleProcess, id)
+		case errors.Is(err, unix.EPERM):
+			return killWithSudo(id, signal)
+		}
+		return fmt.Errorf("pidfd_send_signal %d: %v", id.PID, err)
+	})
+}
+
+// escalate sends the kill.signal with send and, for TERM, a KILL if the
+// process didn't exit within kill.escalate_after.
+func escalate(id processIdentity, send func(syscall.Signal) error) error {
+	policy := config().Kill
+	if policy.Signal != "TERM" {
+		return send(syscall.SIGKILL)
+	}
+	if err := send(syscall.SIGTERM); err != nil || policy.EscalateAfter == 0 {
+		return err
+	}
+	for deadline := time.Now().Add(policy.EscalateAfter); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		if !id.running() {
+			return nil
+		}
+	}
+	if !id.running() {
+		return nil
+	}
+	logger.Warningf("[kill] %s still running %s after TERM, sending KILL", id, policy.EscalateAfter)
+	if err := send(syscall.SIGKILL); err != nil && !errors.Is(err, errStaleProcess) {
+		return fmt.Errorf("still running after TERM, KILL failed: %v", err)
+	}
+	return nil
+}
+
+// running reports whether the identified process still runs, a zombie
+// doesn't count.
+func (id processIdentity) running() bool {
+	stat, err := readProcStat(id.PID)
+	return err == nil && stat.state != 'Z' && (id.Started == 0 || stat.ticks == id.Started)
+}
+
+var signalNames = map[syscall.Signal]string{syscall.SIGTERM: "TERM", syscall.SIGKILL: "KILL"}
+
+func killWithSudo(id processIdentity, signal syscall.Signal) error {
+	if err := id.verify(); err != nil {
+		return err
+	}
+	_, err := runCommand(true, config().Commands.Kill, "-"+signalNames[signal], "--", strconv.Itoa(id.PID))
+	return err
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var errProbeTimeout = errors.New("timed out")
+
+// ProbeResult describes one part of the status collection.
+type ProbeResult struct {
+	Name       string `json:"name"`
+	DurationMs int64  `json:"durationMs"`
+	Error      string `json:"error,omitempty"`
+	TimedOut   bool   `json:"timedOut,omitempty"`
+}
+
+// probe runs fn with the configured probe timeout. fn should pass its context
+// on to commands; calls that cannot be cancelled, like statfs on a dead
+// network mount, are abandoned in the background once the deadline passed.
+// The outcome is recorded in status unless it is nil.
+func probe[T any](parent context.Context, status *SystemStatus, name string, fn func(context.Context) (T, error)) (T, error) {
+	timeout := config().Timeouts.Probe
+	ctx, cancel := context.WithTimeout(parent, timeout)
+	defer cancel()
+
+	type result struct {
+		value T
+		err   error
+	}
+	done := make(chan result, 1)
+	start := time.Now()
+	go func() {
+		value, err := fn(ctx)
+		done <- result{value, err}
+	}()
+
+	var res result
+	select {
+	case res = <-done:
+	case <-ctx.Done():
+	}
+
+	timedOut := false
+	switch {
+	case parent.Err() != nil:
+		res = result{err: fmt.Errorf("%s canceled: %v", name, parent.Err())}
+	case ctx.Err() != nil:
+		timedOut = true
+		res = result{err: fmt.Errorf("%s %w after %s", name, errProbeTimeout, timeout)}
+	}
+
+	probeResult := ProbeResult{Name: name, DurationMs: time.Since(start).Milliseconds(), TimedOut: timedOut}
+	if res.err != nil {
+		probeResult.Error = res.err.Error()
+	}
+	observeProbe(probeResult)
+	if status != nil {
+		status.probesMu.Lock()
+		status.Probes = append(status.Probes, probeResult)
+		status.probesMu.Unlock()
+	}
+	return res.value, res.err
+}
+
+// TimedOutProbes lists the probes that did not finish in time.
+func (s *SystemStatus) TimedOutProbes() []string {
+	names := []string{}
+	for _, p := range s.Probes {
+		if p.TimedOut {
+			names = append(names, p.Name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// restartOnlySettings are config keys (or key prefixes) that are read once at
+// startup. Changing them in a reload is reported but has no effect until the
+// service is restarted.
+var restartOnlySettings = []string{"listen.", "tls.enabled", "auth.keys_file", "auth.tokens_file", "auth.totp_file", "history.file", "mqtt.", "webhooks.outbox", "schedules.state"}
+
+// reloadResult is the outcome of a config reload.
+type reloadResult struct {
+	Time    time.Time `json:"time"`
+	Trigger string    `json:"trigger"`
+	Changes []string  `json:"changes"`
+	Restart []string  `json:"restartRequired,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+func (r *reloadResult) Success() bool {
+	return r.Error == ""
+}
+
+var reloadMu sync.Mutex
+var lastReload *reloadResult
+
+// reloadConfig re-reads the config file and swaps it in if it is valid. On
+// any error the running config stays untouched.
+func reloadConfig(trigger string) *reloadResult {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	result := &reloadResult{Time: time.Now(), Trigger: trigger, Changes: []string{}}
+	lastReload = result
+
+	next, err := loadConfig(configFile)
+	if err != nil {
+		result.Error = err.Error()
+		logger.Errorf("[config] reload by %s failed: %v", trigger, err)
+		return result
+	}
+	prev := config()
+
+	result.Changes = diffConfig(prev, next)
+	for _, change := range result.Changes {
+		key, _, _ := strings.Cut(change, ":")
+		if slices.ContainsFunc(restartOnlySettings, func(prefix string) bool { return strings.HasPrefix(key, prefix) }) {
+			result.Restart = append(result.Restart, key)
+		}
+	}
+
+	if certs != nil && (next.TLS.CertFile != prev.TLS.CertFile || next.TLS.KeyFile != prev.TLS.KeyFile) {
+		if err := certs.SetFiles(next.TLS.CertFile, next.TLS.KeyFile); err != nil {
+			result.Error = err.Error()
+			logger.Errorf("[config] reload by %s failed: %v", trigger, err)
+			return result
+		}
+	}
+	if loginAttempts != nil {
+		loginAttempts.SetLimits(next.Auth.MaxFailures, next.Auth.Lockout, next.Auth.MaxLockout)
+	}
+	if actionLimiter != nil {
+		actionLimiter.SetRate(next.Auth.ActionRateLimit, max(1, next.Auth.ActionRateLimit/6))
+	}
+	currentConfig.Store(next)
+
+	logger.Infof("[config] reloaded by %s, %d changes", trigger, len(result.Changes))
+	for _, change := range result.Changes {
+		logger.Infof("[config]   %s", change)
+	}
+	if len(result.Restart) > 0 {
+		logger.Warningf("[config] restart required to apply: %s", strings.Join(result.Restart, ", "))
+	}
+	return result
+}
+
+// watchReloadSignal reloads the config on every SIGHUP until ctx is done.
+func watchReloadSignal(ctx context.Context) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	defer signal.Stop(signals)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-signals:
+			sdNotify("RELOADING=1")
+			result := reloadConfig("SIGHUP")
+			entry := auditEntry{User: "system", Source: "signal", Action: "config.reload", Target: configFile, Outcome: auditSuccess}
+			if !result.Success() {
+				entry.Outcome, entry.Error = auditFailure, result.Error
+			}
+			audit.Record(entry)
+			sdNotify("READY=1")
+		}
+	}
+}
+
+// diffConfig lists the changed settings as "key: old -> new". Passwords and
+// tokens are only reported as changed.
+func diffConfig(prev, next *Config) []string {
+	before, after := flattenConfig(prev), flattenConfig(next)
+	keys := []string{}
+	for key := range before {
+		keys = append(keys, key)
+	}
+	for key := range after {
+		if _, ok := before[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+
+	changes := []string{}
+	for _, key := range keys {
+		old, hadOld := before[key]
+		value, hasNew := after[key]
+		switch {
+		case hadOld && hasNew && old == value:
+			continue
+		case strings.HasSuffix(key, ".password") || strings.HasSuffix(key, ".token") || strings.HasSuffix(key, ".secret") || strings.Contains(key, ".env."):
+			changes = append(changes, key+": changed")
+		case !hadOld:
+			changes = append(changes, fmt.Sprintf("%s: added %s", key, value))
+		case !hasNew:
+			changes = append(changes, fmt.Sprintf("%s: removed %s", key, old))
+		default:
+			changes = append(changes, fmt.Sprintf("%s: %s -> %s", key, old, value))
+		}
+	}
+	return changes
+}
+
+// flattenConfig maps every leaf of the config to its dotted key, e.g.
+// "services[0].unit".
+func flattenConfig(c *Config) map[string]string {
+	flat := map[string]string{}
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		return flat
+	}
+	var tree any
+	if err := yaml.Unmarshal(data, &tree); err != nil {
+		return flat
+	}
+
+	var walk func(key string, node any)
+	walk = func(key string, node any) {
+		switch node := node.(type) {
+		case map[string]any:
+			for name, child := range node {
+				if key != "" {
+					name = key + "." + name
+				}
+				walk(name, child)
+			}
+		case []any:
+			if len(node) == 0 {
+				flat[key] = "[]"
+			}
+			for i, child := range node {
+				walk(fmt.Sprintf("%s[%d]", key, i), child)
+			}
+		default:
+			flat[key] = fmt.Sprint(node)
+		}
+	}
+	walk("", tree)
+	return flat
+}
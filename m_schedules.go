@@ -0,0 +1,423 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Actions of scheduled jobs.
+const (
+	scheduleUnmount = "unmount"
+	scheduleEject   = "eject"   // unmount and eject the disk, so it can be unplugged
+	scheduleRemount = "remount" // mount an unmounted drive again
+	scheduleRestart = "restart" // restart a service, autofs by default
+)
+
+var scheduleActions = []string{scheduleUnmount, scheduleEject, scheduleRemount, scheduleRestart}
+
+// jobRun is the last run of a job.
+type jobRun struct {
+	Time  time.Time `json:"time"`
+	User  string    `json:"user"` // schedule, or who pressed run now
+	Error string    `json:"error,omitempty"`
+}
+
+// scheduledJob is a job as listed on the schedules page.
+type scheduledJob struct {
+	ScheduleJob
+	FromUI bool      `json:"fromUI"` // added on the schedules page, not in the config file
+	Next   time.Time `json:"next"`
+	Last   *jobRun   `json:"last,omitempty"`
+}
+
+// Target is the drive or unit the job acts on.
+func (j ScheduleJob) Target() string {
+	if j.Action == scheduleRestart {
+		return j.ServiceUnit()
+	}
+	return j.Drive
+}
+
+func (j ScheduleJob) ServiceUnit() string {
+	if j.Unit == "" {
+		return "autofs"
+	}
+	return j.Unit
+}
+
+// Scope is what a user needs to run the job now.
+func (j ScheduleJob) Scope() string {
+	if j.Action == scheduleRestart {
+		return scopeServiceRestart
+	}
+	return scopeMountUnmount
+}
+
+// Unmounts reports whether running the job leaves its drive unmounted, which
+// needs the same 2FA step-up as an unmount when run by hand.
+func (j ScheduleJob) Unmounts() bool {
+	return j.Action == scheduleUnmount || j.Action == scheduleEject
+}
+
+// schedulerState is the state file: the last runs survive restarts, so runs
+// missed while the service was down can be made up.
+type schedulerState struct {
+	Jobs    []ScheduleJob     `json:"jobs,omitempty"` // added on the schedules page
+	Runs    map[string]jobRun `json:"runs,omitempty"` // by job name
+	Stopped time.Time         `json:"stopped"`
+}
+
+type scheduler struct {
+	path  string
+	mu    sync.Mutex
+	state schedulerState
+}
+
+var schedules = newScheduler("")
+
+func newScheduler(path string) *scheduler {
+	return &scheduler{path: path, state: schedulerState{Runs: map[string]jobRun{}}}
+}
+
+func loadScheduler(path string) (*scheduler, error) {
+	s := newScheduler(path)
+	if path == "" {
+		return s, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schedules %s: %v", path, err)
+	}
+	if err := json.Unmarshal(data, &s.state); err != nil {
+		return nil, fmt.Errorf("failed to parse schedules %s: %v", path, err)
+	}
+	if s.state.Runs == nil {
+		s.state.Runs = map[string]jobRun{}
+	}
+	return s, nil
+}
+
+// save writes the state file. Callers hold s.mu.
+func (s *scheduler) save() {
+	if s.path == "" {
+		return
+	}
+	data, err := json.Marshal(s.state)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(s.path), 0o700)
+	}
+	if err == nil {
+		tmp := s.path + ".tmp"
+		if err = os.WriteFile(tmp, data, 0o600); err == nil {
+			err = os.Rename(tmp, s.path)
+		}
+	}
+	if err != nil {
+		logger.Errorf("[schedules] failed to write %s: %v", s.path, err)
+	}
+}
+
+// Jobs returns the jobs of the config file and the ones added on the page,
+// with their next and last runs.
+func (s *scheduler) Jobs() []scheduledJob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	jobs := []scheduledJob{}
+	add := func(job ScheduleJob, fromUI bool) {
+		j := scheduledJob{ScheduleJob: job, FromUI: fromUI}
+		if cron, err := parseCron(job.Cron); err == nil {
+			j.Next = cron.Next(now)
+		}
+		if run, ok := s.state.Runs[job.Name]; ok {
+			j.Last = &run
+		}
+		jobs = append(jobs, j)
+	}
+	for _, job := range config().Schedules.Jobs {
+		add(job, false)
+	}
+	for _, job := range s.state.Jobs {
+		add(job, true)
+	}
+	return jobs
+}
+
+// Job returns a job by name.
+func (s *scheduler) Job(name string) (scheduledJob, bool) {
+	for _, job := range s.Jobs() {
+		if job.Name == name {
+			return job, true
+		}
+	}
+	return scheduledJob{}, false
+}
+
+// NextFor returns the job that acts on a mount next, nil if there is none.
+func (s *scheduler) NextFor(m Mount) *scheduledJob {
+	var next *scheduledJob
+	for _, job := range s.Jobs() {
+		if job.Action == scheduleRestart || (job.Drive != m.Path && job.Drive != m.UUID) || job.Next.IsZero() {
+			continue
+		}
+		if next == nil || job.Next.Before(next.Next) {
+			next = &job
+		}
+	}
+	return next
+}
+
+// Add adds a job on the schedules page.
+func (s *scheduler) Add(job ScheduleJob) error {
+	if problems := config().validateScheduleJob(job); len(problems) > 0 {
+		return errors.New(strings.Join(problems, ", "))
+	}
+	if _, ok := s.Job(job.Name); ok {
+		return fmt.Errorf("a job named %q exists", job.Name)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state.Jobs = append(s.state.Jobs, job)
+	s.save()
+	return nil
+}
+
+// Remove removes a job added on the schedules page.
+func (s *scheduler) Remove(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := slices.IndexFunc(s.state.Jobs, func(job ScheduleJob) bool { return job.Name == name })
+	if i < 0 {
+		return fmt.Errorf("no job %q added on this page", name)
+	}
+	s.state.Jobs = slices.Delete(s.state.Jobs, i, i+1)
+	delete(s.state.Runs, name)
+	s.save()
+	return nil
+}
+
+// maxReplay is how far the clock may move ahead between two evaluations, e.g.
+// a job that ran long, before the minutes in between are no longer replayed.
+const maxReplay = 5 * time.Minute
+
+// Run runs the jobs when they are due until ctx is done. Runs missed while
+// the service was down are made up if they are younger than
+// schedules.catch_up.
+func (s *scheduler) Run(ctx context.Context) {
+	s.catchUp(ctx)
+	evaluated := time.Now().Truncate(time.Minute)
+	for {
+		select {
+		case <-ctx.Done():
+			s.mu.Lock()
+			s.state.Stopped = time.Now()
+			s.save()
+			s.mu.Unlock()
+			return
+		case <-time.After(time.Until(evaluated.Add(time.Minute))):
+		}
+		// After a suspend or a clock jump every job that was due runs once,
+		// not once for every minute it matched.
+		if now := time.Now(); now.Sub(evaluated) > maxReplay {
+			logger.Warningf("[schedules] clock moved %s ahead, running the jobs due since %s once", now.Sub(evaluated).Round(time.Second), evaluated.Format(time.DateTime))
+			for _, job := range s.Jobs() {
+				if cron, err := parseCron(job.Cron); err == nil && !lastRunBefore(cron, evaluated, now).IsZero() {
+					s.Execute(ctx, job.ScheduleJob, auditEntry{User: "schedule", Source: "schedule"})
+				}
+			}
+			evaluated = now.Truncate(time.Minute)
+			continue
+		}
+		// A minute is never skipped, even if a job ran longer than one.
+		for minute := evaluated.Add(time.Minute); !minute.After(time.Now()); minute = minute.Add(time.Minute) {
+			evaluated = minute
+			for _, job := range s.Jobs() {
+				if cron, err := parseCron(job.Cron); err == nil && cron.Matches(minute) {
+					s.Execute(ctx, job.ScheduleJob, auditEntry{User: "schedule", Source: "schedule"})
+				}
+			}
+		}
+	}
+}
+
+func (s *scheduler) catchUp(ctx context.Context) {
+	now := time.Now()
+	for _, job := range s.Jobs() {
+		s.mu.Lock()
+		since := s.state.Stopped
+		if job.Last != nil && job.Last.Time.After(since) {
+			since = job.Last.Time
+		}
+		s.mu.Unlock()
+		cron, err := parseCron(job.Cron)
+		if since.IsZero() || err != nil {
+			continue
+		}
+		// The latest run that was missed counts, older ones are dropped.
+		missed := lastRunBefore(cron, since, now)
+		if missed.IsZero() {
+			continue
+		}
+		if now.Sub(missed) > config().Schedules.CatchUp {
+			logger.Warningf("[schedules] %s missed its run at %s while the service was down", job.Name, missed.Format(time.DateTime))
+			continue
+		}
+		logger.Infof("[schedules] %s: making up the run at %s", job.Name, missed.Format(time.DateTime))
+		s.Execute(ctx, job.ScheduleJob, auditEntry{User: "schedule", Source: "schedule"})
+	}
+}
+
+// lastRunBefore returns the latest time after since and not after now the
+// schedule was due, or zero if there is none.
+func lastRunBefore(cron *cronSchedule, since, now time.Time) time.Time {
+	var last time.Time
+	for next := cron.Next(since); !next.IsZero() && !next.After(now); next = cron.Next(next) {
+		last = next
+	}
+	return last
+}
+
+// Execute runs a job now. entry is the audit entry with who started it.
+func (s *scheduler) Execute(ctx context.Context, job ScheduleJob, entry auditEntry) error {
+	entry.Action, entry.Target, entry.Outcome = job.Action, job.Target()+" (schedule "+job.Name+")", auditSuccess
+	start := time.Now()
+	var err error
+	if done, ok := operations.Begin("schedule " + job.Name); !ok {
+		err = errors.New("shutting down")
+	} else {
+		err = runScheduledAction(ctx, job, auditEntry{User: entry.User, Token: entry.Token, Source: entry.Source})
+		done()
+		systemStatusCache.Invalidate()
+	}
+	if err != nil {
+		entry.Outcome, entry.Error = auditFailure, err.Error()
+	}
+	audit.Record(entry)
+
+	s.mu.Lock()
+	run := jobRun{Time: start, User: entry.User}
+	if err != nil {
+		run.Error = err.Error()
+	}
+	s.state.Runs[job.Name] = run
+	s.save()
+	s.mu.Unlock()
+
+	if err != nil {
+		notifyScheduleFailure(job, entry.User, err)
+	}
+	return err
+}
+
+// runScheduledAction checks that the action can succeed and runs it. A drive
+// in use is not forced, the job fails with the processes using it.
+func runScheduledAction(ctx context.Context, job ScheduleJob, actor auditEntry) error {
+	user := actor.User
+	status := systemStatusCache.Get(ctx, true)
+	if status.ErrorMounts != nil {
+		return fmt.Errorf("pre-check: failed to list mounts: %v", status.ErrorMounts)
+	}
+	var mount *Mount
+	for i, m := range status.Mounts {
+		if job.Drive != "" && (m.Path == job.Drive || m.UUID == job.Drive) {
+			mount = &status.Mounts[i]
+		}
+	}
+
+	switch job.Action {
+	case scheduleUnmount, scheduleEject:
+		if mount == nil {
+			return fmt.Errorf("pre-check: %w: %s", errNotMounted, job.Drive)
+		}
+		if mount.UsageError != "" {
+			return fmt.Errorf("pre-check: failed to list open files: %s", mount.UsageError)
+		}
+		// A pre-unmount hook may stop what uses the drive, umount tells if it didn't.
+		drive := hookDrive{Device: mount.Device, UUID: mount.UUID, Path: mount.Path}
+		if blockers := uniqueBlockers(mount.Usages); len(blockers) > 0 && !hooksApply(hookPreUnmount, drive) {
+			return fmt.Errorf("pre-check: in use by %s", describeBlockers(blockers))
+		}
+		disk := wholeDisk(mount.Device)
+		if job.Action == scheduleEject {
+			for _, m := range status.Mounts {
+				if m.Path != mount.Path && wholeDisk(m.Device) == disk {
+					return fmt.Errorf("pre-check: %s of the same disk is mounted too", m.Path)
+				}
+			}
+		}
+		_, err := unmountWithHooks(ctx, mount.Path, actor)
+		history.RecordUnmount(mount.Path, user, err)
+		if err != nil || job.Action == scheduleUnmount {
+			return err
+		}
+		return ejectDisk(ctx, disk)
+
+	case scheduleRemount:
+		if mount != nil {
+			return fmt.Errorf("pre-check: %s is mounted already", mount.Path)
+		}
+		path, uuid := job.Drive, ""
+		if !strings.HasPrefix(path, "/") {
+			uuid = path
+			drive, ok := history.Drive(uuid)
+			if !ok {
+				return fmt.Errorf("pre-check: drive %s was never mounted, its mount path is unknown", uuid)
+			}
+			path = drive.Path
+		} else {
+			for _, drive := range history.Drives() {
+				if drive.Path == path {
+					uuid = drive.UUID
+				}
+			}
+		}
+		if attached, err := attachedDrives(); err == nil && uuid != "" && !config().DevMode {
+			if _, ok := attached[uuid]; !ok {
+				return fmt.Errorf("pre-check: drive %s is not attached", uuid)
+			}
+		}
+		return mountPath(ctx, path)
+
+	case scheduleRestart:
+		unit := job.ServiceUnit()
+		err := restartService(unit)
+		history.RecordRestart(unit, user, err)
+		return err
+	}
+	return fmt.Errorf("unknown action %q", job.Action)
+}
+
+// notifyScheduleFailure sends a failed run to the channels of the job.
+func notifyScheduleFailure(job ScheduleJob, user string, err error) {
+	logger.Errorf("[schedules] %s (%s %s) failed: %v", job.Name, job.Action, job.Target(), err)
+	channels := job.Notify
+	if len(channels) == 0 {
+		channels = scheduleChannels
+	}
+	if slices.Contains(channels, channelWebhook) {
+		webhooks.Emit(webhookScheduleFailed, webhookScheduleData{Name: job.Name, Action: job.Action, Target: job.Target(), User: user, Error: err.Error()})
+	}
+	if slices.Contains(channels, channelEmail) && len(config().Alerts.Email.To) > 0 {
+		go func() {
+			subject := fmt.Sprintf("[unmounter] scheduled %s of %s failed", job.Action, job.Target())
+			body := fmt.Sprintf("%v\n\nJob:    %s (%s)\nAction: %s %s\nBy:     %s\n", err, job.Name, job.Cron, job.Action, job.Target(), user)
+			if err := sendEmail(subject, body); err != nil {
+				logger.Errorf("[schedules] failed to send email for %s: %v", job.Name, err)
+			}
+		}()
+	}
+}
+
+var scheduleChannels = []string{channelWebhook, channelEmail}
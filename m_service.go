@@ -2,88 +2,180 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"strconv"
+	"time"
 
 	"github.com/kardianos/service"
 )
 
-var serviceConfig = &service.Config{
-	Name:        "unmounter",
-	DisplayName: "unmounter",
-	Description: "A web service to list and unmount devices.",
-	UserName:    "unmounter",
-	EnvVars: map[string]string{
-		EnvVarAuthUser: username,
-		EnvVarAuthPass: password,
-		EnvVarDevMode:  strconv.FormatBool(devModeEnabled),
-	},
+// newServiceConfig describes the installed service. It is started with the
+// same config file; environment variables that are set during install are
+// passed on as well.
+func newServiceConfig() *service.Config {
+	serviceConfig := &service.Config{
+		Name:        "unmounter",
+		DisplayName: "unmounter",
+		Description: "A web service to list and unmount devices.",
+		UserName:    "unmounter",
+		EnvVars:     map[string]string{},
+		Option: service.KeyValue{
+			"SystemdScript": systemdScript(),
+			"ReloadSignal":  "HUP",
+		},
+	}
+	if configFile != "" {
+		serviceConfig.Arguments = []string{"-config", configFile}
+	}
+	for _, name := range []string{EnvVarAuthUser, EnvVarAuthPass, EnvVarDevMode, EnvVarKeysFile, EnvVarKeysGracePeriod,
+		EnvVarListenAddr, EnvVarTLSEnabled, EnvVarTLSCertFile, EnvVarTLSKeyFile, EnvVarHTTPRedirectAddr, EnvVarTokensFile,
+		EnvVarAuthMaxFailures, EnvVarAuthLockout, EnvVarAuthMaxLockout, EnvVarActionRateLimit, EnvVarTOTPFile, EnvVarTOTPMode} {
+		if value, ok := os.LookupEnv(name); ok {
+			serviceConfig.EnvVars[name] = value
+		}
+	}
+	return serviceConfig
 }
 
-type systemService struct{}
+// systemdScript is the unit template of kardianos/service with Type=notify,
+// so systemd knows when the server listens and waits for the shutdown.
+func systemdScript() string {
+	stopTimeout := strconv.Itoa(int((config().Timeouts.Shutdown + 10*time.Second).Seconds()))
+	return `[Unit]
+Description={{.Description}}
+ConditionFileIsExecutable={{.Path|cmdEscape}}
+After=network.target autofs.service
+
+[Service]
+Type=notify
+NotifyAccess=main
+StartLimitInterval=5
+StartLimitBurst=10
+ExecStart={{.Path|cmdEscape}}{{range .Arguments}} {{.|cmd}}{{end}}
+{{if .UserName}}User={{.UserName}}{{end}}
+AmbientCapabilities=CAP_KILL
+{{if .ReloadSignal}}ExecReload=/bin/kill -{{.ReloadSignal}} "$MAINPID"{{end}}
+TimeoutStopSec=` + stopTimeout + `
+Restart=always
+RestartSec=10
+EnvironmentFile=-/etc/sysconfig/{{.Name}}
+
+{{range $k, $v := .EnvVars -}}
+Environment={{$k}}={{$v}}
+{{end -}}
+
+[Install]
+WantedBy=multi-user.target
+`
+}
+
+type systemService struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
 
 func (p *systemService) Start(s service.Service) error {
 	// Start should not block. Do the actual work async.
-	go p.run()
+	ctx, cancel := context.WithCancel(context.Background())
+	p.cancel = cancel
+	p.done = make(chan struct{})
+	go p.run(ctx)
 	return nil
 }
 
-func (p *systemService) run() {
-	runWebServer()
+func (p *systemService) run(ctx context.Context) {
+	defer close(p.done)
+	if err := runWebServer(ctx); err != nil {
+		logger.Error(err)
+		// Exit so systemd restarts the service instead of leaving it idle.
+		sdNotify("STOPPING=1")
+		os.Exit(exitFailure)
+	}
 }
 
+// Stop shuts the web server down and blocks until running operations are
+// drained or the shutdown deadline passed.
 func (p *systemService) Stop(s service.Service) error {
-	// Any clean-up or resource release logic here.
-	return nil
+	sdNotify("STOPPING=1")
+	p.cancel()
+	select {
+	case <-p.done:
+		return nil
+	case <-time.After(config().Timeouts.Shutdown + 5*time.Second):
+		return fmt.Errorf("shutdown did not finish within %s", config().Timeouts.Shutdown)
+	}
 }
 
-func handleServiceArgs(s service.Service) {
-	if len(os.Args) < 2 {
-		fmt.Println("Usage: myservice <command>")
-		fmt.Println("Commands: install, uninstall, start, stop, restart")
-		return
+// handleServiceArgs runs a CLI command and returns the process exit code.
+func handleServiceArgs(s service.Service, args []string) int {
+	if len(args) < 1 {
+		fmt.Println(cliUsage)
+		return exitUsage
 	}
-	cmd := os.Args[1]
+	cmd := args[0]
 	switch cmd {
+	case "status":
+		return handleStatusArgs(args[1:])
+	case "unmount":
+		return handleUnmountArgs(args[1:])
+	case "kill":
+		return handleKillArgs(args[1:])
+	case "doctor":
+		return handleDoctorArgs(args[1:])
 	case "install":
 		err := s.Install()
 		if err != nil {
 			fmt.Println("Failed to install:", err)
-			return
+			return exitFailure
 		}
 		fmt.Println("Service installed")
 	case "uninstall":
 		err := s.Uninstall()
 		if err != nil {
 			fmt.Println("Failed to uninstall:", err)
-			return
+			return exitFailure
 		}
 		fmt.Println("Service uninstalled")
 	case "start":
 		err := s.Start()
 		if err != nil {
 			fmt.Println("Failed to start:", err)
-			return
+			return exitFailure
 		}
 		fmt.Println("Service started")
 	case "stop":
 		err := s.Stop()
 		if err != nil {
 			fmt.Println("Failed to stop:", err)
-			return
+			return exitFailure
 		}
 		fmt.Println("Service stopped")
 	case "restart":
 		err := s.Restart()
 		if err != nil {
 			fmt.Println("Failed to restart:", err)
-			return
+			return exitFailure
 		}
 		fmt.Println("Service restarted")
+	case "token":
+		return handleTokenArgs(args[1:])
+	case "2fa":
+		return handleTOTPArgs(args[1:])
+	case "rotate-keys":
+		_, err := rotateKeyRing(config().Auth.KeysFile)
+		auditCLI("keys.rotate", config().Auth.KeysFile, err)
+		if err != nil {
+			fmt.Println("Failed to rotate keys:", err)
+			return exitFailure
+		}
+		fmt.Println("Keys rotated in", config().Auth.KeysFile)
+		fmt.Println("Restart the service to apply them, the previous keys stay valid for", config().Auth.KeysGracePeriod)
 	default:
 		fmt.Println("Invalid command")
-		fmt.Println("Usage: myservice <command>")
-		fmt.Println("Commands: install, uninstall, start, stop, restart")
+		fmt.Println(cliUsage)
+		return exitUsage
 	}
+	return exitOK
 }
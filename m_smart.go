@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// smartReport is the SMART data of one disk as shown on the drive cards.
+type smartReport struct {
+	Disk         string        `json:"disk"`
+	Model        string        `json:"model,omitempty"`
+	Serial       string        `json:"serial,omitempty"`
+	Source       string        `json:"source,omitempty"` // sg_io or smartctl, empty if nothing was read yet
+	Passed       bool          `json:"passed"`
+	Temperature  int           `json:"temperature,omitempty"` // °C
+	PowerOnHours int           `json:"powerOnHours,omitempty"`
+	Reallocated  int64         `json:"reallocatedSectors"`
+	Pending      int64         `json:"pendingSectors"`
+	SelfTest     smartSelfTest `json:"selfTest"`
+	Messages     []string      `json:"messages,omitempty"` // warnings of smartctl
+	Standby      bool          `json:"standby,omitempty"`  // spun down at the last check, the values are from ReadAt
+	ReadAt       time.Time     `json:"readAt"`
+	CheckedAt    time.Time     `json:"checkedAt"`
+	Error        string        `json:"error,omitempty"`
+}
+
+type smartSelfTest struct {
+	Running    bool   `json:"running"`
+	Remaining  int    `json:"remainingPercent,omitempty"`
+	Last       string `json:"last,omitempty"` // e.g. "Short offline: Completed without error"
+	LastHours  int    `json:"lastHours,omitempty"`
+	LastPassed bool   `json:"lastPassed"`
+}
+
+// Warnings lists what needs attention, empty for a healthy disk or one that
+// could not be read.
+func (r *smartReport) Warnings() []string {
+	if r == nil || r.Source == "" || r.Error != "" {
+		return nil
+	}
+	warnings := []string{}
+	if !r.Passed {
+		warnings = append(warnings, "overall health FAILED")
+	}
+	if r.Reallocated > 0 {
+		warnings = append(warnings, fmt.Sprintf("%d reallocated sectors", r.Reallocated))
+	}
+	if r.Pending > 0 {
+		warnings = append(warnings, fmt.Sprintf("%d pending sectors", r.Pending))
+	}
+	if r.SelfTest.Last != "" && !r.SelfTest.LastPassed && !r.SelfTest.Running {
+		warnings = append(warnings, "last self-test: "+r.SelfTest.Last)
+	}
+	return append(warnings, r.Messages...)
+}
+
+// smartCache keeps the last report per disk. Reading SMART takes a while and
+// wakes nothing up, so it is refreshed in the background every smart.interval
+// and every minute while a self-test runs.
+type smartCache struct {
+	mu         sync.Mutex
+	reports    map[string]*smartReport // by disk, replaced and never modified
+	refreshing map[string]bool
+}
+
+var smartReports = &smartCache{reports: map[string]*smartReport{}, refreshing: map[string]bool{}}
+
+// Get returns the last report of a disk, nil if there is none yet or SMART
+// is disabled, and starts a refresh if it is due.
+func (c *smartCache) Get(disk string) *smartReport {
+	if !config().SMART.Enabled {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	report := c.reports[disk]
+	maxAge := config().SMART.Interval
+	if report != nil && report.SelfTest.Running {
+		maxAge = min(maxAge, time.Minute)
+	}
+	if (report == nil || time.Since(report.CheckedAt) >= maxAge) && !c.refreshing[disk] {
+		c.refreshing[disk] = true
+		go c.refresh(disk)
+	}
+	return report
+}
+
+func (c *smartCache) refresh(disk string) {
+	ctx, cancel := context.WithTimeout(context.Background(), config().Timeouts.Command)
+	defer cancel()
+	report := readSMART(ctx, disk)
+	report.Disk, report.CheckedAt = disk, time.Now()
+	if report.Error != "" {
+		logger.Warningf("[smart] %s: %s", disk, report.Error)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if prev := c.reports[disk]; report.Standby && prev != nil && prev.Source != "" {
+		kept := *prev
+		kept.Standby, kept.CheckedAt = true, report.CheckedAt
+		report = &kept
+	}
+	c.reports[disk] = report
+	c.refreshing[disk] = false
+}
+
+// Forget drops the report of a disk so the next Get reads it again.
+func (c *smartCache) Forget(disk string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if report, ok := c.reports[disk]; ok {
+		stale := *report
+		stale.CheckedAt = time.Time{}
+		c.reports[disk] = &stale
+	}
+}
+
+// readSMART reads a disk by ATA pass-through, which needs CAP_SYS_RAWIO, and
+// otherwise with smartctl through sudo. A disk in standby is not woken up.
+func readSMART(ctx context.Context, disk string) *smartReport {
+	if config().DevMode {
+		return readSMARTDevMode(disk)
+	}
+	report, err := readSMARTNative(disk)
+	if err == nil {
+		return report
+	}
+	report, smartctlErr := readSMARTSmartctl(ctx, disk)
+	if smartctlErr != nil {
+		return &smartReport{Error: fmt.Sprintf("%v (sg_io: %v)", smartctlErr, err)}
+	}
+	return report
+}
+
+func readSMARTSmartctl(ctx context.Context, disk string) (*smartReport, error) {
+	output, err := runCommandContext(ctx, true, config().Commands.Smartctl, "--json", "-a", "-n", "standby", "--", disk)
+	var result struct {
+		Smartctl struct {
+			Messages []struct {
+				String   string `json:"string"`
+				Severity string `json:"severity"`
+			} `json:"messages"`
+		} `json:"smartctl"`
+		ModelName    string `json:"model_name"`
+		SerialNumber string `json:"serial_number"`
+		PowerMode    string `json:"power_mode"`
+		SmartStatus  *struct {
+			Passed bool `json:"passed"`
+		} `json:"smart_status"`
+		Temperature struct {
+			Current int `json:"current"`
+		} `json:"temperature"`
+		PowerOnTime struct {
+			Hours int `json:"hours"`
+		} `json:"power_on_time"`
+		ATASmartData struct {
+			SelfTest struct {
+				Status struct {
+					Value            int `json:"value"`
+					RemainingPercent int `json:"remaining_percent"`
+				} `json:"status"`
+			} `json:"self_test"`
+		} `json:"ata_smart_data"`
+		ATASmartAttributes struct {
+			Table []struct {
+				ID  int `json:"id"`
+				Raw struct {
+					Value int64 `json:"value"`
+				} `json:"raw"`
+			} `json:"table"`
+		} `json:"ata_smart_attributes"`
+		ATASelfTestLog struct {
+			Standard struct {
+				Table []struct {
+					Type struct {
+						String string `json:"string"`
+					} `json:"type"`
+					Status struct {
+						String string `json:"string"`
+						Passed *bool  `json:"passed"`
+					} `json:"status"`
+					LifetimeHours int `json:"lifetime_hours"`
+				} `json:"table"`
+			} `json:"standard"`
+		} `json:"ata_smart_self_test_log"`
+	}
+	// smartctl reports the disk status in its exit status, the JSON is still valid.
+	if jsonErr := json.Unmarshal(output, &result); jsonErr != nil {
+		if err == nil {
+			err = jsonErr
+		}
+		return nil, fmt.Errorf("smartctl: %v", err)
+	}
+
+	report := &smartReport{Source: "smartctl", Model: result.ModelName, Serial: result.SerialNumber, ReadAt: time.Now()}
+	standby := strings.Contains(strings.ToUpper(result.PowerMode), "STANDBY")
+	for _, m := range result.Smartctl.Messages {
+		standby = standby || strings.Contains(m.String, "STANDBY")
+		if m.Severity != "information" {
+			report.Messages = append(report.Messages, m.String)
+		}
+	}
+	if result.SmartStatus == nil {
+		if standby {
+			return &smartReport{Standby: true}, nil
+		}
+		return nil, fmt.Errorf("smartctl: no SMART data: %s", strings.Join(report.Messages, "; "))
+	}
+
+	report.Passed = result.SmartStatus.Passed
+	report.Temperature = result.Temperature.Current
+	report.PowerOnHours = result.PowerOnTime.Hours
+	for _, attribute := range result.ATASmartAttributes.Table {
+		switch attribute.ID {
+		case 5:
+			report.Reallocated = attribute.Raw.Value
+		case 197:
+			report.Pending = attribute.Raw.Value
+		}
+	}
+	if status := result.ATASmartData.SelfTest.Status; status.Value>>4 == 0xf {
+		report.SelfTest.Running, report.SelfTest.Remaining = true, status.RemainingPercent
+	}
+	if log := result.ATASelfTestLog.Standard.Table; len(log) > 0 {
+		report.SelfTest.Last = log[0].Type.String + ": " + log[0].Status.String
+		report.SelfTest.LastHours = log[0].LifetimeHours
+		report.SelfTest.LastPassed = log[0].Status.Passed == nil || *log[0].Status.Passed
+	}
+	return report, nil
+}
+
+// startSelfTest starts a short or long self-test on the disk of a managed
+// mount. The disk keeps working while it runs.
+func startSelfTest(ctx context.Context, path, kind string) error {
+	device := ""
+	for _, m := range systemStatusCache.Get(ctx, false).Mounts {
+		if m.Path == path {
+			device = m.Device
+		}
+	}
+	if device == "" {
+		return errNotMounted
+	}
+	disk := wholeDisk(device)
+	defer smartReports.Forget(disk)
+
+	if config().DevMode {
+		return startSelfTestDevMode(disk)
+	}
+	err := startSelfTestNative(disk, kind)
+	if err == nil {
+		return nil
+	}
+	output, smartctlErr := runCommandContext(ctx, true, config().Commands.Smartctl, "-t", kind, "--", disk)
+	if smartctlErr != nil {
+		return fmt.Errorf("smartctl: %v: %s (sg_io: %v)", smartctlErr, lastLine(string(output)), err)
+	}
+	return nil
+}
+
+func lastLine(output string) string {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	return lines[len(lines)-1]
+}
+
+// wholeDisk returns the disk of a partition, e.g. /dev/sda for /dev/sda1.
+func wholeDisk(device string) string {
+	name := filepath.Base(device)
+	sysPath, err := filepath.EvalSymlinks(filepath.Join("/sys/class/block", name))
+	if err != nil {
+		if config().DevMode {
+			return strings.TrimRight(device, "0123456789")
+		}
+		return device
+	}
+	if _, err := os.Stat(filepath.Join(sysPath, "partition")); errors.Is(err, os.ErrNotExist) {
+		return device
+	}
+	return filepath.Join(filepath.Dir(device), filepath.Base(filepath.Dir(sysPath)))
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// SMART over SG_IO with SCSI/ATA Translation (SAT) ATA PASS-THROUGH(16),
+// which most USB bridges understand. Sending it needs CAP_SYS_RAWIO, so as
+// the service user readSMART falls back to smartctl through sudo.
+
+const (
+	sgIO           = 0x2285
+	sgDxferNone    = -1
+	sgDxferFromDev = -3
+
+	ataPassThrough16 = 0x85
+	ataProtoNonData  = 3
+	ataProtoPIOIn    = 4
+	ataFlagsDataIn   = 0x0e // t_dir from device, byt_blok, length in sector count
+	ataFlagsCheck    = 0x20 // ck_cond: return the ATA registers in the sense data
+
+	ataSMART            = 0xb0
+	ataIdentify         = 0xec
+	ataCheckPowerMode   = 0xe5
+	ataStandbyImmediate = 0xe0
+
+	smartReadData       = 0xd0
+	smartReadLog        = 0xd5
+	smartExecuteOffline = 0xd4
+	smartReturnStatus   = 0xda
+	smartSelfTestLog    = 0x06
+)
+
+// sgIOHdr is struct sg_io_hdr of <scsi/sg.h>; uintptr keeps the C layout on
+// 32 and 64 bit.
+type sgIOHdr struct {
+	InterfaceID    int32
+	DxferDirection int32
+	CmdLen         uint8
+	MxSbLen        uint8
+	IovecCount     uint16
+	DxferLen       uint32
+	Dxferp         uintptr
+	Cmdp           uintptr
+	Sbp            uintptr
+	Timeout        uint32
+	Flags          uint32
+	PackID         int32
+	UsrPtr         uintptr
+	Status         uint8
+	MaskedStatus   uint8
+	MsgStatus      uint8
+	SbLenWr        uint8
+	HostStatus     uint16
+	DriverStatus   uint16
+	Resid          int32
+	Duration       uint32
+	Info           uint32
+}
+
+type ataDevice struct {
+	fd int
+}
+
+func openATA(disk string) (*ataDevice, error) {
+	fd, err := syscall.Open(disk, syscall.O_RDONLY|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &ataDevice{fd: fd}, nil
+}
+
+func (d *ataDevice) Close() error {
+	return syscall.Close(d.fd)
+}
+
+// command sends an ATA command and returns the ATA status return descriptor
+// of the sense data, nil if the device sent none.
+func (d *ataDevice) command(protocol, flags, features, count, lbaLow, command byte, data []byte) ([]byte, error) {
+	cdb := []byte{ataPassThrough16, protocol << 1, flags, 0, features, 0, count, 0, lbaLow, 0, 0x4f, 0, 0xc2, 0, command, 0}
+	sense := make([]byte, 32)
+	hdr := sgIOHdr{InterfaceID: 'S', DxferDirection: sgDxferNone, CmdLen: uint8(len(cdb)), MxSbLen: uint8(len(sense)), Timeout: 20000}
+
+	var pinner runtime.Pinner
+	defer pinner.Unpin()
+	pinner.Pin(&cdb[0])
+	pinner.Pin(&sense[0])
+	hdr.Cmdp, hdr.Sbp = uintptr(unsafe.Pointer(&cdb[0])), uintptr(unsafe.Pointer(&sense[0]))
+	if len(data) > 0 {
+		pinner.Pin(&data[0])
+		hdr.DxferDirection, hdr.DxferLen, hdr.Dxferp = sgDxferFromDev, uint32(len(data)), uintptr(unsafe.Pointer(&data[0]))
+	}
+
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(d.fd), sgIO, uintptr(unsafe.Pointer(&hdr))); errno != 0 {
+		return nil, errno
+	}
+	if hdr.HostStatus != 0 || hdr.DriverStatus&^0x08 != 0 { // DRIVER_SENSE only means there is sense data
+		return nil, fmt.Errorf("host status %#x, driver status %#x", hdr.HostStatus, hdr.DriverStatus)
+	}
+	descriptor := ataStatusDescriptor(sense[:hdr.SbLenWr])
+	if hdr.Status != 0 && descriptor == nil {
+		return nil, fmt.Errorf("scsi status %#x, sense %x", hdr.Status, sense[:hdr.SbLenWr])
+	}
+	if descriptor != nil && descriptor[13]&0x01 != 0 {
+		return nil, fmt.Errorf("ata command %#x aborted, error %#x", command, descriptor[3])
+	}
+	return descriptor, nil
+}
+
+// ataStatusDescriptor finds the ATA status return descriptor (type 9) in
+// descriptor format sense data.
+func ataStatusDescriptor(sense []byte) []byte {
+	if len(sense) < 8 || sense[0]&0x7f != 0x72 {
+		return nil
+	}
+	for i := 8; i+1 < len(sense); i += 2 + int(sense[i+1]) {
+		if sense[i] == 0x09 && i+14 <= len(sense) {
+			return sense[i : i+14]
+		}
+	}
+	return nil
+}
+
+func (d *ataDevice) standby() (bool, error) {
+	descriptor, err := d.command(ataProtoNonData, ataFlagsCheck, 0, 0, 0, ataCheckPowerMode, nil)
+	if err != nil {
+		return false, err
+	}
+	if descriptor == nil {
+		return false, errors.New("no ATA registers returned, the bridge does not support SAT")
+	}
+	return descriptor[5] == 0x00, nil // sector count: 0x00 standby, 0x80 idle, 0xff active
+}
+
+func (d *ataDevice) read(features, lbaLow, command byte) ([]byte, error) {
+	data := make([]byte, 512)
+	_, err := d.command(ataProtoPIOIn, ataFlagsDataIn, features, 1, lbaLow, command, data)
+	return data, err
+}
+
+// ataString decodes an IDENTIFY string, which has the bytes of each word swapped.
+func ataString(data []byte) string {
+	swapped := make([]byte, len(data))
+	for i := 0; i+1 < len(data); i += 2 {
+		swapped[i], swapped[i+1] = data[i+1], data[i]
+	}
+	return strings.TrimSpace(string(swapped))
+}
+
+var ataSelfTestTypes = map[byte]string{1: "Short offline", 2: "Extended offline", 3: "Conveyance offline", 0x81: "Short captive", 0x82: "Extended captive", 0x83: "Conveyance captive"}
+
+var ataSelfTestStatus = map[byte]string{
+	0: "Completed without error", 1: "Aborted by host", 2: "Interrupted by reset", 3: "Fatal error",
+	4: "Completed: unknown failure", 5: "Completed: electrical failure", 6: "Completed: servo/seek failure",
+	7: "Completed: read failure", 8: "Completed: handling damage", 15: "In progress",
+}
+
+func readSMARTNative(disk string) (*smartReport, error) {
+	d, err := openATA(disk)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+
+	if standby, err := d.standby(); err != nil {
+		return nil, err
+	} else if standby {
+		return &smartReport{Standby: true}, nil
+	}
+
+	report := &smartReport{Source: "sg_io", ReadAt: time.Now()}
+	identify, err := d.read(0, 0, ataIdentify)
+	if err != nil {
+		return nil, err
+	}
+	report.Serial, report.Model = ataString(identify[20:40]), ataString(identify[54:94])
+
+	status, err := d.command(ataProtoNonData, ataFlagsCheck, smartReturnStatus, 0, 0, ataSMART, nil)
+	if err != nil {
+		return nil, err
+	}
+	if status == nil {
+		return nil, errors.New("no SMART status returned")
+	}
+	report.Passed = !(status[9] == 0xf4 && status[11] == 0x2c) // LBA mid/high 4f/c2 passed, f4/2c threshold exceeded
+
+	data, err := d.read(smartReadData, 0, ataSMART)
+	if err != nil {
+		return nil, err
+	}
+	for i := 2; i+12 <= 362; i += 12 {
+		attribute := data[i : i+12]
+		raw := int64(binary.LittleEndian.Uint32(attribute[5:9]))
+		switch attribute[0] {
+		case 5:
+			report.Reallocated = raw
+		case 9:
+			report.PowerOnHours = int(raw)
+		case 194:
+			report.Temperature = int(attribute[5])
+		case 190:
+			if report.Temperature == 0 {
+				report.Temperature = int(attribute[5])
+			}
+		case 197:
+			report.Pending = raw
+		}
+	}
+	if execution := data[363]; execution>>4 == 0xf {
+		report.SelfTest.Running, report.SelfTest.Remaining = true, int(execution&0x0f)*10
+	}
+
+	log, err := d.read(smartReadLog, smartSelfTestLog, ataSMART)
+	if err != nil {
+		return report, nil // the self-test log is optional
+	}
+	if index := int(log[508]); index >= 1 && index <= 21 {
+		entry := log[2+(index-1)*24:]
+		result := entry[1] >> 4
+		testType, ok := ataSelfTestTypes[entry[0]]
+		if !ok {
+			testType = fmt.Sprintf("Type %#x", entry[0])
+		}
+		report.SelfTest.Last = testType + ": " + ataSelfTestStatus[result]
+		report.SelfTest.LastHours = int(binary.LittleEndian.Uint16(entry[2:4]))
+		report.SelfTest.LastPassed = result <= 2 || result == 15
+	}
+	return report, nil
+}
+
+func startSelfTestNative(disk, kind string) error {
+	d, err := openATA(disk)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	subcommand := byte(1) // short offline
+	if kind == "long" {
+		subcommand = 2
+	}
+	_, err = d.command(ataProtoNonData, 0, smartExecuteOffline, 0, subcommand, ataSMART, nil)
+	return err
+}
+
+func standbyNative(disk string) error {
+	d, err := openATA(disk)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	_, err = d.command(ataProtoNonData, 0, 0, 0, 0, ataStandbyImmediate, nil)
+	return err
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// statusCache keeps the last collected status for the configured TTL and
+// lets concurrent callers share one running collection, so several browser
+// tabs and pollers don't fork the probes again and again.
+type statusCache struct {
+	mu         sync.Mutex
+	status     *SystemStatus
+	started    time.Time // when the collection of status started
+	generation uint64    // bumped by Invalidate
+	inflight   *statusCall
+}
+
+// statusCall is a running collection. It is cancelled when all callers
+// waiting for it went away.
+type statusCall struct {
+	done       chan struct{}
+	status     *SystemStatus
+	started    time.Time
+	generation uint64
+	waiters    int
+	cancel     context.CancelFunc
+}
+
+var systemStatusCache = &statusCache{}
+
+// Get returns a status that is at most the TTL old. fresh skips the cached
+// value and only joins a collection that started after the call, other
+// callers keep using the cache.
+func (c *statusCache) Get(ctx context.Context, fresh bool) *SystemStatus {
+	requested := time.Now()
+	c.mu.Lock()
+	if !fresh && c.status != nil && time.Since(c.status.CollectedAt) < config().Timeouts.StatusCache {
+		status := c.status
+		c.mu.Unlock()
+		return status
+	}
+
+	call := c.inflight
+	if call == nil || call.generation != c.generation || (fresh && call.started.Before(requested)) {
+		collectCtx, cancel := context.WithCancel(context.Background())
+		call = &statusCall{done: make(chan struct{}), started: time.Now(), generation: c.generation, cancel: cancel}
+		c.inflight = call
+		go c.collect(collectCtx, call)
+	}
+	call.waiters++
+	c.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.status
+	case <-ctx.Done():
+		c.mu.Lock()
+		call.waiters--
+		if call.waiters == 0 {
+			// Later callers start a new collection instead of joining this one.
+			call.cancel()
+			if c.inflight == call {
+				c.inflight = nil
+			}
+		}
+		c.mu.Unlock()
+		<-call.done
+		return call.status
+	}
+}
+
+func (c *statusCache) collect(ctx context.Context, call *statusCall) {
+	status := getSystemStatus(ctx)
+	canceled := ctx.Err() != nil
+	call.cancel()
+
+	c.mu.Lock()
+	call.status = status
+	// A collection cancelled by its callers is incomplete, don't keep it. One
+	// that overlapped an action may show the state before it, and one that
+	// started before the cached status is older than it.
+	current := !canceled && call.generation == c.generation && !call.started.Before(c.started)
+	if current {
+		c.status, c.started = status, call.started
+	}
+	if c.inflight == call {
+		c.inflight = nil
+	}
+	close(call.done)
+	c.mu.Unlock()
+
+	if current {
+		history.Observe(status)
+		webhooks.Observe(status)
+	}
+}
+
+// Invalidate drops the cached status, e.g. after an unmount changed it.
+func (c *statusCache) Invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.status = nil
+	c.generation++
+}
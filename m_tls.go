@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const selfSignedOrganization = "unmounter self-signed"
+const selfSignedValidity = 825 * 24 * time.Hour
+const certCheckInterval = 10 * time.Second
+
+// ensureSelfSignedCert generates a self-signed certificate for this host if
+// neither the certificate nor the key file exist yet. User provided files are
+// left untouched.
+func ensureSelfSignedCert(certFile, keyFile string) error {
+	_, certErr := os.Stat(certFile)
+	_, keyErr := os.Stat(keyFile)
+	if certErr == nil && keyErr == nil {
+		return nil
+	}
+	if !errors.Is(certErr, fs.ErrNotExist) || !errors.Is(keyErr, fs.ErrNotExist) {
+		return fmt.Errorf("only one of %s and %s exists", certFile, keyFile)
+	}
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	dnsNames, ips := hostSANs()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: dnsNames[0], Organization: []string{selfSignedOrganization}},
+		DNSNames:              dnsNames,
+		IPAddresses:           ips,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(keyFile), 0o700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		return err
+	}
+	return os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}), 0o644)
+}
+
+// hostSANs collects the hostnames and interface addresses the self-signed
+// certificate should be valid for.
+func hostSANs() ([]string, []net.IP) {
+	dnsNames := []string{}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		dnsNames = append(dnsNames, hostname, hostname+".local")
+	}
+	dnsNames = append(dnsNames, "localhost")
+
+	ips := []net.IP{}
+	addrs, err := net.InterfaceAddrs()
+	if err == nil {
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLinkLocalUnicast() {
+				ips = append(ips, ipNet.IP)
+			}
+		}
+	}
+	if len(ips) == 0 {
+		ips = append(ips, net.IPv4(127, 0, 0, 1), net.IPv6loopback)
+	}
+	return dnsNames, ips
+}
+
+// certReloader serves the certificate from disk and picks up replaced files
+// without a restart.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	checkedAt time.Time
+}
+
+var certs *certReloader
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{}
+	if err := c.load(certFile, keyFile); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// SetFiles switches to another certificate and key, generating a self-signed
+// pair if neither exists. The current certificate stays in use on errors.
+func (c *certReloader) SetFiles(certFile, keyFile string) error {
+	if err := ensureSelfSignedCert(certFile, keyFile); err != nil {
+		return err
+	}
+	return c.load(certFile, keyFile)
+}
+
+func (c *certReloader) load(certFile, keyFile string) error {
+	modTime, err := pairModTime(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate %s: %v", certFile, err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.certFile, c.keyFile = certFile, keyFile
+	c.cert = &cert
+	c.modTime = modTime
+	c.checkedAt = time.Now()
+	return nil
+}
+
+// pairModTime returns the newer modification time of certificate and key,
+// renewals may replace them one after the other.
+func pairModTime(certFile, keyFile string) (time.Time, error) {
+	certInfo, err := os.Stat(certFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+	keyInfo, err := os.Stat(keyFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if keyInfo.ModTime().After(certInfo.ModTime()) {
+		return keyInfo.ModTime(), nil
+	}
+	return certInfo.ModTime(), nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate. The certificate and
+// key files are checked for changes at most every certCheckInterval; if loading a
+// changed file fails the previous certificate stays in use.
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	cert := c.cert
+	due := time.Since(c.checkedAt) > certCheckInterval
+	if due {
+		c.checkedAt = time.Now()
+	}
+	certFile, keyFile, modTime := c.certFile, c.keyFile, c.modTime
+	c.mu.Unlock()
+
+	if !due {
+		return cert, nil
+	}
+	changed, err := pairModTime(certFile, keyFile)
+	if err != nil || !changed.After(modTime) {
+		return cert, nil
+	}
+	if err := c.load(certFile, keyFile); err != nil {
+		logger.Error("Failed to reload TLS certificate:", err)
+		return cert, nil
+	}
+	logger.Infof("Reloaded TLS certificate from %s", certFile)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cert, nil
+}
+
+// redirectToHTTPS answers every request with a redirect to the same path on
+// the HTTPS listener.
+func redirectToHTTPS(httpsAddr string) http.HandlerFunc {
+	_, httpsPort, _ := net.SplitHostPort(httpsAddr)
+	return func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		if httpsPort != "" && httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const tokenPrefix = "umt_"
+
+// apiToken is a token for automation clients. Only the SHA-256 hash of the
+// secret is stored; the plain token is shown once when it is created.
+type apiToken struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	SecretHash string     `json:"secretHash"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+}
+
+func (t *apiToken) Expired() bool {
+	return t.ExpiresAt != nil && time.Now().After(*t.ExpiresAt)
+}
+
+func (t *apiToken) ScopeList() string {
+	return strings.Join(t.Scopes, ", ")
+}
+
+// tokenStore keeps the tokens in a JSON file. The file is re-read when it
+// changed on disk, so tokens created by the CLI are picked up by the running
+// service.
+type tokenStore struct {
+	path string
+
+	mu      sync.Mutex
+	tokens  []*apiToken
+	modTime time.Time
+}
+
+func loadTokenStore(path string) (*tokenStore, error) {
+	s := &tokenStore{path: path}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.refresh(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// refresh re-reads the token file if it was modified. Callers hold s.mu.
+func (s *tokenStore) refresh() error {
+	info, err := os.Stat(s.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		s.tokens = nil
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !info.ModTime().After(s.modTime) && s.tokens != nil {
+		return nil
+	}
+
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return fmt.Errorf("failed to read token file %s: %v", s.path, err)
+	}
+	tokens := []*apiToken{}
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return fmt.Errorf("failed to parse token file %s: %v", s.path, err)
+	}
+	s.tokens = tokens
+	s.modTime = info.ModTime()
+	return nil
+}
+
+// save writes the token file. Callers hold s.mu.
+func (s *tokenStore) save() error {
+	data, err := json.MarshalIndent(s.tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o700); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("failed to write token file: %v", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	if info, err := os.Stat(s.path); err == nil {
+		s.modTime = info.ModTime()
+	}
+	return nil
+}
+
+func (s *tokenStore) List() ([]*apiToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.refresh(); err != nil {
+		return nil, err
+	}
+	return slices.Clone(s.tokens), nil
+}
+
+// Create adds a token and returns its plain value. A ttl of zero means the
+// token does not expire.
+func (s *tokenStore) Create(name string, scopes []string, ttl time.Duration) (string, *apiToken, error) {
+	if name == "" {
+		return "", nil, fmt.Errorf("token name must not be empty")
+	}
+	if len(scopes) == 0 {
+		return "", nil, fmt.Errorf("at least one scope is required")
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(allScopes, scope) {
+			return "", nil, fmt.Errorf("unknown scope %q, valid scopes: %s", scope, strings.Join(allScopes, ", "))
+		}
+	}
+
+	id := hex.EncodeToString(generateRandomKey(4))
+	secret := base64.RawURLEncoding.EncodeToString(generateRandomKey(32))
+	token := &apiToken{
+		ID:         id,
+		Name:       name,
+		SecretHash: hashTokenSecret(secret),
+		Scopes:     scopes,
+		CreatedAt:  time.Now(),
+	}
+	if ttl > 0 {
+		expiresAt := token.CreatedAt.Add(ttl)
+		token.ExpiresAt = &expiresAt
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.refresh(); err != nil {
+		return "", nil, err
+	}
+	s.tokens = append(s.tokens, token)
+	if err := s.save(); err != nil {
+		return "", nil, err
+	}
+	return tokenPrefix + id + "_" + secret, token, nil
+}
+
+func (s *tokenStore) Revoke(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.refresh(); err != nil {
+		return err
+	}
+	n := len(s.tokens)
+	s.tokens = slices.DeleteFunc(s.tokens, func(t *apiToken) bool { return t.ID == id })
+	if len(s.tokens) == n {
+		return fmt.Errorf("token not found: %s", id)
+	}
+	return s.save()
+}
+
+// Authenticate returns the token matching the plain value if it exists and
+// has not expired.
+func (s *tokenStore) Authenticate(raw string) (*apiToken, error) {
+	id, secret, ok := strings.Cut(strings.TrimPrefix(raw, tokenPrefix), "_")
+	if !ok || !strings.HasPrefix(raw, tokenPrefix) {
+		return nil, fmt.Errorf("malformed token")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.refresh(); err != nil {
+		return nil, err
+	}
+	hash := hashTokenSecret(secret)
+	for _, token := range s.tokens {
+		if token.ID != id {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(token.SecretHash), []byte(hash)) != 1 {
+			return nil, fmt.Errorf("invalid token")
+		}
+		if token.Expired() {
+			return nil, fmt.Errorf("token expired")
+		}
+		return token, nil
+	}
+	return nil, fmt.Errorf("invalid token")
+}
+
+func hashTokenSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// parseScopes splits a comma separated scope list.
+func parseScopes(input string) []string {
+	scopes := []string{}
+	for _, scope := range strings.Split(input, ",") {
+		if scope = strings.TrimSpace(scope); scope != "" {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes
+}
+
+func handleTokenArgs(args []string) int {
+	usage := func() {
+		fmt.Println("Usage: unmounter token <command>")
+		fmt.Println("Commands:")
+		fmt.Println("  create <name> <scope,scope,...> [ttl]   e.g. token create homeassistant status:read,mount:unmount 8760h")
+		fmt.Println("  list")
+		fmt.Println("  revoke <id>")
+		fmt.Println("Scopes:", strings.Join(allScopes, ", "))
+	}
+	if len(args) < 1 {
+		usage()
+		return exitUsage
+	}
+
+	tokens, err := loadTokenStore(config().Auth.TokensFile)
+	if err != nil {
+		fmt.Println("Failed to load tokens:", err)
+		return exitFailure
+	}
+
+	switch args[0] {
+	case "create":
+		if len(args) < 3 {
+			usage()
+			return exitUsage
+		}
+		var ttl time.Duration
+		if len(args) > 3 {
+			ttl, err = time.ParseDuration(args[3])
+			if err != nil {
+				fmt.Println("Invalid ttl:", err)
+				return exitUsage
+			}
+		}
+		plain, token, err := tokens.Create(args[1], parseScopes(args[2]), ttl)
+		if err != nil {
+			auditCLI("token.create", args[1], err)
+			fmt.Println("Failed to create token:", err)
+			return exitFailure
+		}
+		auditCLI("token.create", token.ID+" ("+token.Name+": "+token.ScopeList()+")", nil)
+		fmt.Println("Token", token.ID, "created for", token.Name)
+		fmt.Println("Store it now, it will not be shown again:")
+		fmt.Println(plain)
+	case "list":
+		list, err := tokens.List()
+		if err != nil {
+			fmt.Println("Failed to list tokens:", err)
+			return exitFailure
+		}
+		for _, token := range list {
+			expires := "never"
+			if token.ExpiresAt != nil {
+				expires = token.ExpiresAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%s  %-20s  %-40s  expires: %s\n", token.ID, token.Name, token.ScopeList(), expires)
+		}
+	case "revoke":
+		if len(args) < 2 {
+			usage()
+			return exitUsage
+		}
+		err := tokens.Revoke(args[1])
+		auditCLI("token.revoke", args[1], err)
+		if err != nil {
+			fmt.Println("Failed to revoke token:", err)
+			return exitFailure
+		}
+		fmt.Println("Token revoked")
+	default:
+		usage()
+		return exitUsage
+	}
+	return exitOK
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/safehtml"
+	"github.com/google/safehtml/uncheckedconversions"
+	"rsc.io/qr"
+)
+
+// RFC 6238 parameters, the defaults every authenticator app supports.
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	totpSkew   = 1 // accepted steps before and after the current one
+	totpIssuer = "Unmounter"
+
+	recoveryCodeCount = 10
+)
+
+// Values for TOTP_MODE.
+const (
+	totpModeLogin  = "login"
+	totpModeStepUp = "step-up"
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpCode computes the RFC 4226 HOTP value for the given counter.
+func totpCode(secret []byte, counter int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(counter))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	modulus := uint32(math.Pow10(totpDigits))
+	return fmt.Sprintf("%0*d", totpDigits, value%modulus)
+}
+
+// totpMatch returns the counter the code is valid for, or -1.
+func totpMatch(secret []byte, code string, now time.Time) int64 {
+	current := now.Unix() / totpPeriod
+	for counter := current - totpSkew; counter <= current+totpSkew; counter++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, counter)), []byte(code)) == 1 {
+			return counter
+		}
+	}
+	return -1
+}
+
+type totpEnrollment struct {
+	Secret        string    `json:"secret"`
+	Enabled       bool      `json:"enabled"`
+	RecoveryCodes []string  `json:"recoveryCodes,omitempty"` // sha256 hashes
+	LastCounter   int64     `json:"lastCounter"`
+	CreatedAt     time.Time `json:"createdAt"`
+}
+
+// totpStore keeps the per-user enrollments in a JSON file. The file is re-read
+// when it changed on disk, so an enrollment disabled by the CLI is not written
+// back by the running service.
+type totpStore struct {
+	path string
+
+	mu      sync.Mutex
+	users   map[string]*totpEnrollment
+	modTime time.Time
+}
+
+var totps *totpStore
+
+func loadTOTPStore(path string) (*totpStore, error) {
+	s := &totpStore{path: path}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.refresh(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// refresh re-reads the enrollments if the file was modified. Callers hold s.mu.
+func (s *totpStore) refresh() error {
+	info, err := os.Stat(s.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		s.users = map[string]*totpEnrollment{}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !info.ModTime().After(s.modTime) && s.users != nil {
+		return nil
+	}
+
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return fmt.Errorf("failed to read totp file %s: %v", s.path, err)
+	}
+	users := map[string]*totpEnrollment{}
+	if err := json.Unmarshal(data, &users); err != nil {
+		return fmt.Errorf("failed to parse totp file %s: %v", s.path, err)
+	}
+	s.users = users
+	s.modTime = info.ModTime()
+	return nil
+}
+
+// current refreshes the enrollments for a read-only lookup, keeping the ones
+// in memory if the file can't be read. Callers hold s.mu.
+func (s *totpStore) current() {
+	if err := s.refresh(); err != nil {
+		logger.Warningf("[2fa] %v", err)
+	}
+}
+
+// save writes the enrollments. Callers hold s.mu.
+func (s *totpStore) save() error {
+	data, err := json.MarshalIndent(s.users, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o700); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("failed to write totp file: %v", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	if info, err := os.Stat(s.path); err == nil {
+		s.modTime = info.ModTime()
+	}
+	return nil
+}
+
+func (s *totpStore) Enabled(user string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.current()
+	e, ok := s.users[user]
+	return ok && e.Enabled
+}
+
+// Pending returns the secret of an enrollment that still awaits its first code.
+func (s *totpStore) Pending(user string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.current()
+	e, ok := s.users[user]
+	if !ok || e.Enabled {
+		return "", false
+	}
+	return e.Secret, true
+}
+
+// Begin starts an enrollment with a new secret. It is only active after
+// Confirm succeeded with a code from the authenticator app.
+func (s *totpStore) Begin(user string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.refresh(); err != nil {
+		return "", err
+	}
+	if e, ok := s.users[user]; ok && e.Enabled {
+		return "", fmt.Errorf("two-factor authentication is already enabled")
+	}
+	secret := totpEncoding.EncodeToString(generateRandomKey(20))
+	s.users[user] = &totpEnrollment{Secret: secret, CreatedAt: time.Now()}
+	return secret, s.save()
+}
+
+// Confirm activates a pending enrollment and returns the recovery codes.
+func (s *totpStore) Confirm(user, code string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.refresh(); err != nil {
+		return nil, err
+	}
+	e, ok := s.users[user]
+	if !ok || e.Enabled {
+		return nil, fmt.Errorf("no pending enrollment")
+	}
+	secret, err := totpEncoding.DecodeString(e.Secret)
+	if err != nil {
+		return nil, err
+	}
+	counter := totpMatch(secret, normalizeCode(code), time.Now())
+	if counter < 0 {
+		return nil, fmt.Errorf("invalid code, check the time on your phone")
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	e.RecoveryCodes = make([]string, recoveryCodeCount)
+	for i := range codes {
+		codes[i] = strings.ToLower(totpEncoding.EncodeToString(generateRandomKey(5)))
+		e.RecoveryCodes[i] = hashTokenSecret(codes[i])
+	}
+	e.Enabled = true
+	e.LastCounter = counter
+	return codes, s.save()
+}
+
+// Verify checks a TOTP code or consumes a recovery code. A TOTP code can only
+// be used once.
+func (s *totpStore) Verify(user, code string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.refresh(); err != nil {
+		return err
+	}
+	e, ok := s.users[user]
+	if !ok || !e.Enabled {
+		return fmt.Errorf("two-factor authentication is not enabled")
+	}
+	code = normalizeCode(code)
+
+	secret, err := totpEncoding.DecodeString(e.Secret)
+	if err != nil {
+		return err
+	}
+	if counter := totpMatch(secret, code, time.Now()); counter >= 0 {
+		if counter <= e.LastCounter {
+			return fmt.Errorf("code already used, wait for the next one")
+		}
+		e.LastCounter = counter
+		return s.save()
+	}
+
+	hash := hashTokenSecret(code)
+	for i, recovery := range e.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(recovery), []byte(hash)) == 1 {
+			e.RecoveryCodes = append(e.RecoveryCodes[:i], e.RecoveryCodes[i+1:]...)
+			audit.Record(auditEntry{User: user, Action: "2fa.recovery_code", Target: fmt.Sprintf("%d codes left", len(e.RecoveryCodes)), Outcome: auditSuccess})
+			return s.save()
+		}
+	}
+	return fmt.Errorf("invalid two-factor code")
+}
+
+func (s *totpStore) RecoveryCodesLeft(user string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.current()
+	if e, ok := s.users[user]; ok {
+		return len(e.RecoveryCodes)
+	}
+	return 0
+}
+
+func (s *totpStore) Disable(user string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.refresh(); err != nil {
+		return err
+	}
+	if _, ok := s.users[user]; !ok {
+		return fmt.Errorf("two-factor authentication is not enabled for %s", user)
+	}
+	delete(s.users, user)
+	return s.save()
+}
+
+func normalizeCode(code string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), " ", ""))
+}
+
+// totpURI is the otpauth:// URI understood by authenticator apps.
+func totpURI(user, secret string) string {
+	label := url.PathEscape(totpIssuer + ":" + user)
+	params := url.Values{"secret": {secret}, "issuer": {totpIssuer}, "period": {"30"}, "digits": {"6"}}
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// totpQRCode renders the enrollment URI as a PNG data URL.
+func totpQRCode(user, secret string) (safehtml.URL, error) {
+	code, err := qr.Encode(totpURI(user, secret), qr.M)
+	if err != nil {
+		return safehtml.URL{}, err
+	}
+	code.Scale = 6
+	dataURL := "data:image/png;base64," + base64.StdEncoding.EncodeToString(code.PNG())
+	return uncheckedconversions.URLFromStringKnownToSatisfyTypeContract(dataURL), nil
+}
+
+// stepUpRequired reports whether the caller has to confirm a destructive
+// action with a second factor.
+func stepUpRequired(p *principal) bool {
+	return config().Auth.TOTPMode == totpModeStepUp && p != nil && !p.IsToken() && totps.Enabled(p.Name)
+}
+
+// verifyStepUp checks the "otp" form field when a step-up is required.
+func verifyStepUp(r *http.Request) error {
+	p := principalFrom(r)
+	if !stepUpRequired(p) {
+		return nil
+	}
+	if err := totps.Verify(p.Name, r.FormValue("otp")); err != nil {
+		recordLoginFailure(r, p.Name)
+		return err
+	}
+	return nil
+}
+
+func handleTOTPArgs(args []string) int {
+	if len(args) < 2 || args[0] != "disable" {
+		fmt.Println("Usage: unmounter 2fa disable <user>")
+		return exitUsage
+	}
+	store, err := loadTOTPStore(config().Auth.TOTPFile)
+	if err != nil {
+		fmt.Println("Failed to load 2fa enrollments:", err)
+		return exitFailure
+	}
+	err = store.Disable(args[1])
+	auditCLI("2fa.disable", args[1], err)
+	if err != nil {
+		fmt.Println("Failed to disable 2fa:", err)
+		return exitFailure
+	}
+	fmt.Println("Two-factor authentication disabled for", args[1])
+	return exitOK
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Webhook events.
+const (
+	webhookDriveAttached  = "drive.attached"  // block device appeared
+	webhookDriveDetached  = "drive.detached"  // block device disappeared
+	webhookDriveMounted   = "drive.mounted"   // mounted, e.g. by autofs
+	webhookDriveUnmounted = "drive.unmounted" // unmounted here or no longer mounted
+	webhookUnmountFailed  = "unmount.failed"  // with the processes blocking it
+	webhookProcessKilled  = "process.killed"  // killed here
+	webhookServiceChanged = "service.changed" // a managed unit became active or inactive
+	webhookAlertFiring    = "alert.firing"
+	webhookAlertResolved  = "alert.resolved"
+	webhookScheduleFailed = "schedule.failed" // a scheduled job failed its pre-checks or action
+)
+
+const (
+	maxPendingDeliveries = 1000 // the oldest are dropped beyond this
+	maxDeliveryBackoff   = time.Hour
+)
+
+var webhookEvents = []string{webhookDriveAttached, webhookDriveDetached, webhookDriveMounted, webhookDriveUnmounted, webhookUnmountFailed, webhookProcessKilled, webhookServiceChanged, webhookAlertFiring, webhookAlertResolved, webhookScheduleFailed}
+
+// webhookPayload is the JSON body posted to the endpoints.
+type webhookPayload struct {
+	ID    string    `json:"id"` // the same for all endpoints and retries
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+	Host  string    `json:"host"`
+	Data  any       `json:"data"`
+}
+
+type webhookDriveData struct {
+	UUID     string  `json:"uuid"`
+	Device   string  `json:"device"`
+	Path     string  `json:"path,omitempty"`
+	User     string  `json:"user,omitempty"` // empty if noticed by a status collection
+	Error    string  `json:"error,omitempty"`
+	Blockers []Usage `json:"blockers,omitempty"`
+}
+
+type webhookProcessData struct {
+	PID     int      `json:"pid"`
+	Command string   `json:"command,omitempty"`
+	User    string   `json:"user"`
+	Paths   []string `json:"paths,omitempty"` // drives it was using
+}
+
+type webhookScheduleData struct {
+	Name   string `json:"name"`
+	Action string `json:"action"`
+	Target string `json:"target"`
+	User   string `json:"user"`
+	Error  string `json:"error"`
+}
+
+type webhookServiceData struct {
+	Name   string `json:"name"`
+	Unit   string `json:"unit"`
+	Active bool   `json:"active"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// webhookDelivery is a payload waiting to be posted to one endpoint.
+type webhookDelivery struct {
+	ID          string          `json:"id"`
+	Endpoint    string          `json:"endpoint"` // webhooks.endpoints[].name
+	Event       string          `json:"event"`
+	Body        json.RawMessage `json:"body"`
+	Attempts    int             `json:"attempts"`
+	NextAttempt time.Time       `json:"nextAttempt"`
+	LastError   string          `json:"lastError,omitempty"`
+}
+
+// webhookDispatcher posts events to the configured endpoints. Pending
+// deliveries are kept in an outbox file so they survive a restart while the
+// receiver is down.
+type webhookDispatcher struct {
+	path   string // empty keeps the outbox in memory
+	client *http.Client
+	wake   chan struct{}
+
+	mu       sync.Mutex
+	pending  []*webhookDelivery
+	services map[string]ServiceStatus // by unit, nil before the first status
+	devices  map[string]string        // device by filesystem UUID, nil before the first status
+}
+
+var webhooks = newWebhookDispatcher("")
+
+func newWebhookDispatcher(path string) *webhookDispatcher {
+	return &webhookDispatcher{path: path, client: &http.Client{}, wake: make(chan struct{}, 1)}
+}
+
+func loadWebhookDispatcher(path string) (*webhookDispatcher, error) {
+	d := newWebhookDispatcher(path)
+	if path == "" {
+		return d, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return d, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read webhook outbox %s: %v", path, err)
+	}
+	if err := json.Unmarshal(data, &d.pending); err != nil {
+		return nil, fmt.Errorf("failed to parse webhook outbox %s: %v", path, err)
+	}
+	return d, nil
+}
+
+// save writes the outbox. Callers hold d.mu.
+func (d *webhookDispatcher) save() {
+	if d.path == "" {
+		return
+	}
+	data, err := json.Marshal(d.pending)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(d.path), 0o700)
+	}
+	if err == nil {
+		tmp := d.path + ".tmp"
+		if err = os.WriteFile(tmp, data, 0o600); err == nil {
+			err = os.Rename(tmp, d.path)
+		}
+	}
+	if err != nil {
+		logger.Errorf("[webhooks] failed to write %s: %v", d.path, err)
+	}
+}
+
+// Pending returns the number of deliveries waiting in the outbox.
+func (d *webhookDispatcher) Pending() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.pending)
+}
+
+// Emit queues an event for every endpoint subscribed to it.
+func (d *webhookDispatcher) Emit(event string, data any) {
+	endpoints := []string{}
+	for _, endpoint := range config().Webhooks.Endpoints {
+		if len(endpoint.Events) == 0 || slices.Contains(endpoint.Events, event) {
+			endpoints = append(endpoints, endpoint.Name)
+		}
+	}
+	if len(endpoints) == 0 {
+		return
+	}
+
+	host, _ := os.Hostname()
+	payload := webhookPayload{ID: hex.EncodeToString(generateRandomKey(8)), Event: event, Time: time.Now(), Host: host, Data: data}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		logger.Errorf("[webhooks] %s: %v", event, err)
+		return
+	}
+
+	d.mu.Lock()
+	for _, endpoint := range endpoints {
+		d.pending = append(d.pending, &webhookDelivery{ID: payload.ID, Endpoint: endpoint, Event: event, Body: body, NextAttempt: payload.Time})
+	}
+	if dropped := len(d.pending) - maxPendingDeliveries; dropped > 0 {
+		logger.Warningf("[webhooks] outbox full, dropping the %d oldest deliveries", dropped)
+		d.pending = slices.Delete(d.pending, 0, dropped)
+	}
+	d.save()
+	d.mu.Unlock()
+
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Observe compares a status collection with the previous one and emits
+// service state changes and attached or detached drives. Mounts and unmounts
+// are emitted by the drive history.
+func (d *webhookDispatcher) Observe(status *SystemStatus) {
+	devices, devicesErr := attachedDrives()
+
+	d.mu.Lock()
+	prevServices, prevDevices := d.services, d.devices
+	d.services = map[string]ServiceStatus{}
+	for unit, svc := range prevServices {
+		d.services[unit] = svc // a failed probe keeps the last known state
+	}
+	for _, svc := range status.Services {
+		if svc.Error == "" {
+			d.services[svc.Unit] = svc
+		}
+	}
+	if devicesErr == nil {
+		d.devices = devices
+	}
+	d.mu.Unlock()
+
+	if prevServices != nil {
+		for _, svc := range status.Services {
+			if prev, ok := prevServices[svc.Unit]; ok && svc.Error == "" && prev.Active != svc.Active {
+				d.Emit(webhookServiceChanged, webhookServiceData{Name: svc.Name, Unit: svc.Unit, Active: svc.Active, Detail: svc.Detail})
+			}
+		}
+	}
+	if devicesErr != nil || prevDevices == nil {
+		return
+	}
+	for _, uuid := range sortedKeys(devices) {
+		if _, ok := prevDevices[uuid]; !ok {
+			d.Emit(webhookDriveAttached, webhookDriveData{UUID: uuid, Device: devices[uuid]})
+		}
+	}
+	for _, uuid := range sortedKeys(prevDevices) {
+		if _, ok := devices[uuid]; !ok {
+			data := webhookDriveData{UUID: uuid, Device: prevDevices[uuid]}
+			if drive, ok := history.Drive(uuid); ok {
+				data.Path = drive.Path
+			}
+			d.Emit(webhookDriveDetached, data)
+		}
+	}
+}
+
+// attachedDrives lists the block devices matching mounts.device_prefixes by
+// filesystem UUID, whether mounted or not.
+func attachedDrives() (map[string]string, error) {
+	const dir = "/dev/disk/by-uuid"
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	devices := map[string]string{}
+	for _, entry := range entries {
+		target, err := filepath.EvalSymlinks(filepath.Join(dir, entry.Name()))
+		if err == nil && slices.ContainsFunc(config().Mounts.DevicePrefixes, func(prefix string) bool { return strings.HasPrefix(target, prefix) }) {
+			devices[entry.Name()] = target
+		}
+	}
+	return devices, nil
+}
+
+// Run delivers the outbox until ctx is done. It also collects the status
+// every webhooks.interval, so a drive that disappears is noticed without
+// anybody looking at the page.
+func (d *webhookDispatcher) Run(ctx context.Context) {
+	go d.watch(ctx)
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-d.wake:
+		case <-timer.C:
+		}
+		next := d.deliverDue(ctx)
+		timer.Reset(max(time.Until(next), time.Second))
+	}
+}
+
+func (d *webhookDispatcher) watch(ctx context.Context) {
+	ticker := time.NewTicker(config().Webhooks.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if len(config().Webhooks.Endpoints) > 0 {
+				systemStatusCache.Get(ctx, false)
+			}
+			ticker.Reset(config().Webhooks.Interval)
+		}
+	}
+}
+
+// deliverDue attempts the deliveries that are due, one at a time, and returns
+// when the next one is due.
+func (d *webhookDispatcher) deliverDue(ctx context.Context) time.Time {
+	next := time.Now().Add(maxDeliveryBackoff)
+	d.mu.Lock()
+	due := []*webhookDelivery{}
+	for _, delivery := range d.pending {
+		if !delivery.NextAttempt.After(time.Now()) {
+			due = append(due, delivery)
+		} else if delivery.NextAttempt.Before(next) {
+			next = delivery.NextAttempt
+		}
+	}
+	d.mu.Unlock()
+	if len(due) == 0 {
+		return next
+	}
+
+	done := map[*webhookDelivery]bool{}
+	for _, delivery := range due {
+		if ctx.Err() != nil {
+			break
+		}
+		endpoint, ok := config().Webhook(delivery.Endpoint)
+		if !ok {
+			logger.Warningf("[webhooks] dropping %s %s, endpoint %q is no longer configured", delivery.Event, delivery.ID, delivery.Endpoint)
+			done[delivery] = true
+			continue
+		}
+		err := d.post(ctx, endpoint, delivery)
+
+		d.mu.Lock() // the outbox may be saved meanwhile
+		delivery.Attempts++
+		switch {
+		case err == nil:
+			webhookDeliveriesTotal.Inc(endpoint.Name, "success")
+			done[delivery] = true
+		case delivery.Attempts >= config().Webhooks.MaxAttempts:
+			webhookDeliveriesTotal.Inc(endpoint.Name, "dropped")
+			logger.Errorf("[webhooks] giving up on %s %s to %s after %d attempts: %v", delivery.Event, delivery.ID, endpoint.Name, delivery.Attempts, err)
+			done[delivery] = true
+		default:
+			webhookDeliveriesTotal.Inc(endpoint.Name, "failure")
+			backoff := min(10*time.Second<<min(delivery.Attempts-1, 20), maxDeliveryBackoff) // the shift alone would overflow from attempt 31 on
+			delivery.NextAttempt, delivery.LastError = time.Now().Add(backoff), err.Error()
+			logger.Warningf("[webhooks] %s %s to %s failed, retry in %s: %v", delivery.Event, delivery.ID, endpoint.Name, backoff, err)
+			if delivery.NextAttempt.Before(next) {
+				next = delivery.NextAttempt
+			}
+		}
+		d.mu.Unlock()
+	}
+
+	d.mu.Lock()
+	d.pending = slices.DeleteFunc(d.pending, func(delivery *webhookDelivery) bool { return done[delivery] })
+	d.save()
+	d.mu.Unlock()
+	return next
+}
+
+// post sends one delivery. With a secret the body is signed as
+// X-Unmounter-Signature: sha256=hex(HMAC-SHA256(secret, timestamp + "." + body)).
+func (d *webhookDispatcher) post(ctx context.Context, endpoint WebhookEndpoint, delivery *webhookDelivery) error {
+	ctx, cancel := context.WithTimeout(ctx, config().Webhooks.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.URL, bytes.NewReader(delivery.Body))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "unmounter-webhooks")
+	req.Header.Set("X-Unmounter-Event", delivery.Event)
+	req.Header.Set("X-Unmounter-Delivery", delivery.ID)
+	req.Header.Set("X-Unmounter-Timestamp", timestamp)
+	if endpoint.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(endpoint.Secret))
+		mac.Write([]byte(timestamp + "."))
+		mac.Write(delivery.Body)
+		req.Header.Set("X-Unmounter-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"log"
 	"os"
 
@@ -10,22 +12,43 @@ import (
 var logger service.Logger
 
 func main() {
-	systemService, err := service.New(&systemService{}, serviceConfig)
-	if err != nil {
+	flag.StringVar(&configFile, "config", "", "path to the YAML config file (default "+defaultConfigFile+" if it exists)")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), cliUsage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if err := resolveConfigFile(); err != nil {
 		log.Fatal(err)
 	}
+	if flag.Arg(0) == "config" {
+		// Validation must also work for a broken config.
+		os.Exit(handleConfigArgs(flag.Args()[1:]))
+	}
+
+	if err := initConfig(); err != nil {
+		log.Println(err)
+		os.Exit(exitUsage)
+	}
 
-	if len(os.Args) > 1 {
-		handleServiceArgs(systemService)
-		return
+	systemService, err := service.New(&systemService{}, newServiceConfig())
+	if err != nil {
+		log.Fatal(err)
 	}
 
+	// CLI commands log to stderr, the service to the system log.
 	logger, err = systemService.Logger(nil)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	if flag.NArg() > 0 && flag.Arg(0) != "serve" {
+		os.Exit(handleServiceArgs(systemService, flag.Args()))
+	}
+
 	if err = systemService.Run(); err != nil {
 		logger.Error(err)
+		os.Exit(exitFailure)
 	}
 }
@@ -2,48 +2,998 @@
 package main
 
 import (
+	"bytes"
 	"crypto/rand"
+	_ "embed"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
 	"log"
+	"net"
+	"net/mail"
+	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
 	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/joho/godotenv" // 1. Import the godotenv library
+	"gopkg.in/yaml.v3"
 )
 
+// Environment variables override the values from the config file.
+const EnvVarConfigFile = "UNMOUNTER_CONFIG"
+
 // Configuration for the basic HTTP authentication
 const EnvVarAuthUser = "AUTH_USER"
 const EnvVarAuthPass = "AUTH_PASS"
 const EnvVarDevMode = "DEV_MODE"
 
+// Configuration for the persisted session and CSRF keys
+const EnvVarKeysFile = "KEYS_FILE"
+const EnvVarKeysGracePeriod = "KEYS_GRACE_PERIOD"
+
+// Configuration for the listeners and TLS
+const EnvVarListenAddr = "LISTEN_ADDR"
+const EnvVarTLSEnabled = "TLS_ENABLED"
+const EnvVarTLSCertFile = "TLS_CERT_FILE"
+const EnvVarTLSKeyFile = "TLS_KEY_FILE"
+const EnvVarHTTPRedirectAddr = "HTTP_REDIRECT_ADDR"
+
+// Configuration for the API tokens
+const EnvVarTokensFile = "TOKENS_FILE"
+
+// Configuration for the login lockout and the action rate limit
+const EnvVarAuthMaxFailures = "AUTH_MAX_FAILURES"
+const EnvVarAuthLockout = "AUTH_LOCKOUT"
+const EnvVarAuthMaxLockout = "AUTH_MAX_LOCKOUT"
+const EnvVarActionRateLimit = "ACTION_RATE_LIMIT"
+
+// Configuration for the two-factor authentication
+const EnvVarTOTPFile = "TOTP_FILE"
+const EnvVarTOTPMode = "TOTP_MODE"
+
+const defaultConfigFile = "/etc/unmounter/config.yaml"
+
+// Defaults for the first user, can be set at build time with -ldflags -X.
 var username = "admin"
 var password = "1b2a"
-var devModeEnabled = false
 
-func init() {
+// Roles of configured users and the scopes they grant.
+const (
+	roleAdmin    = "admin"
+	roleOperator = "operator"
+	roleViewer   = "viewer"
+)
+
+var roleScopes = map[string][]string{
+	roleAdmin:    allScopes,
+	roleOperator: {scopeStatusRead, scopeMountUnmount, scopeProcessKill, scopeServiceRestart, scopeDiskTest, scopeContainerManage},
+	roleViewer:   {scopeStatusRead},
+}
+
+//go:embed config.schema.json
+var configSchema []byte
+
+// Config is the structure of the YAML config file, see config.example.yaml.
+type Config struct {
+	DevMode   bool            `yaml:"dev_mode" json:"dev_mode"`
+	Listen    ListenConfig    `yaml:"listen" json:"listen"`
+	TLS       TLSConfig       `yaml:"tls" json:"tls"`
+	Auth      AuthConfig      `yaml:"auth" json:"auth"`
+	Mounts    MountPolicy     `yaml:"mounts" json:"mounts"`
+	Services  []ServiceEntry  `yaml:"services" json:"services"`
+	Samba     SambaConfig     `yaml:"samba" json:"samba"`
+	Kill      KillPolicy      `yaml:"kill" json:"kill"`
+	Commands  CommandPaths    `yaml:"commands" json:"commands"`
+	Timeouts  Timeouts        `yaml:"timeouts" json:"timeouts"`
+	Audit     AuditConfig     `yaml:"audit" json:"audit"`
+	History   HistoryConfig   `yaml:"history" json:"history"`
+	Metrics   MetricsConfig   `yaml:"metrics" json:"metrics"`
+	MQTT      MQTTConfig      `yaml:"mqtt" json:"mqtt"`
+	Webhooks  WebhooksConfig  `yaml:"webhooks" json:"webhooks"`
+	Alerts    AlertsConfig    `yaml:"alerts" json:"alerts"`
+	SMART     SMARTConfig     `yaml:"smart" json:"smart"`
+	Idle      IdleConfig      `yaml:"idle" json:"idle"`
+	Schedules SchedulesConfig `yaml:"schedules" json:"schedules"`
+	Hooks     HooksConfig     `yaml:"hooks" json:"hooks"`
+	Docker    DockerConfig    `yaml:"docker" json:"docker"`
+}
+
+type ListenConfig struct {
+	Address         string `yaml:"address" json:"address"`
+	RedirectAddress string `yaml:"redirect_address" json:"redirect_address"`
+}
+
+type TLSConfig struct {
+	Enabled  bool   `yaml:"enabled" json:"enabled"`
+	CertFile string `yaml:"cert_file" json:"cert_file"`
+	KeyFile  string `yaml:"key_file" json:"key_file"`
+}
+
+type AuthConfig struct {
+	Users           []UserConfig  `yaml:"users" json:"users"`
+	KeysFile        string        `yaml:"keys_file" json:"keys_file"`
+	KeysGracePeriod time.Duration `yaml:"keys_grace_period" json:"keys_grace_period"`
+	TokensFile      string        `yaml:"tokens_file" json:"tokens_file"`
+	TOTPFile        string        `yaml:"totp_file" json:"totp_file"`
+	TOTPMode        string        `yaml:"totp_mode" json:"totp_mode"`
+	MaxFailures     int           `yaml:"max_failures" json:"max_failures"`
+	Lockout         time.Duration `yaml:"lockout" json:"lockout"`
+	MaxLockout      time.Duration `yaml:"max_lockout" json:"max_lockout"`
+	ActionRateLimit int           `yaml:"action_rate_limit" json:"action_rate_limit"` // per minute
+}
+
+type UserConfig struct {
+	Name     string `yaml:"name" json:"name"`
+	Password string `yaml:"password" json:"password"`
+	Role     string `yaml:"role" json:"role"`
+}
+
+// MountPolicy decides which mounts are listed and may be unmounted.
+type MountPolicy struct {
+	DevicePrefixes []string `yaml:"device_prefixes" json:"device_prefixes"`
+	PathPrefixes   []string `yaml:"path_prefixes" json:"path_prefixes"`
+}
+
+// ServiceEntry is a systemd unit shown in the services section.
+type ServiceEntry struct {
+	Name        string `yaml:"name" json:"name"`
+	Unit        string `yaml:"unit" json:"unit"`
+	Restartable bool   `yaml:"restartable" json:"restartable"`
+}
+
+type SambaConfig struct {
+	Enabled bool `yaml:"enabled" json:"enabled"`
+}
+
+type KillPolicy struct {
+	Signal            string        `yaml:"signal" json:"signal"`
+	EscalateAfter     time.Duration `yaml:"escalate_after" json:"escalate_after"` // KILL after TERM, 0 never
+	ProtectedCommands []string      `yaml:"protected_commands" json:"protected_commands"`
+}
+
+// CommandPaths are the binaries that are executed, privileged ones through sudo.
+type CommandPaths struct {
+	Sudo      string `yaml:"sudo" json:"sudo"`
+	Mount     string `yaml:"mount" json:"mount"`
+	Umount    string `yaml:"umount" json:"umount"`
+	Lsof      string `yaml:"lsof" json:"lsof"`
+	Kill      string `yaml:"kill" json:"kill"`
+	Systemctl string `yaml:"systemctl" json:"systemctl"`
+	Smbstatus string `yaml:"smbstatus" json:"smbstatus"`
+	Smartctl  string `yaml:"smartctl" json:"smartctl"`
+	Eject     string `yaml:"eject" json:"eject"`
+	Loginctl  string `yaml:"loginctl" json:"loginctl"`
+}
+
+// AuditConfig is the JSON lines log of privileged actions. An empty file only
+// logs them to the service log.
+type AuditConfig struct {
+	File      string `yaml:"file" json:"file"`
+	MaxSizeMB int    `yaml:"max_size_mb" json:"max_size_mb"` // rotate when the file grows over this
+	MaxFiles  int    `yaml:"max_files" json:"max_files"`     // rotated files to keep
+}
+
+// HistoryConfig is the per-drive timeline. The file is only written when an
+// event is recorded.
+type HistoryConfig struct {
+	File             string        `yaml:"file" json:"file"` // empty keeps it in memory until the next restart
+	MaxEvents        int           `yaml:"max_events" json:"max_events"`
+	MaxAge           time.Duration `yaml:"max_age" json:"max_age"`
+	SnapshotInterval time.Duration `yaml:"snapshot_interval" json:"snapshot_interval"` // free space snapshots per drive
+}
+
+// MetricsConfig is the Prometheus endpoint /metrics. Without token or public
+// it accepts the users and API tokens with status:read.
+type MetricsConfig struct {
+	Enabled bool   `yaml:"enabled" json:"enabled"`
+	Token   string `yaml:"token" json:"token"`   // bearer token only valid for /metrics
+	Public  bool   `yaml:"public" json:"public"` // no authentication at all
+}
+
+// MQTTConfig publishes the state to an MQTT broker with Home Assistant
+// discovery. Commands from the broker run with the role of User.
+type MQTTConfig struct {
+	Enabled         bool          `yaml:"enabled" json:"enabled"`
+	Broker          string        `yaml:"broker" json:"broker"` // tcp://host:1883 or ssl://host:8883
+	Username        string        `yaml:"username" json:"username"`
+	Password        string        `yaml:"password" json:"password"`
+	ClientID        string        `yaml:"client_id" json:"client_id"`
+	TopicPrefix     string        `yaml:"topic_prefix" json:"topic_prefix"`
+	DiscoveryPrefix string        `yaml:"discovery_prefix" json:"discovery_prefix"`
+	NodeID          string        `yaml:"node_id" json:"node_id"` // defaults to the hostname
+	Interval        time.Duration `yaml:"interval" json:"interval"`
+	User            string        `yaml:"user" json:"user"` // auth.users entry whose role authorizes commands; empty: read only
+}
+
+// WebhooksConfig posts drive, process and service events to HTTP endpoints.
+// Pending deliveries are kept in Outbox and retried with backoff.
+type WebhooksConfig struct {
+	Outbox      string            `yaml:"outbox" json:"outbox"`     // empty keeps them in memory until the next restart
+	Interval    time.Duration     `yaml:"interval" json:"interval"` // status collection to notice changes without page loads
+	Timeout     time.Duration     `yaml:"timeout" json:"timeout"`
+	MaxAttempts int               `yaml:"max_attempts" json:"max_attempts"`
+	Endpoints   []WebhookEndpoint `yaml:"endpoints" json:"endpoints"`
+}
+
+type WebhookEndpoint struct {
+	Name   string   `yaml:"name" json:"name"`
+	URL    string   `yaml:"url" json:"url"`
+	Secret string   `yaml:"secret" json:"secret"` // HMAC-SHA256 key of X-Unmounter-Signature; empty: unsigned
+	Events []string `yaml:"events" json:"events"` // empty: all events
+}
+
+// SMARTConfig controls reading the SMART data shown on the drive cards.
+type SMARTConfig struct {
+	Enabled  bool          `yaml:"enabled" json:"enabled"`
+	Interval time.Duration `yaml:"interval" json:"interval"` // how old a report may get, 1m while a self-test runs
+}
+
+// IdleConfig spins down or unmounts drives nobody uses.
+type IdleConfig struct {
+	Interval time.Duration `yaml:"interval" json:"interval"` // how often the I/O counters are read
+	Policies []IdlePolicy  `yaml:"policies" json:"policies"` // the first one matching a drive applies
+}
+
+type IdlePolicy struct {
+	Drives     []string      `yaml:"drives" json:"drives"`           // UUIDs or mount paths; empty: all drives
+	Action     string        `yaml:"action" json:"action"`           // standby or unmount
+	After      time.Duration `yaml:"after" json:"after"`             // idle time before the action; 0: only in quiet hours
+	QuietHours string        `yaml:"quiet_hours" json:"quiet_hours"` // local time range like 22:00-07:00
+	QuietAfter time.Duration `yaml:"quiet_after" json:"quiet_after"` // idle time before the action in quiet hours
+}
+
+// SchedulesConfig runs actions at fixed times, e.g. unmounting the backup
+// drive every Friday evening so it can be swapped.
+type SchedulesConfig struct {
+	State   string        `yaml:"state" json:"state"`       // last runs and jobs added on the page; empty: in memory only
+	CatchUp time.Duration `yaml:"catch_up" json:"catch_up"` // runs missed while the service was down are made up within this
+	Jobs    []ScheduleJob `yaml:"jobs" json:"jobs"`
+}
+
+type ScheduleJob struct {
+	Name   string   `yaml:"name" json:"name"`
+	Cron   string   `yaml:"cron" json:"cron"`     // minute hour day month weekday, local time
+	Action string   `yaml:"action" json:"action"` // unmount, eject, remount or restart
+	Drive  string   `yaml:"drive" json:"drive"`   // UUID or mount path, not for restart
+	Unit   string   `yaml:"unit" json:"unit"`     // restart: a restartable service, defaults to autofs
+	Notify []string `yaml:"notify" json:"notify"` // on failure: webhook, email; empty: both
+}
+
+// HooksConfig runs commands around the lifecycle of a drive, e.g. stopping
+// a container before it is unmounted or rescanning a media library after it
+// is mounted.
+type HooksConfig struct {
+	Interval    time.Duration `yaml:"interval" json:"interval"`         // how often mounts and attached drives are listed for post_mount and on_attach
+	PreUnmount  []Hook        `yaml:"pre_unmount" json:"pre_unmount"`   // before an unmount by unmounter
+	PostUnmount []Hook        `yaml:"post_unmount" json:"post_unmount"` // after a successful unmount by unmounter
+	PostMount   []Hook        `yaml:"post_mount" json:"post_mount"`     // after a drive was mounted by anyone
+	OnAttach    []Hook        `yaml:"on_attach" json:"on_attach"`       // after a drive was plugged in
+}
+
+type Hook struct {
+	Name           string            `yaml:"name" json:"name"`
+	Command        []string          `yaml:"command" json:"command"`                   // program and arguments, not run through a shell
+	Drives         []string          `yaml:"drives" json:"drives"`                     // UUIDs or mount paths; empty: all drives
+	Env            map[string]string `yaml:"env" json:"env"`                           // in addition to the UNMOUNTER_* variables
+	Timeout        time.Duration     `yaml:"timeout" json:"timeout"`                   // defaults to 1m
+	User           string            `yaml:"user" json:"user"`                         // run through sudo as this user; empty: the service user
+	AbortOnFailure bool              `yaml:"abort_on_failure" json:"abort_on_failure"` // pre_unmount only: a failure cancels the unmount
+}
+
+// DockerConfig shows the containers using a drive and lets them be stopped
+// instead of killing their processes.
+type DockerConfig struct {
+	Enabled     bool          `yaml:"enabled" json:"enabled"`
+	Socket      string        `yaml:"socket" json:"socket"`
+	StopTimeout time.Duration `yaml:"stop_timeout" json:"stop_timeout"` // before docker kills a stopping container
+}
+
+// AlertsConfig are the rules evaluated on the drives in the background.
+// Alerts are shown on every page and notified when they fire and resolve.
+type AlertsConfig struct {
+	Interval time.Duration `yaml:"interval" json:"interval"`
+	Rules    []AlertRule   `yaml:"rules" json:"rules"`
+	Email    EmailConfig   `yaml:"email" json:"email"`
+}
+
+type AlertRule struct {
+	Name     string        `yaml:"name" json:"name"`
+	Kind     string        `yaml:"kind" json:"kind"`         // free_percent, free_gb, inodes_free_percent, smart or missing
+	Drives   []string      `yaml:"drives" json:"drives"`     // UUIDs or mount paths; empty: all drives, required for missing
+	Below    float64       `yaml:"below" json:"below"`       // threshold kinds fire below this
+	Clear    float64       `yaml:"clear" json:"clear"`       // and resolve at or above this, defaults to 1.2 × below
+	For      time.Duration `yaml:"for" json:"for"`           // missing: how long the drive has to be gone
+	Severity string        `yaml:"severity" json:"severity"` // warning or critical
+	Notify   []string      `yaml:"notify" json:"notify"`     // webhook, mqtt, email; empty: all that are set up
+}
+
+// EmailConfig sends alerts through a local SMTP relay without authentication.
+type EmailConfig struct {
+	SMTP string   `yaml:"smtp" json:"smtp"` // host:port
+	From string   `yaml:"from" json:"from"` // defaults to unmounter@<hostname>
+	To   []string `yaml:"to" json:"to"`     // empty: no email
+}
+
+type Timeouts struct {
+	Command       time.Duration `yaml:"command" json:"command"`
+	Probe         time.Duration `yaml:"probe" json:"probe"`               // per status probe, e.g. lsof of one mount
+	StatusCache   time.Duration `yaml:"status_cache" json:"status_cache"` // 0 disables caching, concurrent requests still share one collection
+	RestartSettle time.Duration `yaml:"restart_settle" json:"restart_settle"`
+	Shutdown      time.Duration `yaml:"shutdown" json:"shutdown"` // deadline for running operations on stop
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Listen: ListenConfig{Address: ":8080"},
+		TLS: TLSConfig{
+			CertFile: "/var/lib/unmounter/tls-cert.pem",
+			KeyFile:  "/var/lib/unmounter/tls-key.pem",
+		},
+		Auth: AuthConfig{
+			Users:           []UserConfig{{Name: username, Password: password, Role: roleAdmin}},
+			KeysFile:        "/var/lib/unmounter/keys.json",
+			KeysGracePeriod: 24 * time.Hour,
+			TokensFile:      "/var/lib/unmounter/tokens.json",
+			TOTPFile:        "/var/lib/unmounter/totp.json",
+			TOTPMode:        totpModeStepUp,
+			MaxFailures:     5,
+			Lockout:         30 * time.Second,
+			MaxLockout:      time.Hour,
+			ActionRateLimit: 30,
+		},
+		Mounts: MountPolicy{
+			DevicePrefixes: []string{"/dev/sd"},
+			PathPrefixes:   []string{"/mnt/", "/media/"},
+		},
+		Services: []ServiceEntry{{Name: "Autofs", Unit: "autofs", Restartable: true}},
+		Samba:    SambaConfig{Enabled: true},
+		Kill:     KillPolicy{Signal: "KILL", EscalateAfter: 10 * time.Second, ProtectedCommands: []string{"systemd", "init", "sshd"}},
+		Commands: CommandPaths{
+			Sudo:      "sudo",
+			Mount:     "mount",
+			Umount:    "umount",
+			Lsof:      "lsof",
+			Kill:      "kill",
+			Systemctl: "systemctl",
+			Smbstatus: "smbstatus",
+			Smartctl:  "smartctl",
+			Eject:     "eject",
+			Loginctl:  "loginctl",
+		},
+		Timeouts: Timeouts{Command: 30 * time.Second, Probe: 10 * time.Second, StatusCache: 5 * time.Second, RestartSettle: 2 * time.Second, Shutdown: 30 * time.Second},
+		Audit:    AuditConfig{File: "/var/lib/unmounter/audit.jsonl", MaxSizeMB: 5, MaxFiles: 5},
+		Metrics:  MetricsConfig{Enabled: true},
+		MQTT:     MQTTConfig{Broker: "tcp://localhost:1883", ClientID: "unmounter", TopicPrefix: "unmounter", DiscoveryPrefix: "homeassistant", Interval: time.Minute},
+		History:  HistoryConfig{File: "/var/lib/unmounter/history.json", MaxEvents: 200, MaxAge: 90 * 24 * time.Hour, SnapshotInterval: 6 * time.Hour},
+		Alerts: AlertsConfig{
+			Interval: time.Minute,
+			Rules:    []AlertRule{{Name: "low-space", Kind: alertFreePercent, Below: 10, Clear: 15, Severity: alertWarning}},
+			Email:    EmailConfig{SMTP: "localhost:25"},
+		},
+		SMART:     SMARTConfig{Enabled: true, Interval: 30 * time.Minute},
+		Idle:      IdleConfig{Interval: time.Minute},
+		Schedules: SchedulesConfig{State: "/var/lib/unmounter/schedules.json", CatchUp: time.Hour},
+		Hooks:     HooksConfig{Interval: 10 * time.Second},
+		Docker:    DockerConfig{Socket: "/var/run/docker.sock", StopTimeout: 10 * time.Second},
+		Webhooks:  WebhooksConfig{Outbox: "/var/lib/unmounter/webhooks.json", Interval: time.Minute, Timeout: 10 * time.Second, MaxAttempts: 10},
+	}
+}
+
+var currentConfig atomic.Pointer[Config]
+
+// config returns the active configuration.
+func config() *Config {
+	return currentConfig.Load()
+}
+
+// configFile is the path given with -config, UNMOUNTER_CONFIG or the default
+// path if that exists. Empty means defaults and environment variables only.
+var configFile string
+
+// loadConfig reads the config file (if any) on top of the defaults, applies
+// the environment variable overrides and validates the result.
+func loadConfig(path string) (*Config, error) {
+	cfg := defaultConfig()
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config file: %v", err)
+		}
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	if err := applyEnvOverrides(cfg); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// applyEnvOverrides applies the environment variables of older versions,
+// which take precedence over the config file.
+func applyEnvOverrides(cfg *Config) error {
+	var errs []error
+	str := func(name string, target *string) {
+		if value, ok := os.LookupEnv(name); ok {
+			*target = value
+		}
+	}
+	boolean := func(name string, target *bool) {
+		if value, ok := os.LookupEnv(name); ok {
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %v", name, err))
+				return
+			}
+			*target = b
+		}
+	}
+	integer := func(name string, target *int) {
+		if value, ok := os.LookupEnv(name); ok {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %v", name, err))
+				return
+			}
+			*target = n
+		}
+	}
+	duration := func(name string, target *time.Duration) {
+		if value, ok := os.LookupEnv(name); ok {
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %v", name, err))
+				return
+			}
+			*target = d
+		}
+	}
+
+	boolean(EnvVarDevMode, &cfg.DevMode)
+	str(EnvVarListenAddr, &cfg.Listen.Address)
+	str(EnvVarHTTPRedirectAddr, &cfg.Listen.RedirectAddress)
+	boolean(EnvVarTLSEnabled, &cfg.TLS.Enabled)
+	str(EnvVarTLSCertFile, &cfg.TLS.CertFile)
+	str(EnvVarTLSKeyFile, &cfg.TLS.KeyFile)
+	str(EnvVarKeysFile, &cfg.Auth.KeysFile)
+	duration(EnvVarKeysGracePeriod, &cfg.Auth.KeysGracePeriod)
+	str(EnvVarTokensFile, &cfg.Auth.TokensFile)
+	str(EnvVarTOTPFile, &cfg.Auth.TOTPFile)
+	str(EnvVarTOTPMode, &cfg.Auth.TOTPMode)
+	integer(EnvVarAuthMaxFailures, &cfg.Auth.MaxFailures)
+	duration(EnvVarAuthLockout, &cfg.Auth.Lockout)
+	duration(EnvVarAuthMaxLockout, &cfg.Auth.MaxLockout)
+	integer(EnvVarActionRateLimit, &cfg.Auth.ActionRateLimit)
+
+	// AUTH_USER and AUTH_PASS replace the first user, keeping its role.
+	envUser, userOK := os.LookupEnv(EnvVarAuthUser)
+	envPass, passOK := os.LookupEnv(EnvVarAuthPass)
+	if userOK || passOK {
+		if len(cfg.Auth.Users) == 0 {
+			cfg.Auth.Users = []UserConfig{{Name: username, Password: password, Role: roleAdmin}}
+		}
+		if userOK {
+			cfg.Auth.Users[0].Name = envUser
+		}
+		if passOK {
+			cfg.Auth.Users[0].Password = envPass
+		}
+	}
+	return errors.Join(errs...)
+}
+
+var regexUnit = regexp.MustCompile(`^[a-zA-Z0-9@._-]+$`)
+
+// regexName limits the names of webhook endpoints and alert rules.
+var regexName = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// Validate reports all problems of the configuration at once.
+func (c *Config) Validate() error {
+	var errs []error
+	add := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if _, _, err := net.SplitHostPort(c.Listen.Address); err != nil {
+		add("listen.address: %v", err)
+	}
+	if c.Listen.RedirectAddress != "" {
+		if _, _, err := net.SplitHostPort(c.Listen.RedirectAddress); err != nil {
+			add("listen.redirect_address: %v", err)
+		}
+		if !c.TLS.Enabled {
+			add("listen.redirect_address requires tls.enabled")
+		}
+	}
+	if c.TLS.Enabled && (c.TLS.CertFile == "" || c.TLS.KeyFile == "") {
+		add("tls.cert_file and tls.key_file are required when tls is enabled")
+	}
+
+	if len(c.Auth.Users) == 0 {
+		add("auth.users: at least one user is required")
+	}
+	names := map[string]bool{}
+	for i, user := range c.Auth.Users {
+		if user.Name == "" || strings.Contains(user.Name, ":") {
+			add("auth.users[%d].name: must not be empty or contain ':'", i)
+		}
+		if names[user.Name] {
+			add("auth.users[%d].name: duplicate user %q", i, user.Name)
+		}
+		names[user.Name] = true
+		if len(user.Password) < 4 {
+			add("auth.users[%d].password: must have at least 4 characters", i)
+		}
+		if _, ok := roleScopes[user.Role]; !ok {
+			add("auth.users[%d].role: %q is not one of admin, operator, viewer", i, user.Role)
+		}
+	}
+	for name, path := range map[string]string{"auth.keys_file": c.Auth.KeysFile, "auth.tokens_file": c.Auth.TokensFile, "auth.totp_file": c.Auth.TOTPFile} {
+		if !filepath.IsAbs(path) {
+			add("%s: must be an absolute path", name)
+		}
+	}
+	if c.Auth.TOTPMode != totpModeLogin && c.Auth.TOTPMode != totpModeStepUp {
+		add("auth.totp_mode: %q is not one of login, step-up", c.Auth.TOTPMode)
+	}
+	if c.Auth.MaxFailures < 1 {
+		add("auth.max_failures: must be at least 1")
+	}
+	if c.Auth.ActionRateLimit < 1 {
+		add("auth.action_rate_limit: must be at least 1")
+	}
+	for name, d := range map[string]time.Duration{"auth.keys_grace_period": c.Auth.KeysGracePeriod, "auth.lockout": c.Auth.Lockout, "auth.max_lockout": c.Auth.MaxLockout, "timeouts.command": c.Timeouts.Command, "timeouts.probe": c.Timeouts.Probe, "timeouts.shutdown": c.Timeouts.Shutdown, "history.max_age": c.History.MaxAge, "history.snapshot_interval": c.History.SnapshotInterval, "webhooks.interval": c.Webhooks.Interval, "webhooks.timeout": c.Webhooks.Timeout, "alerts.interval": c.Alerts.Interval, "smart.interval": c.SMART.Interval, "idle.interval": c.Idle.Interval, "hooks.interval": c.Hooks.Interval, "docker.stop_timeout": c.Docker.StopTimeout} {
+		if d <= 0 {
+			add("%s: must be a positive duration", name)
+		}
+	}
+	if c.Audit.File != "" && !filepath.IsAbs(c.Audit.File) {
+		add("audit.file: must be an absolute path")
+	}
+	if c.Audit.MaxSizeMB < 1 {
+		add("audit.max_size_mb: must be at least 1")
+	}
+	if c.Audit.MaxFiles < 1 {
+		add("audit.max_files: must be at least 1")
+	}
+	if c.History.File != "" && !filepath.IsAbs(c.History.File) {
+		add("history.file: must be an absolute path")
+	}
+	if c.History.MaxEvents < 1 {
+		add("history.max_events: must be at least 1")
+	}
+	if c.Metrics.Public && c.Metrics.Token != "" {
+		add("metrics.token: not used with metrics.public")
+	}
+	if c.Metrics.Token != "" && len(c.Metrics.Token) < 16 {
+		add("metrics.token: must have at least 16 characters")
+	}
+	if c.MQTT.Enabled {
+		if u, err := url.Parse(c.MQTT.Broker); err != nil || u.Host == "" || !slices.Contains([]string{"tcp", "ssl", "tls", "mqtt", "mqtts", "ws", "wss"}, u.Scheme) {
+			add("mqtt.broker: %q is not a broker url like tcp://localhost:1883", c.MQTT.Broker)
+		}
+		for name, topic := range map[string]string{"mqtt.topic_prefix": c.MQTT.TopicPrefix, "mqtt.discovery_prefix": c.MQTT.DiscoveryPrefix} {
+			if topic == "" || strings.ContainsAny(topic, "+#") {
+				add("%s: must be a topic without wildcards", name)
+			}
+		}
+		if c.MQTT.Interval <= 0 {
+			add("mqtt.interval: must be a positive duration")
+		}
+		if _, ok := c.User(c.MQTT.User); c.MQTT.User != "" && !ok {
+			add("mqtt.user: %q is not in auth.users", c.MQTT.User)
+		}
+	}
+	if c.Webhooks.Outbox != "" && !filepath.IsAbs(c.Webhooks.Outbox) {
+		add("webhooks.outbox: must be an absolute path")
+	}
+	if c.Webhooks.MaxAttempts < 1 {
+		add("webhooks.max_attempts: must be at least 1")
+	}
+	endpoints := map[string]bool{}
+	for i, endpoint := range c.Webhooks.Endpoints {
+		if !regexName.MatchString(endpoint.Name) {
+			add("webhooks.endpoints[%d].name: %q must consist of letters, digits, - and _", i, endpoint.Name)
+		}
+		if endpoints[endpoint.Name] {
+			add("webhooks.endpoints[%d].name: duplicate name %q", i, endpoint.Name)
+		}
+		endpoints[endpoint.Name] = true
+		if u, err := url.Parse(endpoint.URL); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			add("webhooks.endpoints[%d].url: %q is not an http or https url", i, endpoint.URL)
+		}
+		if endpoint.Secret != "" && len(endpoint.Secret) < 16 {
+			add("webhooks.endpoints[%d].secret: must have at least 16 characters", i)
+		}
+		for _, event := range endpoint.Events {
+			if !slices.Contains(webhookEvents, event) {
+				add("webhooks.endpoints[%d].events: %q is not one of %s", i, event, strings.Join(webhookEvents, ", "))
+			}
+		}
+	}
+	rules := map[string]bool{}
+	for i, rule := range c.Alerts.Rules {
+		if !regexName.MatchString(rule.Name) {
+			add("alerts.rules[%d].name: %q must consist of letters, digits, - and _", i, rule.Name)
+		}
+		if rules[rule.Name] {
+			add("alerts.rules[%d].name: duplicate name %q", i, rule.Name)
+		}
+		rules[rule.Name] = true
+		switch rule.Kind {
+		case alertFreePercent, alertFreeGB, alertInodesFreePercent:
+			if rule.Below <= 0 {
+				add("alerts.rules[%d].below: must be positive for %s", i, rule.Kind)
+			}
+			if rule.Clear != 0 && rule.Clear <= rule.Below {
+				add("alerts.rules[%d].clear: must be above below", i)
+			}
+		case alertMissing:
+			if rule.For <= 0 {
+				add("alerts.rules[%d].for: must be a positive duration for missing", i)
+			}
+			if len(rule.Drives) == 0 {
+				add("alerts.rules[%d].drives: missing needs the drives to watch", i)
+			}
+		case alertSMART:
+			if !c.SMART.Enabled {
+				add("alerts.rules[%d].kind: smart needs smart.enabled", i)
+			}
+		default:
+			add("alerts.rules[%d].kind: %q is not one of %s", i, rule.Kind, strings.Join(alertKinds, ", "))
+		}
+		if rule.Severity != "" && rule.Severity != alertWarning && rule.Severity != alertCritical {
+			add("alerts.rules[%d].severity: %q is not one of warning, critical", i, rule.Severity)
+		}
+		for _, channel := range rule.Notify {
+			if !slices.Contains(alertChannels, channel) {
+				add("alerts.rules[%d].notify: %q is not one of %s", i, channel, strings.Join(alertChannels, ", "))
+			}
+		}
+	}
+	if len(c.Alerts.Email.To) > 0 {
+		if _, _, err := net.SplitHostPort(c.Alerts.Email.SMTP); err != nil {
+			add("alerts.email.smtp: %q is not host:port", c.Alerts.Email.SMTP)
+		}
+		for i, address := range append([]string{c.Alerts.Email.From}, c.Alerts.Email.To...) {
+			if _, err := mail.ParseAddress(address); address != "" && err != nil {
+				add("alerts.email: %q is not an email address", address)
+			} else if address == "" && i > 0 {
+				add("alerts.email.to: must not contain empty addresses")
+			}
+		}
+	}
+	if c.Schedules.State != "" && !filepath.IsAbs(c.Schedules.State) {
+		add("schedules.state: must be an absolute path")
+	}
+	if c.Schedules.CatchUp < 0 {
+		add("schedules.catch_up: must not be negative")
+	}
+	jobs := map[string]bool{}
+	for i, job := range c.Schedules.Jobs {
+		if jobs[job.Name] {
+			add("schedules.jobs[%d].name: duplicate name %q", i, job.Name)
+		}
+		jobs[job.Name] = true
+		for _, problem := range c.validateScheduleJob(job) {
+			add("schedules.jobs[%d].%s", i, problem)
+		}
+	}
+	if c.Docker.Enabled && !filepath.IsAbs(c.Docker.Socket) {
+		add("docker.socket: must be an absolute path")
+	}
+	hookNames := map[string]bool{}
+	for _, event := range hookEvents {
+		key := strings.ReplaceAll(event, "-", "_")
+		for i, hook := range c.Hooks.For(event) {
+			if hookNames[hook.Name] {
+				add("hooks.%s[%d].name: duplicate name %q", key, i, hook.Name)
+			}
+			hookNames[hook.Name] = true
+			for _, problem := range c.validateHook(event, hook) {
+				add("hooks.%s[%d].%s", key, i, problem)
+			}
+		}
+	}
+	for i, policy := range c.Idle.Policies {
+		if policy.Action != idleStandby && policy.Action != idleUnmount {
+			add("idle.policies[%d].action: %q is not one of standby, unmount", i, policy.Action)
+		}
+		if policy.After < 0 {
+			add("idle.policies[%d].after: must not be negative", i)
+		}
+		if policy.QuietHours == "" {
+			if policy.After == 0 {
+				add("idle.policies[%d].after: must be positive without quiet_hours", i)
+			}
+		} else if _, _, err := parseQuietHours(policy.QuietHours); err != nil {
+			add("idle.policies[%d].quiet_hours: %v", i, err)
+		} else if policy.QuietAfter <= 0 {
+			add("idle.policies[%d].quiet_after: must be positive with quiet_hours", i)
+		}
+	}
+	if c.Timeouts.StatusCache < 0 {
+		add("timeouts.status_cache: must not be negative")
+	}
+	if c.Auth.Lockout > c.Auth.MaxLockout {
+		add("auth.lockout: must not be longer than auth.max_lockout")
+	}
+
+	if len(c.Mounts.DevicePrefixes) == 0 {
+		add("mounts.device_prefixes: at least one prefix is required")
+	}
+	if len(c.Mounts.PathPrefixes) == 0 {
+		add("mounts.path_prefixes: at least one prefix is required")
+	}
+	for i, prefix := range c.Mounts.PathPrefixes {
+		if !strings.HasPrefix(prefix, "/") || !strings.HasSuffix(prefix, "/") || prefix == "/" {
+			add("mounts.path_prefixes[%d]: %q must be an absolute directory ending in /", i, prefix)
+		}
+	}
+
+	units := map[string]bool{}
+	for i, svc := range c.Services {
+		if svc.Name == "" {
+			add("services[%d].name: must not be empty", i)
+		}
+		if !regexUnit.MatchString(svc.Unit) {
+			add("services[%d].unit: %q is not a valid systemd unit name", i, svc.Unit)
+		}
+		if units[svc.Unit] {
+			add("services[%d].unit: duplicate unit %q", i, svc.Unit)
+		}
+		units[svc.Unit] = true
+	}
+
+	if c.Kill.Signal != "TERM" && c.Kill.Signal != "KILL" {
+		add("kill.signal: %q is not one of TERM, KILL", c.Kill.Signal)
+	}
+	if c.Kill.EscalateAfter < 0 {
+		add("kill.escalate_after: must not be negative")
+	}
+	for name, path := range map[string]string{"sudo": c.Commands.Sudo, "mount": c.Commands.Mount, "umount": c.Commands.Umount, "lsof": c.Commands.Lsof, "kill": c.Commands.Kill, "eject": c.Commands.Eject, "systemctl": c.Commands.Systemctl, "smbstatus": c.Commands.Smbstatus, "smartctl": c.Commands.Smartctl, "loginctl": c.Commands.Loginctl} {
+		if path == "" || strings.ContainsAny(path, " \t") {
+			add("commands.%s: must be a single executable name or path", name)
+		}
+	}
+
+	slices.SortFunc(errs, func(a, b error) int { return strings.Compare(a.Error(), b.Error()) })
+	return errors.Join(errs...)
+}
+
+// User returns the configured user with the given name.
+func (c *Config) User(name string) (UserConfig, bool) {
+	for _, user := range c.Auth.Users {
+		if user.Name == name {
+			return user, true
+		}
+	}
+	return UserConfig{}, false
+}
+
+// Webhook returns the configured webhook endpoint with the given name.
+func (c *Config) Webhook(name string) (WebhookEndpoint, bool) {
+	for _, endpoint := range c.Webhooks.Endpoints {
+		if endpoint.Name == name {
+			return endpoint, true
+		}
+	}
+	return WebhookEndpoint{}, false
+}
+
+// validateScheduleJob checks a job of the config file or the schedules page.
+func (c *Config) validateScheduleJob(job ScheduleJob) []string {
+	problems := []string{}
+	if !regexName.MatchString(job.Name) {
+		problems = append(problems, fmt.Sprintf("name: %q must be letters, digits, - and _", job.Name))
+	}
+	if _, err := parseCron(job.Cron); err != nil {
+		problems = append(problems, fmt.Sprintf("cron: %v", err))
+	}
+	switch job.Action {
+	case scheduleUnmount, scheduleEject, scheduleRemount:
+		if job.Drive == "" {
+			problems = append(problems, "drive: a UUID or mount path is required for "+job.Action)
+		} else if strings.HasPrefix(job.Drive, "/") && (!regexDevice.MatchString(job.Drive) || strings.Contains(job.Drive, "..") ||
+			!slices.ContainsFunc(c.Mounts.PathPrefixes, func(prefix string) bool { return strings.HasPrefix(job.Drive, prefix) })) {
+			problems = append(problems, fmt.Sprintf("drive: %q is not below mounts.path_prefixes", job.Drive))
+		}
+	case scheduleRestart:
+		if svc, ok := c.Service(job.ServiceUnit()); !ok || !svc.Restartable {
+			problems = append(problems, fmt.Sprintf("unit: %q is not a restartable service", job.ServiceUnit()))
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("action: %q is not one of %s", job.Action, strings.Join(scheduleActions, ", ")))
+	}
+	for _, channel := range job.Notify {
+		if !slices.Contains(scheduleChannels, channel) {
+			problems = append(problems, fmt.Sprintf("notify: %q is not one of %s", channel, strings.Join(scheduleChannels, ", ")))
+		}
+	}
+	return problems
+}
+
+// regexEnvName limits the names of variables passed to hooks.
+var regexEnvName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// regexUserName limits the users hooks run as.
+var regexUserName = regexp.MustCompile(`^[a-z_][a-z0-9_-]*[$]?$`)
+
+func (c *Config) validateHook(event string, hook Hook) []string {
+	problems := []string{}
+	if !regexName.MatchString(hook.Name) {
+		problems = append(problems, fmt.Sprintf("name: %q must be letters, digits, - and _", hook.Name))
+	}
+	if len(hook.Command) == 0 || hook.Command[0] == "" {
+		problems = append(problems, "command: a program is required")
+	}
+	for _, name := range sortedKeys(hook.Env) {
+		if !regexEnvName.MatchString(name) || strings.HasPrefix(name, "UNMOUNTER_") {
+			problems = append(problems, fmt.Sprintf("env: %q is not a valid variable name or is reserved", name))
+		}
+	}
+	if hook.Timeout < 0 {
+		problems = append(problems, "timeout: must not be negative")
+	}
+	if hook.User != "" && !regexUserName.MatchString(hook.User) {
+		problems = append(problems, fmt.Sprintf("user: %q is not a valid user name", hook.User))
+	}
+	if hook.AbortOnFailure && event != hookPreUnmount {
+		problems = append(problems, "abort_on_failure: only pre_unmount hooks can abort")
+	}
+	return problems
+}
+
+// For returns the hooks of an event.
+func (c HooksConfig) For(event string) []Hook {
+	switch event {
+	case hookPreUnmount:
+		return c.PreUnmount
+	case hookPostUnmount:
+		return c.PostUnmount
+	case hookPostMount:
+		return c.PostMount
+	case hookOnAttach:
+		return c.OnAttach
+	}
+	return nil
+}
+
+// Service returns the configured service for a systemd unit.
+func (c *Config) Service(unit string) (ServiceEntry, bool) {
+	for _, svc := range c.Services {
+		if svc.Unit == unit {
+			return svc, true
+		}
+	}
+	return ServiceEntry{}, false
+}
+
+// Redacted returns a copy without passwords, for printing.
+func (c *Config) Redacted() *Config {
+	redacted := *c
+	redacted.Auth.Users = slices.Clone(c.Auth.Users)
+	for i := range redacted.Auth.Users {
+		redacted.Auth.Users[i].Password = "********"
+	}
+	if redacted.MQTT.Password != "" {
+		redacted.MQTT.Password = "********"
+	}
+	if redacted.Metrics.Token != "" {
+		redacted.Metrics.Token = "********"
+	}
+	redacted.Webhooks.Endpoints = slices.Clone(c.Webhooks.Endpoints)
+	for i := range redacted.Webhooks.Endpoints {
+		if redacted.Webhooks.Endpoints[i].Secret != "" {
+			redacted.Webhooks.Endpoints[i].Secret = "********"
+		}
+	}
+	for _, hooks := range []*[]Hook{&redacted.Hooks.PreUnmount, &redacted.Hooks.PostUnmount, &redacted.Hooks.PostMount, &redacted.Hooks.OnAttach} {
+		*hooks = slices.Clone(*hooks)
+		for i := range *hooks {
+			if len((*hooks)[i].Env) == 0 {
+				continue
+			}
+			env := map[string]string{}
+			for name := range (*hooks)[i].Env {
+				env[name] = "********" // may hold API keys
+			}
+			(*hooks)[i].Env = env
+		}
+	}
+	return &redacted
+}
+
+// resolveConfigFile loads the .env file and determines the config file from
+// the -config flag, UNMOUNTER_CONFIG or the default path if that exists.
+func resolveConfigFile() error {
 	err := godotenv.Load() // 2. Load .env file at the beginning of init()
 	if err != nil {
 		log.Println("Error loading .env file, using system environment variables (if set)")
 	}
 
-	var ok bool
-
-	envUsername, ok := os.LookupEnv(EnvVarAuthUser)
-	if ok {
-		username = envUsername
+	if configFile == "" {
+		configFile = os.Getenv(EnvVarConfigFile)
 	}
-
-	envPassword, ok := os.LookupEnv(EnvVarAuthPass)
-	if ok {
-		password = envPassword
+	if configFile == "" {
+		if _, err := os.Stat(defaultConfigFile); err == nil {
+			configFile = defaultConfigFile
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	if configFile != "" {
+		if configFile, err = filepath.Abs(configFile); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	envDevMode, ok := os.LookupEnv(EnvVarDevMode)
-	if ok {
-		devModeEnabled, _ = strconv.ParseBool(envDevMode)
+// initConfig loads the configuration and makes it the active one.
+func initConfig() error {
+	cfg, err := loadConfig(configFile)
+	if err != nil {
+		return err
 	}
+	currentConfig.Store(cfg)
 
 	// Optional: Add logging to verify DEV_MODE
-	log.Printf("DEV_MODE environment variable: %s, parsed devModeEnabled: %v", os.Getenv("DEV_MODE"), devModeEnabled)
+	log.Printf("config file: %q, devModeEnabled: %v", configFile, cfg.DevMode)
+	return nil
+}
+
+func handleConfigArgs(args []string) int {
+	if len(args) < 1 {
+		fmt.Println("Usage: unmounter [-config <file>] config <validate|show|schema>")
+		return exitUsage
+	}
+	switch args[0] {
+	case "validate":
+		cfg, err := loadConfig(configFile)
+		if err != nil {
+			fmt.Println("Config is invalid:")
+			fmt.Println(err)
+			return exitFailure
+		}
+		source := configFile
+		if source == "" {
+			source = "defaults and environment"
+		}
+		fmt.Printf("Config is valid (%s, %d users, %d services)\n", source, len(cfg.Auth.Users), len(cfg.Services))
+		return exitOK
+	case "show":
+		cfg, err := loadConfig(configFile)
+		if err != nil {
+			fmt.Println(err)
+			return exitFailure
+		}
+		data, err := yaml.Marshal(cfg.Redacted())
+		if err != nil {
+			fmt.Println(err)
+			return exitFailure
+		}
+		os.Stdout.Write(data)
+		return exitOK
+	case "schema":
+		os.Stdout.Write(configSchema)
+		return exitOK
+	default:
+		fmt.Println("Usage: unmounter [-config <file>] config <validate|show|schema>")
+		return exitUsage
+	}
 }
 
 func generateRandomKey(length int) []byte {